@@ -1,35 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
+	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
-	"math/rand"
 
 	matrix "github.com/arvchahal/Limitly/server/matrix"
 	server "github.com/arvchahal/Limitly/server/rate" // Import your custom rate-limiting package
 )
 
-// Client represents a client with a rate limiter
-type Client struct {
-	limiter  server.RateLimiter
-	lastSeen time.Time
-}
-
 var (
-	clients   = make(map[string]*Client)
-	clientsMu sync.Mutex
+	// Per-client limiters, keyed by IP
+	clients        *server.KeyedLimiter
+	clientTTL      = 5 * time.Minute
+	maxClients     = 100000
+	clientOverflow = "evict"
+
+	// Shared store for limits enforced across several instances, set by -store
+	store     server.Store
+	storeAddr = ""
+
+	// Gossip of client consumption with other instances, set by -peers
+	gossip         *server.Gossip
+	gossipPeers    = ""
+	gossipInterval = 100 * time.Millisecond
+	gossipSecret   = ""
+	nodeID         = ""
+
+	// Tenant and global limits over the client ones, set by -tenant-header
+	// and -global-rate
+	hierarchy    *server.Hierarchy
+	tenantHeader = ""
+	tenantRate   = 100.0
+	tenantBurst  = 50
+	globalRate   = 0.0
+	globalBurst  = 500
+	borrow       = false
+
+	// Adapting the global rate to how the backends answer, set by -aimd
+	aimd       = false
+	aimdConfig = server.DefaultAIMDConfig()
+
+	// Units of quota each request costs, set by -cost
+	costFunc server.CostFunc = server.UnitCost
+	costSpec                 = ""
+
+	// Backends accepted requests are forwarded to, set by -backends or
+	// -backends-config; without any the server answers requests itself
+	pool           *server.Pool
+	backendsSpec   = ""
+	backendsConfig = ""
+	balancer       = "round_robin"
+	maxFailures    = 5
+	ejectTime      = 30 * time.Second
+	healthCheck    = server.DefaultHealthCheckConfig()
+	transport      = server.DefaultTransportConfig()
+
+	// Endpoints for operators only, such as the backends' health, served on
+	// their own listener set by -admin-addr
+	adminMux  = http.NewServeMux()
+	adminAddr = "127.0.0.1:8081"
+
+	// Client limiter state saved across restarts, set by -snapshot
+	snapshotPath     = ""
+	snapshotInterval = 30 * time.Second
 
 	// Rate limit parameters (modifiable via flags)
 	rateLimitAlgorithm = "token_bucket" // Default algorithm
-	requestsPerSecond  = 10
+	requestsPerSecond  = 10.0
 	burstLimit         = 5
 	windowSize         = time.Second
+	// Calendar period and timezone of the quota algorithm
+	quotaPeriod   = "day"
+	quotaTimezone = ""
+	// Limits enforced together by the composite algorithm, set by -limits
+	limits     []server.LimiterConfig
+	limitsSpec = ""
+	// JSON file describing the limiter instead of the flags above, set by
+	// -limiter-config
+	limiterFile = ""
+
+	// Concurrency limit or queue shared by all clients, set by algorithms such
+	// as concurrency and leaky_queue
+	inFlightLimiter server.InFlightLimiter
+	requestQueue    *server.LeakyQueue
+	queueSize       = 0
+	queueTimeout    = time.Duration(0)
+
+	// Limiters that adapt to how the backends answer, such as gradient's and
+	// the one -aimd sets up
+	observers []server.Observer
 
 	// Counters for requests
 	acceptedCount  int
@@ -288,61 +358,326 @@ func customFunction(r *http.Request) {
 	fmt.Println("ACCEPTED")
 }
 
-// getClientLimiter retrieves or initializes a rate limiter for a given IP
-func getClientLimiter(ip string) server.RateLimiter {
-	clientsMu.Lock()
-	defer clientsMu.Unlock()
+// newClientLimiter initializes a rate limiter for a newly seen client, with
+// its state in the shared store if there is one
+func newClientLimiter(ip string) server.RateLimiter {
+	var limiter server.RateLimiter
+	var err error
+	if store != nil {
+		limiter, err = server.NewStoreLimiter(store, "limitly:"+rateLimitAlgorithm+":"+ip, limiterConfig())
+	} else {
+		limiter, err = server.NewLimiter(limiterConfig())
+	}
+	if err != nil {
+		// Checked in main before any client is seen
+		log.Fatal(err)
+	}
+	return limiter
+}
 
-	if client, exists := clients[ip]; exists {
-		client.lastSeen = time.Now()
-		return client.limiter
+// limiterConfig describes the limiters set by the flags
+func limiterConfig() server.LimiterConfig {
+	return server.LimiterConfig{
+		Algorithm:    rateLimitAlgorithm,
+		Rate:         requestsPerSecond,
+		Burst:        burstLimit,
+		Window:       windowSize,
+		QueueSize:    queueSize,
+		QueueTimeout: queueTimeout,
+		Limits:       limits,
+		Period:       quotaPeriod,
+		Timezone:     quotaTimezone,
 	}
+}
 
-	var limiter server.RateLimiter
-	switch rateLimitAlgorithm {
-	case "token_bucket":
-		limiter = server.NewTokenBucket(burstLimit, time.Second/time.Duration(requestsPerSecond))
-	case "leaky_bucket":
-		limiter = server.NewLeakyBucket(burstLimit, time.Second/time.Duration(requestsPerSecond))
-	case "sliding_window":
-		limiter = server.NewSlidingWindow(requestsPerSecond, windowSize)
-	case "fixed_window":
-		limiter = server.NewFixedWindow(requestsPerSecond, windowSize)
-	case "no_rate_limit":
-		limiter = &server.NoRateLimiter{}
-	default:
-		log.Fatalf("Unknown rate limiting algorithm: %s", rateLimitAlgorithm)
+// backendPoolConfig describes the backend pool set by the flags or the file
+// named by -backends-config
+func backendPoolConfig() (server.PoolConfig, error) {
+	if backendsConfig != "" {
+		return server.LoadPoolConfig(backendsConfig)
 	}
+	config := server.DefaultPoolConfig()
+	var err error
+	if config.Balancer, err = server.ParseBalancer(balancer); err != nil {
+		return config, err
+	}
+	if config.Backends, err = server.ParseBackends(backendsSpec); err != nil {
+		return config, err
+	}
+	config.MaxFailures = maxFailures
+	config.EjectTime = ejectTime
+	config.HealthCheck = healthCheck
+	return config, nil
+}
 
-	clients[ip] = &Client{
-		limiter:  limiter,
-		lastSeen: time.Now(),
+// sweepIdleKeys drops the keys of kl idle for the TTL every TTL. Shards are
+// otherwise only swept when a request lands on them, so keys on a shard that
+// sees no more requests would be kept for good.
+func sweepIdleKeys(kl *server.KeyedLimiter) {
+	if clientTTL <= 0 {
+		return
 	}
-	return limiter
+	ticker := time.NewTicker(clientTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		kl.Cleanup()
+	}
+}
+
+// limitClient serves h only to clients their limiter admits, charging each
+// request a unit as the proxied routes do
+func limitClient(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clients.Key(r)
+		var decision server.Decision
+		if hierarchy != nil {
+			decision, _ = hierarchy.Decide(r, 1)
+		} else if gossip != nil {
+			decision, _ = gossip.Decide(ip, 1)
+		} else if limiter, err := clients.Limiter(ip); err == nil {
+			decision = limiter.Decide(1)
+		}
+		server.SetRateLimitHeaders(w.Header(), decision)
+		if !decision.Allowed {
+			requestCountMu.Lock()
+			deniedCount++
+			non200Count++
+			requestCountMu.Unlock()
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
-// cleanupClients periodically removes clients that haven't been seen for a while
-func cleanupClients() {
+// saveSnapshots saves client limiter state every snapshot interval, and once
+// more before the server exits on an interrupt
+func saveSnapshots() {
+	save := func() {
+		if err := clients.SaveSnapshot(snapshotPath); err != nil {
+			log.Printf("Could not save client state to %s: %v", snapshotPath, err)
+		}
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Minute)
-		clientsMu.Lock()
-		for ip, client := range clients {
-			if time.Since(client.lastSeen) > 5*time.Minute {
-				delete(clients, ip)
-			}
+		select {
+		case <-ticker.C:
+			save()
+		case <-stop:
+			save()
+			os.Exit(0)
 		}
-		clientsMu.Unlock()
 	}
 }
 
+// algorithmUsage lists the registered algorithms and what each limits
+func algorithmUsage() string {
+	usage := "Rate limiting algorithm to use:"
+	for _, name := range server.Algorithms() {
+		algorithm, _ := server.LookupAlgorithm(name)
+		usage += fmt.Sprintf("\n  %s: %s", name, algorithm.Description)
+	}
+	return usage
+}
+
 func main() {
-	flag.StringVar(&rateLimitAlgorithm, "algorithm", "token_bucket", "Rate limiting algorithm to use")
-	flag.IntVar(&requestsPerSecond, "rate", 10, "Number of requests per second")
-	flag.IntVar(&burstLimit, "burst", 5, "Burst limit for the rate limiter")
-	flag.DurationVar(&windowSize, "window", time.Second, "Window size for window-based algorithms")
+	flag.StringVar(&rateLimitAlgorithm, "algorithm", "token_bucket", algorithmUsage())
+	flag.Float64Var(&requestsPerSecond, "rate", 10, "Number of requests per second (may be fractional), or per -window for the window algorithms")
+	flag.IntVar(&burstLimit, "burst", 5, "Burst limit for the rate limiter, or requests in flight for the concurrency algorithm")
+	flag.DurationVar(&windowSize, "window", time.Second, "Window size for window-based algorithms, which allow -rate requests per window")
+	flag.StringVar(&limitsSpec, "limits", "", "Comma-separated limits to enforce together, such as 10/s,500/m,10000/d, each using -algorithm unless prefixed as in fixed_window:500/m")
+	flag.StringVar(&limiterFile, "limiter-config", "", "JSON file describing the client limiter, used instead of -algorithm and its parameter flags")
+	flag.StringVar(&quotaPeriod, "period", "day", "Calendar period the quota algorithm allows -burst requests in: hour, day or month")
+	flag.StringVar(&quotaTimezone, "timezone", "", "Timezone quota periods start in, such as America/New_York (defaults to UTC)")
+	flag.IntVar(&queueSize, "queue", 0, "Requests allowed to wait for a slot with the concurrency and gradient algorithms")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 0, "Longest a request may wait for a slot or in the leaky_queue (0 waits until the client gives up)")
+	flag.DurationVar(&clientTTL, "client-ttl", 5*time.Minute, "How long an idle client's limiter is kept")
+	flag.IntVar(&maxClients, "max-clients", 100000, "Most clients, and tenants, tracked at once (0 for no cap)")
+	flag.StringVar(&clientOverflow, "client-overflow", "evict", "What to do with new clients or tenants past -max-clients: evict, shared or reject")
+	flag.StringVar(&storeAddr, "store", "", "Address of a Redis server to share limits with other instances (token_bucket, fixed_window, sliding_window_counter and quota only)")
+	flag.StringVar(&gossipPeers, "peers", "", "Comma-separated URLs of other instances' gossip endpoints, to share limits without a store (not with -store)")
+	flag.DurationVar(&gossipInterval, "gossip-interval", 100*time.Millisecond, "How often consumption is sent to -peers")
+	flag.StringVar(&gossipSecret, "gossip-secret", "", "Secret gossiping instances must share (required with -peers)")
+	flag.StringVar(&nodeID, "node-id", "", "Name of this instance in gossip messages (defaults to the hostname)")
+	flag.StringVar(&tenantHeader, "tenant-header", "", "Header naming the tenant a client belongs to, to limit each tenant as well as each client")
+	flag.Float64Var(&tenantRate, "tenant-rate", 100, "Requests per second allowed each tenant, by token bucket")
+	flag.IntVar(&tenantBurst, "tenant-burst", 50, "Burst allowed each tenant")
+	flag.Float64Var(&globalRate, "global-rate", 0, "Requests per second allowed across all clients, by token bucket (0 for no global limit)")
+	flag.IntVar(&globalBurst, "global-burst", 500, "Burst allowed across all clients")
+	flag.BoolVar(&borrow, "borrow", false, "Let clients past their own limit use capacity their tenant has to spare")
+	flag.BoolVar(&aimd, "aimd", false, "Adapt -global-rate to the backends, raising it while they answer in time and cutting it on 5xx responses or high latency")
+	flag.DurationVar(&aimdConfig.LatencyTarget, "aimd-latency", 0, "Mean backend latency above which -aimd cuts the rate (0 only reacts to 5xx responses)")
+	flag.Float64Var(&aimdConfig.MinRate, "aimd-min-rate", aimdConfig.MinRate, "Lowest rate -aimd may cut the global rate to")
+	flag.Float64Var(&aimdConfig.MaxRate, "aimd-max-rate", 0, "Highest rate -aimd may raise the global rate to (0 for no bound)")
+	flag.StringVar(&costSpec, "cost", "", "Comma-separated costs of routes in units of quota, such as POST /cholesky=matrix,/upload/=body,GET /=1 (others cost 1); a cost past a client's limit is charged as the whole limit")
+	flag.StringVar(&backendsSpec, "backends", "", "Comma-separated URLs of backends to forward accepted requests to, each optionally with a weight, such as http://10.0.0.1:8080=2,http://10.0.0.2:8080")
+	flag.StringVar(&backendsConfig, "backends-config", "", "JSON file describing the backends and their health checks, used instead of the other backend flags")
+	flag.StringVar(&balancer, "balancer", "round_robin", "How requests are spread over -backends: round_robin, least_conn or weighted_random")
+	flag.IntVar(&maxFailures, "max-failures", 5, "Failed requests in a row after which a backend is ejected (0 never ejects)")
+	flag.DurationVar(&ejectTime, "eject-time", 30*time.Second, "How long an ejected backend is left out")
+	flag.DurationVar(&transport.ResponseHeaderTimeout, "upstream-timeout", transport.ResponseHeaderTimeout, "How long a backend may take to respond before the client gets a 504 (0 waits as long as the client)")
+	flag.IntVar(&transport.MaxIdleConnsPerHost, "upstream-idle-conns", transport.MaxIdleConnsPerHost, "Idle connections kept open to each backend")
+	flag.BoolVar(&transport.UnencryptedHTTP2, "upstream-h2c", false, "Speak HTTP/2 without TLS to http backends, which must all support it")
+	flag.StringVar(&adminAddr, "admin-addr", adminAddr, "Address of the listener for operator endpoints such as /_limitly/backends (empty turns them off)")
+	flag.StringVar(&healthCheck.Path, "health-path", "", "Path requested from each backend to check its health (empty turns health checks off)")
+	flag.DurationVar(&healthCheck.Interval, "health-interval", healthCheck.Interval, "How often each backend's health is checked")
+	flag.DurationVar(&healthCheck.Timeout, "health-timeout", healthCheck.Timeout, "How long a health check may take before it fails")
+	flag.IntVar(&healthCheck.HealthyThreshold, "healthy-threshold", healthCheck.HealthyThreshold, "Health checks in a row an unhealthy backend must pass to rejoin")
+	flag.IntVar(&healthCheck.UnhealthyThreshold, "unhealthy-threshold", healthCheck.UnhealthyThreshold, "Health checks in a row a backend may fail before it is taken out")
+	flag.StringVar(&snapshotPath, "snapshot", "", "File client limiter state is saved to and restored from across restarts")
+	flag.DurationVar(&snapshotInterval, "snapshot-interval", 30*time.Second, "How often client limiter state is saved to -snapshot")
 	flag.Parse()
 
-	go cleanupClients()
+	if storeAddr != "" {
+		store = server.NewRESPStore(storeAddr, 16, 100*time.Millisecond)
+	}
+	if limiterFile != "" {
+		config, err := server.LoadLimiterConfig(limiterFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rateLimitAlgorithm, requestsPerSecond, burstLimit, windowSize = config.Algorithm, config.Rate, config.Burst, config.Window
+		queueSize, queueTimeout, limits = config.QueueSize, config.QueueTimeout, config.Limits
+		quotaPeriod, quotaTimezone = config.Period, config.Timezone
+	} else if limitsSpec != "" {
+		var err error
+		if limits, err = server.ParseLimits(limitsSpec, rateLimitAlgorithm); err != nil {
+			log.Fatal(err)
+		}
+		for i := range limits {
+			limits[i].Timezone = quotaTimezone
+		}
+		rateLimitAlgorithm = "composite"
+	}
+	if err := limiterConfig().Validate(); err != nil {
+		log.Fatal(err)
+	}
+	algorithm, _ := server.LookupAlgorithm(rateLimitAlgorithm)
+	if store != nil && algorithm.NewStore == nil {
+		log.Fatalf("Rate limiting algorithm %s can't use a shared store", rateLimitAlgorithm)
+	}
+	overflow, err := server.ParseOverflowPolicy(clientOverflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := server.DefaultKeyedConfig()
+	config.TTL = clientTTL
+	config.MaxKeys = maxClients
+	config.Overflow = overflow
+	clients = server.NewKeyedLimiter(server.ClientIP, newClientLimiter, config)
+	go sweepIdleKeys(clients)
+
+	if snapshotPath != "" {
+		restored, err := clients.LoadSnapshot(snapshotPath)
+		if err != nil {
+			log.Printf("Could not restore client state from %s: %v", snapshotPath, err)
+		} else {
+			log.Printf("Restored the state of %d clients from %s", restored, snapshotPath)
+		}
+		go saveSnapshots()
+	}
+
+	if backendsSpec != "" || backendsConfig != "" {
+		poolConfig, err := backendPoolConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		poolConfig.Transport = server.NewTransport(transport)
+		if pool, err = server.NewPool(poolConfig); err != nil {
+			log.Fatal(err)
+		}
+		// Backend URLs and health are for operators, not for every client
+		adminMux.Handle("/_limitly/backends", pool.StatusHandler())
+		go pool.Run(context.Background())
+	}
+
+	if costSpec != "" {
+		rules, err := server.ParseCostRules(costSpec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		costFunc = server.RouteCost(rules, server.UnitCost)
+	}
+
+	if aimd && globalRate <= 0 {
+		log.Fatal("-aimd adapts the global limit and needs a -global-rate to start from")
+	}
+	if borrow && tenantHeader == "" {
+		log.Fatal("-borrow needs a -tenant-header to borrow from")
+	}
+	if tenantHeader != "" || globalRate > 0 {
+		if gossipPeers != "" {
+			log.Fatal("Tenant and global limits can't be combined with -peers")
+		}
+		var tenants *server.KeyedLimiter
+		var global server.RateLimiter
+		var err error
+		if tenantHeader != "" {
+			tenantConfig := server.LimiterConfig{Algorithm: "token_bucket", Rate: tenantRate, Burst: tenantBurst}
+			if err := tenantConfig.Validate(); err != nil {
+				log.Fatal(err)
+			}
+			// Tenants are named by the client, so they are capped like clients
+			tenants = server.NewKeyedLimiter(server.HeaderKey(tenantHeader), func(string) server.RateLimiter {
+				limiter, _ := server.NewLimiter(tenantConfig)
+				return limiter
+			}, config)
+			go sweepIdleKeys(tenants)
+		}
+		if globalRate > 0 {
+			global, err = server.NewLimiter(server.LimiterConfig{Algorithm: "token_bucket", Rate: globalRate, Burst: globalBurst})
+			if err != nil {
+				log.Fatal(err)
+			}
+			if aimd {
+				// The hierarchy charges the bucket itself, whose rate the
+				// AIMD tunes as it observes the backends
+				observers = append(observers, server.NewAIMD(global.(server.Tunable), aimdConfig))
+			}
+		}
+		hierarchy = server.NewHierarchy(clients, tenants, global, borrow)
+	}
+
+	if gossipPeers != "" {
+		// A shared store already counts every instance's requests, so
+		// gossiping them as well would charge each one twice
+		if store != nil {
+			log.Fatal("-peers can't be combined with -store")
+		}
+		// The gossip endpoint is served alongside the proxied routes, so
+		// anyone could otherwise charge requests to any client
+		if gossipSecret == "" {
+			log.Fatal("-peers needs a -gossip-secret shared by every instance")
+		}
+		if nodeID == "" {
+			nodeID, _ = os.Hostname()
+		}
+		gossipConfig := server.DefaultGossipConfig()
+		gossipConfig.NodeID = nodeID
+		gossipConfig.Peers = strings.Split(gossipPeers, ",")
+		gossipConfig.Interval = gossipInterval
+		gossipConfig.Secret = gossipSecret
+		gossip = server.NewGossip(clients, gossipConfig)
+		http.Handle("/_limitly/gossip", gossip.Handler())
+		go gossip.Run(context.Background())
+	}
+
+	if algorithm.NewInFlight != nil {
+		inFlightLimiter = algorithm.NewInFlight(limiterConfig())
+	}
+	if observer, ok := inFlightLimiter.(server.Observer); ok {
+		observers = append(observers, observer)
+	}
+	if len(observers) > 0 && pool == nil {
+		log.Fatal("-aimd and the gradient algorithm adapt to the backends and need -backends")
+	}
+	if algorithm.NewQueue != nil {
+		requestQueue = algorithm.NewQueue(limiterConfig())
+	}
 
 	go func() {
 		for {
@@ -350,14 +685,41 @@ func main() {
 			requestCountMu.Lock()
 			log.Printf("Total accepted requests: %d, Total denied requests: %d, Non-200 responses: %d", acceptedCount, deniedCount, non200Count)
 			requestCountMu.Unlock()
+			stats := clients.Stats()
+			log.Printf("Clients tracked: %d, expired: %d, evicted: %d, shared: %d, rejected: %d", stats.Keys, stats.Expired, stats.Evicted, stats.Shared, stats.Rejected)
 		}
 	}()
 
+	// Clients on a quota can check what they have left, each check counting
+	// as a request so that it can't be used to get past the limit
+	http.Handle("/_limitly/usage", limitClient(server.UsageHandler(clients)))
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		ip := extractIP(r)
-		limiter := getClientLimiter(ip)
+		ip := clients.Key(r)
+		var decision server.Decision
+		exhausted := false
+		// Turn away clients with nothing left before working out the cost,
+		// which may mean reading the body
+		if hierarchy != nil && costSpec != "" {
+			decision, exhausted = hierarchy.Exhausted(r)
+		} else if costSpec != "" {
+			if limiter, err := clients.Limiter(ip); err == nil {
+				decision, exhausted = server.Exhausted(limiter)
+			}
+		}
+		if !exhausted {
+			cost := costFunc(r)
+			if hierarchy != nil {
+				decision, _ = hierarchy.Decide(r, cost)
+			} else if gossip != nil {
+				decision, _ = gossip.Decide(ip, cost)
+			} else if limiter, err := clients.Limiter(ip); err == nil {
+				decision = limiter.Decide(server.CapCost(limiter, cost))
+			}
+		}
+		server.SetRateLimitHeaders(w.Header(), decision)
 
-		if !limiter.Allow() {
+		if !decision.Allowed {
 			requestCountMu.Lock()
 			deniedCount++
 			non200Count++
@@ -369,33 +731,71 @@ func main() {
 			return
 		}
 
+		if requestQueue != nil {
+			if err := requestQueue.Enqueue(r.Context()); err != nil {
+				status, message := http.StatusServiceUnavailable, "Request would wait too long"
+				if errors.Is(err, server.ErrQueueFull) {
+					status, message = http.StatusTooManyRequests, "Request queue is full"
+				}
+				requestCountMu.Lock()
+				deniedCount++
+				non200Count++
+				requestCountMu.Unlock()
+
+				w.WriteHeader(status)
+				log.Printf("[%s] Response sent: Status %d, IP %s", time.Now().Format("2006-01-02 15:04:05"), status, ip)
+				fmt.Fprint(w, message)
+				return
+			}
+		}
+
+		if inFlightLimiter != nil {
+			release, err := inFlightLimiter.Acquire(r.Context())
+			if err != nil {
+				requestCountMu.Lock()
+				deniedCount++
+				non200Count++
+				requestCountMu.Unlock()
+
+				w.WriteHeader(http.StatusServiceUnavailable)
+				log.Printf("[%s] Response sent: Status %d, IP %s", time.Now().Format("2006-01-02 15:04:05"), http.StatusServiceUnavailable, ip)
+				fmt.Fprint(w, "Too many requests in flight")
+				return
+			}
+			defer release()
+		}
+
 		requestCountMu.Lock()
 		acceptedCount++
 		requestCountMu.Unlock()
 
+		if pool != nil {
+			start := time.Now()
+			rec := server.NewStatusRecorder(w)
+			pool.ServeHTTP(rec, r)
+			latency := time.Since(start)
+			for _, observer := range observers {
+				observer.Observe(latency, rec.Status >= http.StatusInternalServerError)
+			}
+			if rec.Status != http.StatusOK {
+				requestCountMu.Lock()
+				non200Count++
+				requestCountMu.Unlock()
+			}
+			log.Printf("[%s] Response sent: Status %d, IP %s", time.Now().Format("2006-01-02 15:04:05"), rec.Status, ip)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
 		log.Printf("[%s] Response sent: Status %d, IP %s", time.Now().Format("2006-01-02 15:04:05"), http.StatusOK, ip)
 		fmt.Fprint(w, "Hello from the Go server!")
 	})
 
+	if adminAddr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(adminAddr, adminMux))
+		}()
+	}
 	fmt.Println("Rate-limiting server running on http://0.0.0.0:80")
 	log.Fatal(http.ListenAndServe("0.0.0.0:80", nil))
 }
-
-// extractIP extracts the IP address from the request's RemoteAddr
-func extractIP(r *http.Request) string {
-	ipPort := r.RemoteAddr
-	ip := ipPort
-	if strings.Contains(ipPort, ":") {
-		if strings.Count(ipPort, ":") > 1 {
-			ip = strings.Trim(ipPort, "[]")
-			colon := strings.LastIndex(ip, ":")
-			if colon != -1 {
-				ip = ip[:colon]
-			}
-		} else {
-			ip, _, _ = net.SplitHostPort(ipPort)
-		}
-	}
-	return ip
-}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Tunable is implemented by limiters whose rate can be changed at runtime
+type Tunable interface {
+	RateLimiter
+	// Rate returns the current rate in requests per second
+	Rate() float64
+	// SetRate changes the rate in requests per second
+	SetRate(rate float64)
+}
+
+// Observer is implemented by limiters that adapt to how the backend handles
+// the requests they admit
+type Observer interface {
+	// Observe records the latency of a request and whether it failed
+	Observe(latency time.Duration, failed bool)
+}
+
+// AIMDConfig holds the parameters of an AIMD limiter
+type AIMDConfig struct {
+	// MinRate and MaxRate bound the rate in requests per second; a zero
+	// MaxRate leaves it unbounded
+	MinRate float64
+	MaxRate float64
+	// Increase is added to the rate after a healthy interval
+	Increase float64
+	// Decrease multiplies the rate after an unhealthy interval
+	Decrease float64
+	// LatencyTarget is the mean latency above which an interval is unhealthy;
+	// zero ignores latency
+	LatencyTarget time.Duration
+	// ErrorThreshold is the fraction of failed requests above which an
+	// interval is unhealthy
+	ErrorThreshold float64
+	// Interval is how often the rate is adjusted
+	Interval time.Duration
+}
+
+// DefaultAIMDConfig returns an AIMDConfig that adds one request per second
+// every second while all requests succeed, and halves the rate otherwise
+func DefaultAIMDConfig() AIMDConfig {
+	return AIMDConfig{
+		MinRate:  1,
+		Increase: 1,
+		Decrease: 0.5,
+		Interval: time.Second,
+	}
+}
+
+// AIMD wraps a Tunable limiter and adjusts its rate with additive increase,
+// multiplicative decrease, based on the latency and failures it observes
+type AIMD struct {
+	Tunable
+	config      AIMDConfig
+	rate        float64
+	windowStart time.Time
+	samples     int
+	failures    int
+	latencySum  time.Duration
+	clock       Clock
+	mutex       sync.Mutex
+}
+
+// NewAIMD creates a new AIMD around limiter, starting from its current rate
+func NewAIMD(limiter Tunable, config AIMDConfig, opts ...Option) *AIMD {
+	o := newOptions(opts)
+	a := &AIMD{
+		Tunable:     limiter,
+		config:      config,
+		windowStart: o.clock.Now(),
+		clock:       o.clock,
+	}
+	a.rate = a.clamp(limiter.Rate())
+	limiter.SetRate(a.rate)
+	return a
+}
+
+// Observe records how the backend handled a request, adjusting the rate
+// once per interval
+func (a *AIMD) Observe(latency time.Duration, failed bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.samples++
+	a.latencySum += latency
+	if failed {
+		a.failures++
+	}
+
+	now := a.clock.Now()
+	if now.Sub(a.windowStart) < a.config.Interval {
+		return
+	}
+
+	errorRate := float64(a.failures) / float64(a.samples)
+	meanLatency := a.latencySum / time.Duration(a.samples)
+	if errorRate > a.config.ErrorThreshold ||
+		(a.config.LatencyTarget > 0 && meanLatency > a.config.LatencyTarget) {
+		a.rate = a.clamp(a.rate * a.config.Decrease)
+	} else {
+		a.rate = a.clamp(a.rate + a.config.Increase)
+	}
+	a.Tunable.SetRate(a.rate)
+
+	a.windowStart = now
+	a.samples, a.failures, a.latencySum = 0, 0, 0
+}
+
+// Rate returns the rate the AIMD has settled on, in requests per second
+func (a *AIMD) Rate() float64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.rate
+}
+
+// SetRate resets the rate, which the AIMD will adjust from there
+func (a *AIMD) SetRate(rate float64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.rate = a.clamp(rate)
+	a.Tunable.SetRate(a.rate)
+}
+
+func (a *AIMD) clamp(rate float64) float64 {
+	if a.config.MaxRate > 0 && rate > a.config.MaxRate {
+		rate = a.config.MaxRate
+	}
+	if rate < a.config.MinRate {
+		rate = a.config.MinRate
+	}
+	return rate
+}
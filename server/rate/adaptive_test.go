@@ -0,0 +1,96 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	_ Tunable = (*TokenBucket)(nil)
+	_ Tunable = (*LeakyBucket)(nil)
+	_ Tunable = (*GCRA)(nil)
+	_ Tunable = (*SlidingWindow)(nil)
+	_ Tunable = (*SlidingWindowCounter)(nil)
+	_ Tunable = (*FixedWindow)(nil)
+	_ Tunable = (*AIMD)(nil)
+)
+
+func TestAIMDAdjustsRate(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	config := DefaultAIMDConfig()
+	config.MaxRate = 12
+	config.LatencyTarget = 100 * ms
+	a := NewAIMD(NewTokenBucketRate(10, 10, WithClock(clock)), config, WithClock(clock))
+
+	steps := []struct {
+		latency time.Duration
+		failed  bool
+		want    float64
+	}{
+		{10 * ms, false, 11},
+		{10 * ms, false, 12},
+		{10 * ms, false, 12}, // capped at MaxRate
+		{10 * ms, true, 6},
+		{500 * ms, false, 3},
+		{10 * ms, false, 4},
+		{10 * ms, true, 2},
+		{10 * ms, true, 1},
+		{10 * ms, true, 1}, // floored at MinRate
+	}
+	for i, s := range steps {
+		// Samples within the interval are only aggregated
+		a.Observe(s.latency, s.failed)
+		clock.Advance(time.Second)
+		a.Observe(s.latency, s.failed)
+		if got := a.Rate(); got != s.want {
+			t.Fatalf("step %d: rate %v, want %v", i, got, s.want)
+		}
+		if got := a.Tunable.Rate(); got != s.want {
+			t.Fatalf("step %d: wrapped limiter rate %v, want %v", i, got, s.want)
+		}
+	}
+}
+
+func TestAIMDTunesWindowLimit(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	fw := NewFixedWindow(4, time.Second, WithClock(clock))
+	a := NewAIMD(fw, DefaultAIMDConfig(), WithClock(clock))
+
+	clock.Advance(time.Second)
+	a.Observe(0, true)
+	if !a.AllowN(2) || a.Allow() {
+		t.Fatal("halving the rate should leave a limit of 2 per window")
+	}
+}
+
+func TestProxyHandlerBacksOffOnServerErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("token_bucket", 100, 100)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	config := DefaultAIMDConfig()
+	config.Interval = 0
+	if err := SetAIMD(config); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	if got := loadConfig().rateLimiter.(*AIMD).Rate(); got != 50 {
+		t.Fatalf("rate after a 5xx is %v, want 50", got)
+	}
+
+	SetRateLimiter("no_rate_limit", 0, 0)
+	if err := SetAIMD(config); err == nil {
+		t.Fatal("SetAIMD accepted a limiter without a rate")
+	}
+}
@@ -1,52 +1,407 @@
 package server
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var backendURL string
+// proxyConfig is what ProxyHandler limits and forwards requests with. It is
+// never changed once published: the setters below publish an updated copy,
+// so that reconfiguring at runtime doesn't race with requests in flight.
+type proxyConfig struct {
+	backendURL         string
+	backendProxy       *httputil.ReverseProxy
+	backendTransport   http.RoundTripper
+	rateLimiter        RateLimiter
+	concurrencyLimiter InFlightLimiter
+	requestQueue       *LeakyQueue
+	keyedLimiter       *KeyedLimiter
+	hierarchy          *Hierarchy
+	costFunc           CostFunc
+	backendPool        *Pool
+	// rateMutex is held across decideKeyed's reservations on rateLimiter,
+	// as a Composite's is, so that no request sees capacity held by one
+	// that is then denied. It is nil when rateLimiter doesn't limit, and
+	// keyed requests then skip it.
+	rateMutex *sync.Mutex
+}
+
+var (
+	current     atomic.Pointer[proxyConfig]
+	updateMutex sync.Mutex
+)
+
+// loadConfig returns the configuration ProxyHandler currently uses
+func loadConfig() *proxyConfig {
+	if config := current.Load(); config != nil {
+		return config
+	}
+	return &proxyConfig{}
+}
+
+// updateConfig publishes a copy of the current configuration changed by
+// update. Updates are serialised so that none is lost.
+func updateConfig(update func(config *proxyConfig) error) error {
+	updateMutex.Lock()
+	defer updateMutex.Unlock()
 
-func SetBackendURL(url string) {
-	backendURL = url
+	config := *loadConfig()
+	if err := update(&config); err != nil {
+		return err
+	}
+	current.Store(&config)
+	return nil
 }
 
-var rateLimiter RateLimiter
+// SetBackendURL sets the backend ProxyHandler forwards to. The proxy is
+// built here once and shared by every request.
+func SetBackendURL(backend string) {
+	updateConfig(func(config *proxyConfig) error {
+		config.setBackend(backend)
+		return nil
+	})
+}
 
-// SetRateLimiter initializes the rate limiter based on parameters
-func SetRateLimiter(algorithm string, rate int, burst int) {
-	switch algorithm {
-	case "token_bucket":
-		rateLimiter = NewTokenBucket(burst, time.Second/time.Duration(rate))
-	case "leaky_bucket":
-		rateLimiter = NewLeakyBucket(burst, time.Second/time.Duration(rate))
-	case "sliding_window":
-		rateLimiter = NewSlidingWindow(rate, time.Second)
-	case "fixed_window":
-		rateLimiter = NewFixedWindow(rate, time.Second)
-	case "no_rate_limit":
-        rateLimiter = &NoRateLimiter{}
-	default:
-		log.Fatalf("Unknown algorithm: %s", algorithm)
+func (c *proxyConfig) setBackend(backend string) {
+	c.backendURL = backend
+	c.backendProxy = nil
+	if target, err := url.Parse(backend); err == nil {
+		c.backendProxy = NewReverseProxy(target, c.backendTransport)
+	}
+}
+
+// SetTransport sets the transport ProxyHandler forwards requests to the
+// backend URL over, such as one from NewTransport. A nil transport uses the
+// shared default.
+func SetTransport(transport http.RoundTripper) {
+	updateConfig(func(config *proxyConfig) error {
+		config.backendTransport = transport
+		config.setBackend(config.backendURL)
+		return nil
+	})
+}
+
+// SetRateLimiter initializes the rate limiter based on parameters. rate is in
+// requests per second and may be fractional for the bucket algorithms. The
+// concurrency algorithm allows burst requests in flight and ignores rate; the
+// gradient algorithm starts from burst and adapts to the backend's latency.
+// The leaky_queue algorithm queues up to burst requests and forwards them at rate.
+// If the parameters are invalid the current limiter is kept and the error
+// returned.
+func SetRateLimiter(algorithm string, rate float64, burst int) error {
+	return SetLimiterConfig(LimiterConfig{Algorithm: algorithm, Rate: rate, Burst: burst})
+}
+
+// SetLimiterConfig sets the rate limiter, and any in-flight limiter or queue
+// its algorithm uses, from config. If config is invalid the current limiters
+// are kept and the error returned.
+func SetLimiterConfig(limiterConfig LimiterConfig) error {
+	algorithm, limiterConfig, err := limiterConfig.resolve()
+	if err != nil {
+		return err
+	}
+
+	return updateConfig(func(config *proxyConfig) error {
+		config.setRateLimiter(algorithm.New(limiterConfig))
+		config.concurrencyLimiter = nil
+		if algorithm.NewInFlight != nil {
+			config.concurrencyLimiter = algorithm.NewInFlight(limiterConfig)
+		}
+		config.requestQueue = nil
+		if algorithm.NewQueue != nil {
+			config.requestQueue = algorithm.NewQueue(limiterConfig)
+		}
+		return nil
+	})
+}
+
+// SetKeyedLimiter makes ProxyHandler limit each key separately, on top of the
+// limiter set by SetRateLimiter. A nil kl turns per-key limiting off.
+func SetKeyedLimiter(kl *KeyedLimiter) {
+	updateConfig(func(config *proxyConfig) error {
+		config.keyedLimiter = kl
+		return nil
+	})
+}
+
+// SetHierarchy makes ProxyHandler limit requests by client, tenant and
+// globally with h, in place of the limiters set by SetKeyedLimiter and
+// SetRateLimiter. A nil h turns it off.
+func SetHierarchy(h *Hierarchy) {
+	updateConfig(func(config *proxyConfig) error {
+		config.hierarchy = h
+		return nil
+	})
+}
+
+// SetCostFunc makes ProxyHandler charge each request the units f returns
+// rather than one. A nil f charges every request one unit again.
+func SetCostFunc(f CostFunc) {
+	updateConfig(func(config *proxyConfig) error {
+		config.costFunc = f
+		return nil
+	})
+}
+
+// SetBackendPool makes ProxyHandler spread requests over the backends of
+// pool rather than forward them to the backend URL. A nil pool turns it off.
+func SetBackendPool(pool *Pool) {
+	updateConfig(func(config *proxyConfig) error {
+		config.backendPool = pool
+		return nil
+	})
+}
+
+// SetConcurrencyLimiter bounds the requests ProxyHandler forwards at once,
+// queueing up to queueSize more for at most queueTimeout
+func SetConcurrencyLimiter(limit, queueSize int, queueTimeout time.Duration) {
+	updateConfig(func(config *proxyConfig) error {
+		config.concurrencyLimiter = NewConcurrencyLimiter(limit, queueSize, queueTimeout)
+		return nil
+	})
+}
+
+// SetLeakyQueue makes ProxyHandler queue up to capacity requests and forward
+// them at rate per second, rejecting any that would wait longer than maxWait
+func SetLeakyQueue(rate float64, capacity int, maxWait time.Duration) {
+	updateConfig(func(config *proxyConfig) error {
+		config.requestQueue = NewLeakyQueue(capacity, RateInterval(rate), maxWait)
+		return nil
+	})
+}
+
+// SetAIMD wraps the current rate limiter in an AIMD so that its rate follows
+// the latency and 5xx responses ProxyHandler sees from the backend
+func SetAIMD(aimdConfig AIMDConfig) error {
+	return updateConfig(func(config *proxyConfig) error {
+		limiter, ok := config.rateLimiter.(Tunable)
+		if !ok {
+			return fmt.Errorf("rate: %T cannot be tuned at runtime", config.rateLimiter)
+		}
+		config.setRateLimiter(NewAIMD(limiter, aimdConfig))
+		return nil
+	})
+}
+
+// setRateLimiter sets the limiter every request passes, with a mutex of its
+// own if it limits anything
+func (c *proxyConfig) setRateLimiter(limiter RateLimiter) {
+	c.rateLimiter, c.rateMutex = limiter, nil
+	if Capacity(limiter) > 0 {
+		c.rateMutex = new(sync.Mutex)
 	}
 }
 
 // ProxyHandler applies rate limiting and forwards requests
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	if rateLimiter != nil && !rateLimiter.Allow() {
+	// Requests keep the configuration they started with
+	config := loadConfig()
+	rateLimiter, concurrencyLimiter, requestQueue := config.rateLimiter, config.concurrencyLimiter, config.requestQueue
+	rateMutex, keyedLimiter, hierarchy, costFunc := config.rateMutex, config.keyedLimiter, config.hierarchy, config.costFunc
+	backendPool, backendProxy := config.backendPool, config.backendProxy
+
+	deny := func(d Decision) {
+		SetRateLimitHeaders(w.Header(), d)
 		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-		return
 	}
 
-	targetURL, err := url.Parse(backendURL)
-	if err != nil {
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	var limiter RateLimiter
+	if hierarchy == nil && keyedLimiter != nil {
+		var err error
+		if limiter, err = keyedLimiter.LimiterFor(r); err != nil {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+	if hierarchy != nil && costFunc != nil {
+		// Turn away clients with nothing left before working out the cost,
+		// which may mean reading the body
+		if d, exhausted := hierarchy.Exhausted(r); exhausted {
+			deny(d)
+			return
+		}
+	} else if costFunc != nil {
+		for _, l := range []RateLimiter{limiter, rateLimiter} {
+			if l == nil {
+				continue
+			}
+			if d, exhausted := Exhausted(l); exhausted {
+				deny(d)
+				return
+			}
+		}
+	}
+
+	cost := 1
+	if costFunc != nil {
+		cost = costFunc(r)
+	}
+
+	if hierarchy != nil {
+		decision, err := hierarchy.Decide(r, cost)
+		if err != nil || !decision.Allowed {
+			deny(decision)
+			return
+		}
+		SetRateLimitHeaders(w.Header(), decision)
+	} else if limiter != nil && rateMutex != nil {
+		// The client's quota is only charged if the global limit admits the
+		// request too. Its quota is more useful to the client unless the
+		// global limit is what denies it. An unlimited global limit is left
+		// out, so that clients aren't serialised on its mutex.
+		decision := decideKeyed(limiter, rateLimiter, rateMutex, keyedLimiter.clock.Now(), cost)
+		if !decision.Allowed {
+			deny(decision)
+			return
+		}
+		SetRateLimitHeaders(w.Header(), decision)
+	} else if limiter != nil {
+		decision := limiter.Decide(CapCost(limiter, cost))
+		if !decision.Allowed {
+			deny(decision)
+			return
+		}
+		SetRateLimitHeaders(w.Header(), decision)
+	} else if rateLimiter != nil {
+		decision := rateLimiter.Decide(CapCost(rateLimiter, cost))
+		if !decision.Allowed {
+			deny(decision)
+			return
+		}
+		SetRateLimitHeaders(w.Header(), decision)
+	}
+
+	// Smooth bursts by releasing queued requests at a constant rate
+	if requestQueue != nil {
+		if err := requestQueue.Enqueue(r.Context()); err != nil {
+			if errors.Is(err, ErrQueueFull) {
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			} else {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			}
+			return
+		}
+	}
+
+	// Hold a slot for as long as the backend is working on the request
+	if concurrencyLimiter != nil {
+		release, err := concurrencyLimiter.Acquire(r.Context())
+		if err != nil {
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+	}
+
+	var proxy http.Handler = backendPool
+	if backendPool == nil {
+		if backendProxy == nil {
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		proxy = backendProxy
+	}
+	observers := observersOf(rateLimiter, concurrencyLimiter)
+	if len(observers) == 0 {
+		proxy.ServeHTTP(w, r)
 		return
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	proxy.ServeHTTP(w, r)
+	start := time.Now()
+	rec := NewStatusRecorder(w)
+	proxy.ServeHTTP(rec, r)
+	latency := time.Since(start)
+	for _, observer := range observers {
+		observer.Observe(latency, rec.Status >= http.StatusInternalServerError)
+	}
+}
+
+// decideKeyed checks if n requests can proceed under both a client's limiter
+// and the global one, charging neither unless both admit them: each is
+// reserved and the reservations are handed back if either would delay, as a
+// Composite does. Only the global reservation and its hand back are made
+// holding mutex, as the global limiter is the one other clients share. The
+// decision reported is the client's, unless the global limit is what denies
+// the requests. Limiters that don't implement Reserver are checked global
+// first, so that at least a global denial costs the client nothing.
+func decideKeyed(client, global RateLimiter, mutex *sync.Mutex, now time.Time, n int) Decision {
+	n = CapCost(global, CapCost(client, n))
+	clientPart, clientOK := client.(Reserver)
+	globalPart, globalOK := global.(Reserver)
+	if !clientOK || !globalOK {
+		if d := global.Decide(n); !d.Allowed {
+			return d
+		}
+		return client.Decide(n)
+	}
+
+	clientAt, clientOK, cancelClient := reserve(clientPart, now, n)
+	clientDelay, globalDelay := delayOf(now, clientAt, clientOK), time.Duration(0)
+	if clientDelay == 0 {
+		mutex.Lock()
+		globalAt, globalOK, cancelGlobal := reserve(globalPart, now, n)
+		if globalDelay = delayOf(now, globalAt, globalOK); globalDelay > 0 && globalOK {
+			cancelGlobal(now)
+		}
+		mutex.Unlock()
+	}
+	allowed := clientDelay == 0 && globalDelay == 0
+	if !allowed && clientOK {
+		cancelClient(now)
+	}
+
+	d, retryAfter := client.Decide(0), clientDelay
+	if clientDelay == 0 && globalDelay > 0 {
+		d, retryAfter = global.Decide(0), globalDelay
+	}
+	d.Allowed, d.RetryAfter = allowed, retryAfter
+	return d
+}
+
+// delayOf returns how long from now a reservation for at must wait, or
+// InfDuration if it could never be honoured
+func delayOf(now, at time.Time, ok bool) time.Duration {
+	if !ok {
+		return InfDuration
+	}
+	return until(now, at)
+}
+
+// observersOf returns the limiters that want to hear how the backend did
+func observersOf(limiters ...any) []Observer {
+	var observers []Observer
+	for _, limiter := range limiters {
+		if observer, ok := limiter.(Observer); ok {
+			observers = append(observers, observer)
+		}
+	}
+	return observers
+}
+
+// StatusRecorder remembers the status code written through it
+type StatusRecorder struct {
+	http.ResponseWriter
+	// Status is the status code written, 200 until one is
+	Status int
+}
+
+// NewStatusRecorder creates a new StatusRecorder writing through w
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (sr *StatusRecorder) WriteHeader(code int) {
+	sr.Status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sr *StatusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
 }
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the limiters, so they can be driven by a
+// FakeClock in tests
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of time.Timer the limiters use
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// RealClock is the wall clock
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (rt realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTimer) Stop() bool {
+	return rt.t.Stop()
+}
+
+// FakeClock is a Clock that only moves when told to
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mutex  sync.Mutex
+}
+
+// NewFakeClock creates a FakeClock reading start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the fake time
+func (fc *FakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.now
+}
+
+// Advance moves the clock forward by d, firing any timers that come due
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	fc.now = fc.now.Add(d)
+
+	sort.Slice(fc.timers, func(i, j int) bool {
+		return fc.timers[i].deadline.Before(fc.timers[j].deadline)
+	})
+	for len(fc.timers) > 0 && !fc.timers[0].deadline.After(fc.now) {
+		fc.timers[0].c <- fc.now
+		fc.timers = fc.timers[1:]
+	}
+}
+
+// NewTimer creates a timer that fires once the clock is advanced past d
+func (fc *FakeClock) NewTimer(d time.Duration) Timer {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	t := &fakeTimer{clock: fc, deadline: fc.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- fc.now
+		return t
+	}
+	fc.timers = append(fc.timers, t)
+	return t
+}
+
+// Timers returns the number of timers waiting to fire
+func (fc *FakeClock) Timers() int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return len(fc.timers)
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (ft *fakeTimer) C() <-chan time.Time {
+	return ft.c
+}
+
+func (ft *fakeTimer) Stop() bool {
+	ft.clock.mutex.Lock()
+	defer ft.clock.mutex.Unlock()
+
+	for i, t := range ft.clock.timers {
+		if t == ft {
+			ft.clock.timers = append(ft.clock.timers[:i], ft.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
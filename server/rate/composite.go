@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Composite enforces several limits together, such as 10 requests a second
+// and 500 a minute. A request is admitted only if every limiter admits it,
+// and when one denies nothing is taken from the others: each is reserved in
+// turn and the reservations are handed back unless all can act now. The
+// limiters should share the Composite's clock.
+type Composite struct {
+	limiters []RateLimiter
+	parts    []Reserver
+	clock    Clock
+	mutex    sync.Mutex
+}
+
+// NewComposite creates a new Composite of limiters. Every limiter must
+// implement Reserver, as all the limiters in this package do.
+func NewComposite(limiters []RateLimiter, opts ...Option) (*Composite, error) {
+	o := newOptions(opts)
+	c := &Composite{
+		limiters: limiters,
+		parts:    make([]Reserver, len(limiters)),
+		clock:    o.clock,
+	}
+	for i, limiter := range limiters {
+		part, ok := limiter.(Reserver)
+		if !ok {
+			return nil, fmt.Errorf("rate: %T can't be part of a composite limiter", limiter)
+		}
+		c.parts[i] = part
+	}
+	return c, nil
+}
+
+// newCompositeConfig creates the Composite of config's Limits
+func newCompositeConfig(config LimiterConfig, opts ...Option) (*Composite, error) {
+	if len(config.Limits) == 0 {
+		return nil, &ParamError{config.Algorithm, "limits", config.Limits, "must not be empty"}
+	}
+	limiters := make([]RateLimiter, len(config.Limits))
+	for i, limit := range config.Limits {
+		limiter, err := NewLimiter(limit, opts...)
+		if err != nil {
+			return nil, err
+		}
+		limiters[i] = limiter
+	}
+	return NewComposite(limiters, opts...)
+}
+
+// Allow checks if a request can proceed under every limit
+func (c *Composite) Allow() bool {
+	return c.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under every limit
+func (c *Composite) AllowN(n int) bool {
+	return c.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed under every limit. The quota
+// reported is that of the limit closest to running out, and a denied
+// request is told to retry once every limit would admit it.
+func (c *Composite) Decide(n int) Decision {
+	n = max(0, n)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.clock.Now()
+	ats, cancels, ok := c.reserveAll(now, n)
+	allowed := ok && !latest(ats).After(now)
+	if ok && !allowed {
+		cancelAll(now, cancels)
+	}
+
+	d := tightest(c.limiters)
+	d.Allowed = allowed
+	switch {
+	case !ok:
+		d.RetryAfter = InfDuration
+	case !allowed:
+		d.RetryAfter = latest(ats).Sub(now)
+	}
+	return d
+}
+
+// Reserve claims a request under every limit, reporting how long until all
+// of them admit it
+func (c *Composite) Reserve() *Reservation {
+	return NewReservation(c, c.clock, 1)
+}
+
+// Wait blocks until every limit admits a request or ctx is done
+func (c *Composite) Wait(ctx context.Context) error {
+	return WaitN(ctx, c, c.clock, 1)
+}
+
+// Limiters returns the limiters the Composite enforces
+func (c *Composite) Limiters() []RateLimiter {
+	return c.limiters
+}
+
+// tightest returns the decision of the limit with the least quota left,
+// the one that resets last breaking ties. Unlimited limiters are skipped.
+func tightest(limiters []RateLimiter) Decision {
+	var tightest Decision
+	for _, limiter := range limiters {
+		d := limiter.Decide(0)
+		if d.Limit <= 0 {
+			continue
+		}
+		if tightest.Limit == 0 || d.Remaining < tightest.Remaining ||
+			(d.Remaining == tightest.Remaining && d.Reset > tightest.Reset) {
+			tightest = d
+		}
+	}
+	tightest.Allowed, tightest.RetryAfter = false, 0
+	return tightest
+}
+
+// reserveAll reserves n requests from every limiter, returning the time each
+// reserved and the functions that hand them back. If any limiter can never
+// admit n, the others are handed back.
+func (c *Composite) reserveAll(now time.Time, n int) ([]time.Time, []func(now time.Time), bool) {
+	ats := make([]time.Time, len(c.parts))
+	cancels := make([]func(now time.Time), len(c.parts))
+	for i, part := range c.parts {
+		at, ok, cancel := reserve(part, now, n)
+		if !ok {
+			cancelAll(now, cancels[:i])
+			return nil, nil, false
+		}
+		ats[i], cancels[i] = at, cancel
+	}
+	return ats, cancels, true
+}
+
+func cancelAll(now time.Time, cancels []func(now time.Time)) {
+	for _, cancel := range cancels {
+		cancel(now)
+	}
+}
+
+// reserveRecord reserves n requests under every limit. The function it
+// returns hands back what each limiter reserved for this reservation alone,
+// however many others are due at the same time.
+func (c *Composite) reserveRecord(now time.Time, n int) (time.Time, bool, func(now time.Time)) {
+	n = max(0, n)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ats, cancels, ok := c.reserveAll(now, n)
+	if !ok {
+		return time.Time{}, false, func(time.Time) {}
+	}
+	at := latest(ats)
+	if at.Before(now) {
+		at = now
+	}
+	return at, true, func(now time.Time) {
+		// A reservation whose time has come can't be cancelled
+		if at.Before(now) {
+			return
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		cancelAll(now, cancels)
+	}
+}
+
+// ReserveN reserves n requests from every limit and returns when all of
+// them admit them. Reservations made this way can't be handed back; those
+// made through Reserve or NewReservation can.
+func (c *Composite) ReserveN(now time.Time, n int) (time.Time, bool) {
+	at, ok, _ := c.reserveRecord(now, n)
+	return at, ok
+}
+
+// CancelN does nothing, as the Composite can't tell which of each limit's
+// reservations were made for at
+func (c *Composite) CancelN(now, at time.Time, n int) {}
+
+func latest(ats []time.Time) time.Time {
+	var last time.Time
+	for _, at := range ats {
+		if at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+// ParseLimits parses a comma-separated list of limits such as
+// "10/s,500/m,10000/d" into the configs of a composite limiter. Each limit
+// is a count of requests per s, m, h, d or a duration like 30s, optionally
+// prefixed with an algorithm as in "fixed_window:500/m"; the default is
+// algorithm. The bucket algorithms get a burst of the whole count. A quota
+// is per calendar hour, day or month, as in "quota:100000/month".
+func ParseLimits(spec, algorithm string) ([]LimiterConfig, error) {
+	var configs []LimiterConfig
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		config := LimiterConfig{Algorithm: algorithm}
+		if name, limit, found := strings.Cut(part, ":"); found {
+			config.Algorithm, part = name, limit
+		}
+
+		countText, windowText, found := strings.Cut(part, "/")
+		if !found {
+			return nil, fmt.Errorf("rate: limit %q is not count/window", part)
+		}
+		count, err := strconv.Atoi(countText)
+		if err != nil || count < 1 {
+			return nil, fmt.Errorf("rate: limit %q needs a positive count", part)
+		}
+		if config.Algorithm == "quota" {
+			if _, err := ParsePeriod(windowText); err != nil {
+				return nil, fmt.Errorf("rate: limit %q: %w", part, err)
+			}
+			config.Burst, config.Period = count, windowText
+			configs = append(configs, config)
+			continue
+		}
+		window, err := parseWindow(windowText)
+		if err != nil {
+			return nil, fmt.Errorf("rate: limit %q: %w", part, err)
+		}
+
+		// The window algorithms take the count per window as it is
+		config.Rate = float64(count) / window.Seconds()
+		if algorithm, ok := LookupAlgorithm(config.Algorithm); ok && algorithm.windowed() {
+			config.Rate = float64(count)
+		}
+		config.Burst = count
+		config.Window = window
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func parseWindow(text string) (time.Duration, error) {
+	switch text {
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	case "d":
+		return 24 * time.Hour, nil
+	}
+	window, err := time.ParseDuration(text)
+	if err == nil && window <= 0 {
+		err = fmt.Errorf("window %v must be positive", window)
+	}
+	return window, err
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCompositeConsumesAtomically(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	perSecond := NewFixedWindow(2, time.Second, WithClock(clock))
+	perMinute := NewFixedWindow(3, time.Minute, WithClock(clock))
+	c, err := NewComposite([]RateLimiter{perSecond, perMinute}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Allow() || !c.Allow() {
+		t.Fatal("first two requests denied")
+	}
+	if d := c.Decide(1); d.Allowed || d.RetryAfter != time.Second {
+		t.Fatalf("third request in a second: %+v, want denied for a second", d)
+	}
+	if d := perMinute.Decide(0); d.Remaining != 1 {
+		t.Fatalf("per minute limit has %d left, want the 1 the denied request didn't take", d.Remaining)
+	}
+
+	clock.Advance(time.Second)
+	if !c.Allow() {
+		t.Fatal("request in the next second denied")
+	}
+	d := c.Decide(1)
+	if d.Allowed || d.RetryAfter != 59*time.Second || d.Limit != 3 || d.Reset != 59*time.Second {
+		t.Fatalf("request past the minute's limit: %+v, want the minute's quota", d)
+	}
+	if d := perSecond.Decide(0); d.Remaining != 1 {
+		t.Fatalf("per second limit has %d left, want the 1 the denied request didn't take", d.Remaining)
+	}
+}
+
+func TestCompositeReportsTightestLimit(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	c, _ := NewComposite([]RateLimiter{
+		NewFixedWindow(10, time.Second, WithClock(clock)),
+		NewFixedWindow(4, time.Minute, WithClock(clock)),
+		&NoRateLimiter{},
+	}, WithClock(clock))
+
+	if d := c.Decide(2); !d.Allowed || d.Limit != 4 || d.Remaining != 2 || d.Reset != time.Minute {
+		t.Fatalf("got %+v, want the per minute limit's quota", d)
+	}
+	if d := c.Decide(20); d.Allowed || d.RetryAfter != InfDuration {
+		t.Fatalf("got %+v, want a request over every limit denied for good", d)
+	}
+}
+
+func TestCompositeReservationCancel(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	perSecond := NewFixedWindow(1, time.Second, WithClock(clock))
+	bucket := NewTokenBucket(5, time.Second, WithClock(clock))
+	c, _ := NewComposite([]RateLimiter{perSecond, bucket}, WithClock(clock))
+
+	c.Allow()
+	r := c.Reserve()
+	if !r.OK() || r.Delay() != time.Second {
+		t.Fatalf("reservation delayed %v, want a second", r.Delay())
+	}
+	r.Cancel()
+	if d := bucket.Decide(0); d.Remaining != 4 {
+		t.Fatalf("bucket has %d tokens after the cancel, want 4", d.Remaining)
+	}
+	clock.Advance(time.Second)
+	if d := perSecond.Decide(0); d.Remaining != 1 {
+		t.Fatalf("next window has %d left after the cancel, want 1", d.Remaining)
+	}
+}
+
+func TestCompositeCancelsReservationsDueTogether(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	wide := NewFixedWindow(2, time.Second, WithClock(clock))
+	narrow := NewFixedWindow(1, time.Second, WithClock(clock))
+	c, _ := NewComposite([]RateLimiter{wide, narrow}, WithClock(clock))
+
+	// Both reservations are due in a second, the first holding the narrow
+	// limit's current window and the second its next one
+	wide.AllowN(2)
+	first, second := c.Reserve(), c.Reserve()
+	if first.Delay() != time.Second || second.Delay() != time.Second {
+		t.Fatalf("reservations delayed %v and %v, want a second each", first.Delay(), second.Delay())
+	}
+	first.Cancel()
+	if d := narrow.Decide(0); d.Remaining != 1 {
+		t.Fatalf("narrow limit has %d left this window, want the 1 the first reservation held", d.Remaining)
+	}
+	clock.Advance(time.Second)
+	if d := narrow.Decide(0); d.Remaining != 0 {
+		t.Fatalf("narrow limit has %d left next window, want the second reservation kept", d.Remaining)
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	configs, err := ParseLimits("10/s, fixed_window:500/m,10000/d,5/30s", "token_bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LimiterConfig{
+		{Algorithm: "token_bucket", Rate: 10, Burst: 10, Window: time.Second},
+		{Algorithm: "fixed_window", Rate: 500, Burst: 500, Window: time.Minute},
+		{Algorithm: "token_bucket", Rate: 10000.0 / 86400, Burst: 10000, Window: 24 * time.Hour},
+		{Algorithm: "token_bucket", Rate: 5.0 / 30, Burst: 5, Window: 30 * time.Second},
+	}
+	if len(configs) != len(want) {
+		t.Fatalf("got %d limits, want %d", len(configs), len(want))
+	}
+	for i := range want {
+		if configs[i].Algorithm != want[i].Algorithm || configs[i].Rate != want[i].Rate ||
+			configs[i].Burst != want[i].Burst || configs[i].Window != want[i].Window {
+			t.Errorf("limit %d: got %+v, want %+v", i, configs[i], want[i])
+		}
+	}
+
+	for _, spec := range []string{"10", "0/s", "x/s", "10/w", "10/-1s"} {
+		if _, err := ParseLimits(spec, "token_bucket"); err == nil {
+			t.Errorf("ParseLimits(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestNewLimiterBuildsComposite(t *testing.T) {
+	configs, _ := ParseLimits("fixed_window:2/s,fixed_window:3/m", "")
+	limiter, err := NewLimiter(LimiterConfig{Algorithm: "composite", Limits: configs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limiter.AllowN(2) || limiter.Allow() {
+		t.Fatal("composite didn't enforce its per second limit")
+	}
+
+	if _, err := NewLimiter(LimiterConfig{Algorithm: "composite"}); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("got %v for no limits, want ErrInvalidParameter", err)
+	}
+	bad := LimiterConfig{Algorithm: "composite", Limits: []LimiterConfig{{Algorithm: "token_bucket", Rate: 1}}}
+	if _, err := NewLimiter(bad); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("got %v for a bad limit, want ErrInvalidParameter", err)
+	}
+}
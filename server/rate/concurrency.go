@@ -0,0 +1,146 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrConcurrencyLimit is returned when a request can neither run nor queue
+var ErrConcurrencyLimit = errors.New("rate: too many requests in flight")
+
+// InFlightLimiter is implemented by limiters that bound concurrent work
+// rather than arrival rate. The release func must be called once the work is done.
+type InFlightLimiter interface {
+	Acquire(ctx context.Context) (release func(), err error)
+}
+
+// ConcurrencyLimiter bounds the number of requests in flight. Requests that
+// arrive while every slot is taken wait in a FIFO queue of bounded size.
+type ConcurrencyLimiter struct {
+	limit        int
+	queueSize    int
+	queueTimeout time.Duration
+	inFlight     int
+	waiters      list.List // of chan struct{}, closed when a slot is granted
+	mutex        sync.Mutex
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter allowing limit requests
+// in flight and up to queueSize more waiting for at most queueTimeout each.
+// A zero queueTimeout waits as long as the caller's context allows.
+func NewConcurrencyLimiter(limit, queueSize int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		limit:        limit,
+		queueSize:    queueSize,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire takes a slot, queueing until one frees up if necessary
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context) (func(), error) {
+	cl.mutex.Lock()
+	if cl.inFlight < cl.limit && cl.waiters.Len() == 0 {
+		cl.inFlight++
+		cl.mutex.Unlock()
+		return cl.releaser(), nil
+	}
+	if cl.waiters.Len() >= cl.queueSize {
+		cl.mutex.Unlock()
+		return nil, ErrConcurrencyLimit
+	}
+	ready := make(chan struct{})
+	elem := cl.waiters.PushBack(ready)
+	cl.mutex.Unlock()
+
+	if cl.queueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cl.queueTimeout)
+		defer cancel()
+	}
+
+	select {
+	case <-ready:
+		return cl.releaser(), nil
+	case <-ctx.Done():
+		cl.mutex.Lock()
+		select {
+		case <-ready:
+			// Granted while giving up; pass the slot on
+			cl.inFlight--
+			cl.grant()
+		default:
+			cl.waiters.Remove(elem)
+		}
+		cl.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// TryAcquire takes a slot only if one is free right now
+func (cl *ConcurrencyLimiter) TryAcquire() (func(), bool) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if cl.inFlight < cl.limit && cl.waiters.Len() == 0 {
+		cl.inFlight++
+		return cl.releaser(), true
+	}
+	return nil, false
+}
+
+// InFlight returns the number of slots taken
+func (cl *ConcurrencyLimiter) InFlight() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.inFlight
+}
+
+// Queued returns the number of requests waiting for a slot
+func (cl *ConcurrencyLimiter) Queued() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.waiters.Len()
+}
+
+// Limit returns the number of requests allowed in flight
+func (cl *ConcurrencyLimiter) Limit() int {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.limit
+}
+
+// SetLimit changes the number of requests allowed in flight. Lowering it
+// does not interrupt requests already running.
+func (cl *ConcurrencyLimiter) SetLimit(limit int) {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	cl.limit = limit
+	cl.grant()
+}
+
+// releaser returns a func that gives back one slot, however often it is called
+func (cl *ConcurrencyLimiter) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mutex.Lock()
+			defer cl.mutex.Unlock()
+
+			cl.inFlight--
+			cl.grant()
+		})
+	}
+}
+
+// grant hands free slots to queued requests in arrival order
+func (cl *ConcurrencyLimiter) grant() {
+	for cl.inFlight < cl.limit && cl.waiters.Len() > 0 {
+		ready := cl.waiters.Remove(cl.waiters.Front()).(chan struct{})
+		cl.inFlight++
+		close(ready)
+	}
+}
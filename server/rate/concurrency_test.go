@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiterRejectsWithoutQueue(t *testing.T) {
+	cl := NewConcurrencyLimiter(2, 0, 0)
+	r1, err := cl.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := cl.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Acquire(context.Background()); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Fatalf("third Acquire got %v, want ErrConcurrencyLimit", err)
+	}
+
+	r1()
+	r1()
+	if cl.InFlight() != 1 {
+		t.Fatalf("double release left %d in flight, want 1", cl.InFlight())
+	}
+	if _, ok := cl.TryAcquire(); !ok {
+		t.Fatal("TryAcquire failed with a free slot")
+	}
+	r2()
+}
+
+func TestConcurrencyLimiterQueuesInOrder(t *testing.T) {
+	cl := NewConcurrencyLimiter(1, 2, 0)
+	release, _ := cl.Acquire(context.Background())
+
+	order := make(chan int, 2)
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := cl.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			r()
+		}()
+		for cl.Queued() != i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if _, err := cl.Acquire(context.Background()); !errors.Is(err, ErrConcurrencyLimit) {
+		t.Fatalf("Acquire with a full queue got %v, want ErrConcurrencyLimit", err)
+	}
+
+	release()
+	wg.Wait()
+	if first, second := <-order, <-order; first != 1 || second != 2 {
+		t.Fatalf("queued requests ran in order %d, %d", first, second)
+	}
+	if cl.InFlight() != 0 {
+		t.Fatalf("%d still in flight", cl.InFlight())
+	}
+}
+
+func TestConcurrencyLimiterQueueTimeout(t *testing.T) {
+	cl := NewConcurrencyLimiter(1, 1, 10*time.Millisecond)
+	release, _ := cl.Acquire(context.Background())
+	defer release()
+
+	if _, err := cl.Acquire(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("queued Acquire got %v, want a timeout", err)
+	}
+	if cl.Queued() != 0 {
+		t.Fatal("timed out request was left in the queue")
+	}
+}
+
+func TestProxyHandlerHoldsSlotDuringForward(t *testing.T) {
+	var inFlight, peak int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("no_rate_limit", 0, 0)
+	SetConcurrencyLimiter(2, 10, 0)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("got status %d, want queued requests to succeed", code)
+		}
+	}
+	if peak > 2 {
+		t.Fatalf("backend saw %d concurrent requests, limit is 2", peak)
+	}
+}
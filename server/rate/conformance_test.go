@@ -0,0 +1,410 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const ms = time.Millisecond
+
+// step is one point on a scripted timeline: at the given offset from epoch,
+// n requests are attempted and want is the expected admission
+type step struct {
+	at   time.Duration
+	n    int
+	want bool
+}
+
+// admits and denies build steps of single requests at the same instant
+func admits(at time.Duration, count int) []step {
+	return repeatStep(step{at: at, n: 1, want: true}, count)
+}
+
+func denies(at time.Duration, count int) []step {
+	return repeatStep(step{at: at, n: 1, want: false}, count)
+}
+
+func repeatStep(s step, count int) []step {
+	steps := make([]step, count)
+	for i := range steps {
+		steps[i] = s
+	}
+	return steps
+}
+
+func timeline(parts ...[]step) []step {
+	var steps []step
+	for _, p := range parts {
+		steps = append(steps, p...)
+	}
+	return steps
+}
+
+var conformanceCases = []struct {
+	name  string
+	new   func(Clock) RateLimiter
+	steps []step
+}{
+	{
+		name: "token_bucket/burst_then_refill",
+		new:  func(c Clock) RateLimiter { return NewTokenBucket(2, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 2), denies(0, 1),
+			denies(500*ms, 1),
+			admits(1000*ms, 1), denies(1000*ms, 1),
+			denies(1500*ms, 1),
+			admits(3000*ms, 2), denies(3000*ms, 1),
+			admits(10*time.Second, 2), denies(10*time.Second, 1),
+		),
+	},
+	{
+		name: "token_bucket/keeps_partial_refills",
+		new:  func(c Clock) RateLimiter { return NewTokenBucket(2, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 2),
+			admits(1000*ms, 1),
+			// Half a token from 1.0-1.5 and another half from 1.5-2.0
+			denies(1500*ms, 1),
+			admits(2000*ms, 1),
+			admits(3500*ms, 1), denies(3500*ms, 1),
+			admits(4000*ms, 1), denies(4000*ms, 1),
+		),
+	},
+	{
+		name: "token_bucket/below_one_per_second",
+		new:  func(c Clock) RateLimiter { return NewTokenBucketRate(1, 0.25, WithClock(c)) },
+		steps: timeline(
+			admits(0, 1), denies(0, 1),
+			denies(3999*ms, 1),
+			admits(4000*ms, 1), denies(4000*ms, 1),
+		),
+	},
+	{
+		name: "token_bucket/above_1e9_per_second",
+		new:  func(c Clock) RateLimiter { return NewTokenBucketRate(10, 4e9, WithClock(c)) },
+		steps: timeline(
+			admits(0, 10), denies(0, 1),
+			admits(1, 4), denies(1, 1),
+			admits(3, 8),
+		),
+	},
+	{
+		name: "token_bucket/allow_n",
+		new:  func(c Clock) RateLimiter { return NewTokenBucket(3, time.Second, WithClock(c)) },
+		steps: []step{
+			{at: 0, n: 4, want: false},
+			{at: 0, n: 2, want: true},
+			{at: 0, n: 2, want: false},
+			{at: 0, n: 1, want: true},
+			{at: 2000 * ms, n: 3, want: false},
+			{at: 2000 * ms, n: 2, want: true},
+		},
+	},
+	{
+		name: "leaky_bucket/fill_then_leak",
+		new:  func(c Clock) RateLimiter { return NewLeakyBucket(2, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 2), denies(0, 1),
+			denies(999*ms, 1),
+			admits(1000*ms, 1), denies(1000*ms, 1),
+			admits(3000*ms, 2), denies(3000*ms, 1),
+		),
+	},
+	{
+		name: "gcra/burst_then_refill",
+		new:  func(c Clock) RateLimiter { return NewGCRA(2, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 2), denies(0, 1),
+			denies(500*ms, 1),
+			admits(1000*ms, 1), denies(1000*ms, 1),
+			admits(2500*ms, 1), denies(2500*ms, 1),
+			admits(3000*ms, 1),
+			admits(10*time.Second, 2), denies(10*time.Second, 1),
+		),
+	},
+	{
+		name: "gcra/allow_n",
+		new:  func(c Clock) RateLimiter { return NewGCRA(3, time.Second, WithClock(c)) },
+		steps: []step{
+			{at: 0, n: 4, want: false},
+			{at: 0, n: 2, want: true},
+			{at: 0, n: 2, want: false},
+			{at: 0, n: 1, want: true},
+			{at: 2000 * ms, n: 3, want: false},
+			{at: 2000 * ms, n: 2, want: true},
+		},
+	},
+	{
+		name: "sliding_window/rolls_per_request",
+		new:  func(c Clock) RateLimiter { return NewSlidingWindow(2, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 1),
+			admits(900*ms, 1), denies(900*ms, 1),
+			admits(1000*ms, 1), denies(1000*ms, 1),
+			denies(1800*ms, 1),
+			admits(1900*ms, 1), denies(1900*ms, 1),
+		),
+	},
+	{
+		name: "sliding_window/allow_n",
+		new:  func(c Clock) RateLimiter { return NewSlidingWindow(3, time.Second, WithClock(c)) },
+		steps: []step{
+			{at: 0, n: 4, want: false},
+			{at: 0, n: 3, want: true},
+			{at: 999 * ms, n: 1, want: false},
+			{at: 1000 * ms, n: 3, want: true},
+		},
+	},
+	{
+		name: "sliding_window_counter/weights_previous_window",
+		new:  func(c Clock) RateLimiter { return NewSlidingWindowCounter(4, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 4), denies(0, 1),
+			denies(999*ms, 1),
+			// 4 * 0.75 of the previous window still counts
+			admits(1250*ms, 1), denies(1250*ms, 1),
+			admits(1500*ms, 1), denies(1500*ms, 1),
+			admits(2000*ms, 2), denies(2000*ms, 1),
+			admits(5000*ms, 4),
+		),
+	},
+	{
+		name: "fixed_window/resets_on_boundary",
+		new:  func(c Clock) RateLimiter { return NewFixedWindow(2, time.Second, WithClock(c)) },
+		steps: timeline(
+			admits(0, 1),
+			admits(900*ms, 1), denies(900*ms, 1),
+			admits(1000*ms, 2), denies(1000*ms, 1),
+			denies(1999*ms, 1),
+			admits(4500*ms, 2), denies(4500*ms, 1),
+			admits(5000*ms, 1),
+		),
+	},
+	{
+		name: "store_token_bucket/burst_then_refill",
+		new: func(c Clock) RateLimiter {
+			return NewStoreTokenBucket(NewMemoryStore(WithClock(c)), "tb", 2, 1, WithClock(c))
+		},
+		steps: timeline(
+			admits(0, 2), denies(0, 1),
+			denies(500*ms, 1),
+			admits(1000*ms, 1), denies(1000*ms, 1),
+			admits(2500*ms, 1), denies(2500*ms, 1),
+			admits(3000*ms, 1),
+			admits(10*time.Second, 2), denies(10*time.Second, 1),
+		),
+	},
+	{
+		name: "store_sliding_window_counter/weights_previous_window",
+		new: func(c Clock) RateLimiter {
+			return NewStoreSlidingWindowCounter(NewMemoryStore(WithClock(c)), "swc", 4, time.Second, WithClock(c))
+		},
+		steps: timeline(
+			admits(0, 4), denies(0, 1),
+			denies(999*ms, 1),
+			admits(1250*ms, 1), denies(1250*ms, 1),
+			admits(1500*ms, 1), denies(1500*ms, 1),
+			admits(2000*ms, 2), denies(2000*ms, 1),
+			admits(5000*ms, 4),
+		),
+	},
+	{
+		name: "store_fixed_window/resets_on_boundary",
+		new: func(c Clock) RateLimiter {
+			return NewStoreFixedWindow(NewMemoryStore(WithClock(c)), "fw", 2, time.Second, WithClock(c))
+		},
+		steps: timeline(
+			admits(0, 1),
+			admits(900*ms, 1), denies(900*ms, 1),
+			admits(1000*ms, 2), denies(1000*ms, 1),
+			denies(1999*ms, 1),
+			admits(4500*ms, 2), denies(4500*ms, 1),
+			admits(5000*ms, 1),
+		),
+	},
+	{
+		name: "no_rate_limit",
+		new:  func(c Clock) RateLimiter { return &NoRateLimiter{} },
+		steps: timeline(
+			admits(0, 100),
+			[]step{{at: 0, n: 1000, want: true}},
+		),
+	},
+}
+
+func TestConformance(t *testing.T) {
+	for _, tc := range conformanceCases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			limiter := tc.new(clock)
+			for i, s := range tc.steps {
+				clock.Advance(epoch.Add(s.at).Sub(clock.Now()))
+				if got := limiter.AllowN(s.n); got != s.want {
+					t.Fatalf("step %d at %v: AllowN(%d) = %v, want %v", i, s.at, s.n, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestConformanceTakesNothingForNonPositiveN(t *testing.T) {
+	cases := append([]struct {
+		name  string
+		new   func(Clock) RateLimiter
+		steps []step
+	}{
+		{name: "quota", new: func(c Clock) RateLimiter { return NewQuota(2, PeriodDay, time.UTC, WithClock(c)) }},
+		{name: "composite", new: func(c Clock) RateLimiter {
+			limiter, _ := NewComposite([]RateLimiter{
+				NewTokenBucket(2, time.Second, WithClock(c)),
+				NewSlidingWindow(3, time.Second, WithClock(c)),
+			}, WithClock(c))
+			return limiter
+		}},
+	}, conformanceCases...)
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := tc.new(NewFakeClock(epoch))
+			limiter.Allow()
+			before := limiter.Decide(0)
+			for _, n := range []int{0, -1, -1000} {
+				if d := limiter.Decide(n); !d.Allowed || d.Remaining != before.Remaining {
+					t.Fatalf("Decide(%d) = %+v, want allowed with %d still remaining", n, d, before.Remaining)
+				}
+			}
+			if part, ok := limiter.(Reserver); ok {
+				_, ok := part.ReserveN(epoch, -1)
+				if d := limiter.Decide(0); !ok || d.Remaining != before.Remaining {
+					t.Fatalf("reserving -1 left %d remaining, want %d", d.Remaining, before.Remaining)
+				}
+			}
+		})
+	}
+}
+
+func TestConformanceReserveDelays(t *testing.T) {
+	cases := []struct {
+		name   string
+		new    func(Clock) RateLimiter
+		delays []time.Duration
+	}{
+		{
+			name:   "token_bucket",
+			new:    func(c Clock) RateLimiter { return NewTokenBucket(2, time.Second, WithClock(c)) },
+			delays: []time.Duration{0, 0, time.Second, 2 * time.Second},
+		},
+		{
+			name:   "leaky_bucket",
+			new:    func(c Clock) RateLimiter { return NewLeakyBucket(2, time.Second, WithClock(c)) },
+			delays: []time.Duration{0, 0, time.Second, 2 * time.Second},
+		},
+		{
+			name:   "gcra",
+			new:    func(c Clock) RateLimiter { return NewGCRA(2, time.Second, WithClock(c)) },
+			delays: []time.Duration{0, 0, time.Second, 2 * time.Second},
+		},
+		{
+			name:   "sliding_window",
+			new:    func(c Clock) RateLimiter { return NewSlidingWindow(2, time.Second, WithClock(c)) },
+			delays: []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second},
+		},
+		{
+			name:   "sliding_window_counter",
+			new:    func(c Clock) RateLimiter { return NewSlidingWindowCounter(2, time.Second, WithClock(c)) },
+			delays: []time.Duration{0, 0, 1500 * ms, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name:   "fixed_window",
+			new:    func(c Clock) RateLimiter { return NewFixedWindow(2, time.Second, WithClock(c)) },
+			delays: []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second},
+		},
+		{
+			name: "store_token_bucket",
+			new: func(c Clock) RateLimiter {
+				return NewStoreTokenBucket(NewMemoryStore(WithClock(c)), "tb", 2, 1, WithClock(c))
+			},
+			delays: []time.Duration{0, 0, time.Second, 2 * time.Second},
+		},
+		{
+			name: "store_sliding_window_counter",
+			new: func(c Clock) RateLimiter {
+				return NewStoreSlidingWindowCounter(NewMemoryStore(WithClock(c)), "swc", 2, time.Second, WithClock(c))
+			},
+			delays: []time.Duration{0, 0, 1500 * ms, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name: "store_fixed_window",
+			new: func(c Clock) RateLimiter {
+				return NewStoreFixedWindow(NewMemoryStore(WithClock(c)), "fw", 2, time.Second, WithClock(c))
+			},
+			delays: []time.Duration{0, 0, time.Second, time.Second, 2 * time.Second},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := tc.new(NewFakeClock(epoch))
+			for i, want := range tc.delays {
+				r := limiter.Reserve()
+				if !r.OK() || r.Delay() != want {
+					t.Fatalf("reservation %d: delay %v, want %v", i, r.Delay(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestConformanceWaitAdvancesWithClock(t *testing.T) {
+	cases := []struct {
+		name string
+		new  func(Clock) RateLimiter
+		wait time.Duration
+	}{
+		{"token_bucket", func(c Clock) RateLimiter { return NewTokenBucket(1, time.Second, WithClock(c)) }, time.Second},
+		{"leaky_bucket", func(c Clock) RateLimiter { return NewLeakyBucket(1, time.Second, WithClock(c)) }, time.Second},
+		{"gcra", func(c Clock) RateLimiter { return NewGCRA(1, time.Second, WithClock(c)) }, time.Second},
+		{"sliding_window", func(c Clock) RateLimiter { return NewSlidingWindow(1, time.Second, WithClock(c)) }, time.Second},
+		{"fixed_window", func(c Clock) RateLimiter { return NewFixedWindow(1, time.Second, WithClock(c)) }, time.Second},
+		// The first request keeps its full weight until its window ends
+		{"sliding_window_counter", func(c Clock) RateLimiter { return NewSlidingWindowCounter(1, time.Second, WithClock(c)) }, 2 * time.Second},
+		{"store_token_bucket", func(c Clock) RateLimiter {
+			return NewStoreTokenBucket(NewMemoryStore(WithClock(c)), "tb", 1, 1, WithClock(c))
+		}, time.Second},
+		{"store_fixed_window", func(c Clock) RateLimiter {
+			return NewStoreFixedWindow(NewMemoryStore(WithClock(c)), "fw", 1, time.Second, WithClock(c))
+		}, time.Second},
+		{"store_sliding_window_counter", func(c Clock) RateLimiter {
+			return NewStoreSlidingWindowCounter(NewMemoryStore(WithClock(c)), "swc", 1, time.Second, WithClock(c))
+		}, 2 * time.Second},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			limiter := tc.new(clock)
+			limiter.Allow()
+
+			done := make(chan error)
+			go func() { done <- limiter.Wait(context.Background()) }()
+			for clock.Timers() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			clock.Advance(tc.wait - ms)
+			select {
+			case err := <-done:
+				t.Fatalf("Wait returned early: %v", err)
+			default:
+			}
+
+			clock.Advance(ms)
+			if err := <-done; err != nil {
+				t.Fatalf("Wait failed: %v", err)
+			}
+			if limiter.Allow() {
+				t.Fatal("the waited-for request was not accounted for")
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	matrix "github.com/arvchahal/Limitly/server/matrix"
+)
+
+// CostFunc returns how many units of quota a request consumes, at least one
+type CostFunc func(r *http.Request) int
+
+// UnitCost is the CostFunc that charges every request one unit
+func UnitCost(*http.Request) int {
+	return 1
+}
+
+// FixedCost returns a CostFunc that charges every request n units
+func FixedCost(n int) CostFunc {
+	return func(*http.Request) int {
+		return n
+	}
+}
+
+// BytesPerUnit is how much of a body BodySizeCost charges a unit for by
+// default
+const BytesPerUnit = 1024
+
+// BodySizeCost returns a CostFunc that charges a unit, plus one for each
+// bytesPerUnit of the request body's declared length
+func BodySizeCost(bytesPerUnit int64) CostFunc {
+	return func(r *http.Request) int {
+		if r.ContentLength <= 0 {
+			return 1
+		}
+		return clampCost(1 + r.ContentLength/bytesPerUnit)
+	}
+}
+
+// MatrixOpsPerUnit is how many steps of a factorisation MatrixCost charges
+// a unit for by default, so a 10x10 matrix costs 10
+const MatrixOpsPerUnit = 100
+
+// MatrixMaxBody is the most of a body MatrixCost reads by default
+const MatrixMaxBody = 1 << 20
+
+// MatrixCost returns a CostFunc that charges a matrix.MatrixRequest by the
+// work of factoring its matrix, n³ steps for an n×n matrix, at a unit per
+// opsPerUnit steps. At most maxBody bytes of the body are read, and put back
+// for the backend; a larger body is charged as the largest matrix that
+// could be written in it, two bytes to an element. Bodies that aren't a
+// matrix cost one unit and are left for the backend to reject.
+func MatrixCost(opsPerUnit int, maxBody int64) CostFunc {
+	return func(r *http.Request) int {
+		if r.Body == nil || r.Body == http.NoBody {
+			return 1
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil {
+			return 1
+		}
+
+		var n int64
+		if int64(len(body)) > maxBody {
+			size := r.ContentLength
+			if size < int64(len(body)) {
+				size = int64(len(body))
+			}
+			n = int64(math.Sqrt(float64(size) / 2))
+		} else {
+			var req matrix.MatrixRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				return 1
+			}
+			n = int64(len(req.Matrix))
+		}
+		if n > 1<<20 {
+			return math.MaxInt32
+		}
+		ops := n * n * n
+		return clampCost((ops + int64(opsPerUnit) - 1) / int64(opsPerUnit))
+	}
+}
+
+// clampCost keeps a cost between one unit and the most an int32 can hold
+func clampCost(cost int64) int {
+	switch {
+	case cost < 1:
+		return 1
+	case cost > math.MaxInt32:
+		return math.MaxInt32
+	}
+	return int(cost)
+}
+
+// capacitor is implemented by limiters that know the most units they can
+// admit at once from the burst or limit they were built with. Their
+// capacity can then be had without asking for a decision, which for the
+// limiters kept in a Store means a round trip.
+type capacitor interface {
+	maxUnits() int
+}
+
+// Capacity returns the most units limiter can ever admit at once, or zero if
+// it doesn't limit them. Limiters from outside this package are asked for a
+// decision on no requests.
+func Capacity(limiter RateLimiter) int {
+	if c, ok := limiter.(capacitor); ok {
+		return max(0, c.maxUnits())
+	}
+	return max(0, limiter.Decide(0).Limit)
+}
+
+// CapCost caps a cost of n units at limiter's capacity, so that a request
+// costing more than the limiter could ever admit uses up all of it rather
+// than being denied forever. A negative cost is taken as zero.
+func CapCost(limiter RateLimiter, n int) int {
+	n = max(0, n)
+	if capacity := Capacity(limiter); capacity > 0 && n > capacity {
+		return capacity
+	}
+	return n
+}
+
+// Exhausted reports whether limiter has nothing left for even a request
+// costing one unit, without taking anything from it, along with the
+// decision to deny such a request with. Requests can then be turned away
+// before working out their cost, which may mean reading their body.
+func Exhausted(limiter RateLimiter) (Decision, bool) {
+	if Capacity(limiter) == 0 {
+		return Decision{}, false
+	}
+	d := limiter.Decide(0)
+	if d.Limit <= 0 || d.Remaining > 0 {
+		return d, false
+	}
+	// A reservation handed straight back tells when a unit frees up without
+	// taking it. It is cancelled as of its own time so that it is handed
+	// back even if a unit freed up in between and it was made for now.
+	reservation := limiter.Reserve()
+	if reservation == nil {
+		return d, false
+	}
+	delay := reservation.Delay()
+	reservation.CancelAt(reservation.at)
+	if delay <= 0 {
+		return d, false
+	}
+	d.Allowed, d.RetryAfter = false, delay
+	return d, true
+}
+
+func (nrl *NoRateLimiter) maxUnits() int {
+	return 0
+}
+
+func (tb *TokenBucket) maxUnits() int {
+	return tb.capacity
+}
+
+func (lb *LeakyBucket) maxUnits() int {
+	return lb.capacity
+}
+
+func (g *GCRA) maxUnits() int {
+	return g.burst
+}
+
+func (sw *SlidingWindow) maxUnits() int {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	return sw.limit
+}
+
+func (swc *SlidingWindowCounter) maxUnits() int {
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+	return swc.limit
+}
+
+func (fw *FixedWindow) maxUnits() int {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return fw.limit
+}
+
+func (q *Quota) maxUnits() int {
+	return q.limit
+}
+
+func (stb *StoreTokenBucket) maxUnits() int {
+	return stb.burst
+}
+
+func (sfw *StoreFixedWindow) maxUnits() int {
+	return sfw.windowLimit()
+}
+
+func (sswc *StoreSlidingWindowCounter) maxUnits() int {
+	return sswc.windowLimit()
+}
+
+func (sq *StoreQuota) maxUnits() int {
+	return sq.limit
+}
+
+func (a *AIMD) maxUnits() int {
+	return Capacity(a.Tunable)
+}
+
+// maxUnits is that of the smallest limit, as no more can be admitted at once
+func (c *Composite) maxUnits() int {
+	capacity := 0
+	for _, limiter := range c.limiters {
+		if limit := Capacity(limiter); limit > 0 && (capacity == 0 || limit < capacity) {
+			capacity = limit
+		}
+	}
+	return capacity
+}
+
+// CostRule charges the requests matching Method and Path with Cost. An
+// empty Method matches any; a Path ending in a slash matches everything
+// below it, as with http.ServeMux, and any other Path only itself.
+type CostRule struct {
+	Method string
+	Path   string
+	Cost   CostFunc
+}
+
+func (rule CostRule) matches(r *http.Request) bool {
+	if rule.Method != "" && rule.Method != r.Method {
+		return false
+	}
+	if strings.HasSuffix(rule.Path, "/") {
+		return strings.HasPrefix(r.URL.Path, rule.Path)
+	}
+	return r.URL.Path == rule.Path
+}
+
+// RouteCost returns a CostFunc that charges a request by the first rule it
+// matches, and by fallback if it matches none
+func RouteCost(rules []CostRule, fallback CostFunc) CostFunc {
+	return func(r *http.Request) int {
+		for _, rule := range rules {
+			if rule.matches(r) {
+				return rule.Cost(r)
+			}
+		}
+		return fallback(r)
+	}
+}
+
+// ParseCostRules parses a comma-separated list of rules such as
+// "POST /cholesky=matrix,/upload/=body,GET /=1". Each is an optional method,
+// a path and a cost: a number of units, "body" for BodySizeCost or "matrix"
+// for MatrixCost with their default sizes.
+func ParseCostRules(spec string) ([]CostRule, error) {
+	var rules []CostRule
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		route, costText, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("rate: cost rule %q is not route=cost", part)
+		}
+
+		var rule CostRule
+		fields := strings.Fields(route)
+		switch len(fields) {
+		case 1:
+			rule.Path = fields[0]
+		case 2:
+			rule.Method, rule.Path = fields[0], fields[1]
+		default:
+			return nil, fmt.Errorf("rate: cost rule %q needs a path and at most a method", part)
+		}
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("rate: cost rule %q has no path", part)
+		}
+
+		switch costText {
+		case "body":
+			rule.Cost = BodySizeCost(BytesPerUnit)
+		case "matrix":
+			rule.Cost = MatrixCost(MatrixOpsPerUnit, MatrixMaxBody)
+		default:
+			n, err := strconv.Atoi(costText)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("rate: cost rule %q needs a positive cost, body or matrix", part)
+			}
+			rule.Cost = FixedCost(n)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
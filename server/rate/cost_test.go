@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	matrix "github.com/arvchahal/Limitly/server/matrix"
+)
+
+func matrixBody(t *testing.T, n int) string {
+	req := matrix.MatrixRequest{Matrix: make([][]float64, n)}
+	for i := range req.Matrix {
+		req.Matrix[i] = make([]float64, n)
+		req.Matrix[i][i] = 1
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMatrixCost(t *testing.T) {
+	cost := MatrixCost(MatrixOpsPerUnit, MatrixMaxBody)
+	cases := []struct {
+		body string
+		want int
+	}{
+		{matrixBody(t, 10), 10},
+		{matrixBody(t, 3), 1},
+		{matrixBody(t, 20), 80},
+		{"not a matrix", 1},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("POST", "/cholesky", strings.NewReader(tc.body))
+		if got := cost(r); got != tc.want {
+			t.Errorf("cost of %.20q... = %d, want %d", tc.body, got, tc.want)
+		}
+		if body, _ := io.ReadAll(r.Body); string(body) != tc.body {
+			t.Errorf("body read back as %.20q..., want it left for the backend", body)
+		}
+	}
+
+	// Past the most it reads, a body is charged as the largest matrix it could hold
+	r := httptest.NewRequest("POST", "/cholesky", strings.NewReader(strings.Repeat(" ", 2000)))
+	if got := MatrixCost(1, 100)(r); got != 31*31*31 {
+		t.Errorf("oversized body cost %d, want that of a 31x31 matrix", got)
+	}
+	if got := MatrixCost(1, 100)(httptest.NewRequest("GET", "/", nil)); got != 1 {
+		t.Errorf("request without a body cost %d, want 1", got)
+	}
+}
+
+func TestRouteCost(t *testing.T) {
+	rules, err := ParseCostRules("POST /cholesky=matrix, /upload/=body, GET /=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost := RouteCost(rules, UnitCost)
+
+	upload := httptest.NewRequest("PUT", "/upload/file", strings.NewReader(strings.Repeat("x", 3000)))
+	cases := []struct {
+		r    *http.Request
+		want int
+	}{
+		{httptest.NewRequest("POST", "/cholesky", strings.NewReader(matrixBody(t, 10))), 10},
+		{httptest.NewRequest("GET", "/cholesky", nil), 3},
+		{upload, 3},
+		{httptest.NewRequest("GET", "/", nil), 3},
+		{httptest.NewRequest("DELETE", "/other", nil), 1},
+	}
+	for _, tc := range cases {
+		if got := cost(tc.r); got != tc.want {
+			t.Errorf("%s %s cost %d, want %d", tc.r.Method, tc.r.URL.Path, got, tc.want)
+		}
+	}
+
+	for _, spec := range []string{"/cholesky", "GET=1", "/=0", "/=many", "GET POST /=1"} {
+		if _, err := ParseCostRules(spec); err == nil {
+			t.Errorf("ParseCostRules(%q) succeeded", spec)
+		}
+	}
+	if got := BodySizeCost(10)(httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", math.MaxInt8)))); got != 13 {
+		t.Errorf("body cost %d, want 13", got)
+	}
+}
+
+func TestProxyHandlerChargesRequestCost(t *testing.T) {
+	var received []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+	}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("no_rate_limit", 0, 0)
+	SetKeyedLimiter(NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewFixedWindow(25, time.Minute) }, DefaultKeyedConfig()))
+	defer SetKeyedLimiter(nil)
+	rules, _ := ParseCostRules("POST /cholesky=matrix")
+	SetCostFunc(RouteCost(rules, UnitCost))
+	defer SetCostFunc(nil)
+
+	status := func(r *http.Request, remoteAddr string) int {
+		r.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, r)
+		return rec.Code
+	}
+	cholesky := func() *http.Request {
+		return httptest.NewRequest("POST", "/cholesky", strings.NewReader(matrixBody(t, 10)))
+	}
+
+	// A 10x10 factorisation costs 10, so 25 units last two of them
+	for i := 0; i < 2; i++ {
+		if code := status(cholesky(), "10.0.0.1:1000"); code != http.StatusOK {
+			t.Fatalf("factorisation %d got %d", i+1, code)
+		}
+	}
+	if code := status(cholesky(), "10.0.0.1:1000"); code != http.StatusTooManyRequests {
+		t.Fatalf("third factorisation got %d, want it limited", code)
+	}
+	if received[0] != matrixBody(t, 10) {
+		t.Fatal("backend didn't receive the matrix")
+	}
+	// Cheap requests from another client get all 25
+	for i := 0; i < 25; i++ {
+		if code := status(httptest.NewRequest("GET", "/", nil), "10.0.0.2:1000"); code != http.StatusOK {
+			t.Fatalf("cheap request %d got %d", i+1, code)
+		}
+	}
+}
+
+// countingReader counts the reads of a request body
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.Reader.Read(p)
+}
+
+func TestProxyHandlerCapsCostAtCapacity(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("no_rate_limit", 0, 0)
+	clock := NewFakeClock(epoch)
+	SetKeyedLimiter(NewKeyedLimiter(ClientIP, func(string) RateLimiter {
+		return NewTokenBucket(5, time.Second, WithClock(clock))
+	}, DefaultKeyedConfig(), WithClock(clock)))
+	defer SetKeyedLimiter(nil)
+	rules, _ := ParseCostRules("POST /cholesky=matrix")
+	SetCostFunc(RouteCost(rules, UnitCost))
+	defer SetCostFunc(nil)
+
+	// A 10x10 factorisation costs 10, past the burst of 5
+	body := &countingReader{Reader: strings.NewReader(matrixBody(t, 10))}
+	rec := httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest("POST", "/cholesky", body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request costing more than the burst got %d, want it charged the whole burst", rec.Code)
+	}
+
+	// The client has nothing left, so the next body isn't even read
+	body = &countingReader{Reader: strings.NewReader(matrixBody(t, 10))}
+	rec = httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest("POST", "/cholesky", body))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("got %d with Retry-After %q, want 429 in a second", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if body.reads != 0 {
+		t.Fatalf("body of a denied request was read %d times", body.reads)
+	}
+
+	// Once refilled the request goes through again
+	clock.Advance(5 * time.Second)
+	rec = httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest("POST", "/cholesky", strings.NewReader(matrixBody(t, 10))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("request after a refill got %d", rec.Code)
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	limiter := NewFixedWindow(2, time.Second, WithClock(clock))
+	if _, exhausted := Exhausted(limiter); exhausted {
+		t.Fatal("a fresh limiter is exhausted")
+	}
+	limiter.AllowN(2)
+	d, exhausted := Exhausted(limiter)
+	if !exhausted || d.Allowed || d.RetryAfter != time.Second {
+		t.Fatalf("got %+v, %v, want exhausted for a second", d, exhausted)
+	}
+	// Checking takes nothing, so the next window still has both requests
+	clock.Advance(time.Second)
+	if !limiter.AllowN(2) {
+		t.Fatal("Exhausted took from the next window")
+	}
+	// Nor from a bucket whose next token the check borrowed against
+	bucket := NewTokenBucket(1, time.Second, WithClock(clock))
+	bucket.Allow()
+	if d, exhausted := Exhausted(bucket); !exhausted || d.RetryAfter != time.Second {
+		t.Fatalf("got %+v, %v, want the empty bucket exhausted for a second", d, exhausted)
+	}
+	clock.Advance(time.Second)
+	if _, exhausted := Exhausted(bucket); exhausted || !bucket.Allow() {
+		t.Fatal("Exhausted took the refilled token")
+	}
+	if _, exhausted := Exhausted(&NoRateLimiter{}); exhausted {
+		t.Fatal("an unlimited limiter is exhausted")
+	}
+	if got := CapCost(NewTokenBucket(5, time.Second), 10); got != 5 {
+		t.Fatalf("CapCost = %d, want the burst of 5", got)
+	}
+}
+
+// countingStore counts the calls made to a MemoryStore
+type countingStore struct {
+	*MemoryStore
+	calls atomic.Int64
+}
+
+func (cs *countingStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	cs.calls.Add(1)
+	return cs.MemoryStore.Incr(ctx, key, delta, ttl)
+}
+
+func (cs *countingStore) Get(ctx context.Context, key string) (string, bool, error) {
+	cs.calls.Add(1)
+	return cs.MemoryStore.Get(ctx, key)
+}
+
+func (cs *countingStore) CompareAndSwap(ctx context.Context, key, old, new string, ttl time.Duration) (bool, error) {
+	cs.calls.Add(1)
+	return cs.MemoryStore.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+func TestCapCostSkipsTheStore(t *testing.T) {
+	store := &countingStore{MemoryStore: NewMemoryStore()}
+	limiters := []RateLimiter{
+		NewStoreTokenBucket(store, "tb", 5, 1),
+		NewStoreFixedWindow(store, "fw", 5, time.Minute),
+		NewStoreSlidingWindowCounter(store, "swc", 5, time.Minute),
+		NewStoreQuota(store, "q", 5, PeriodDay, nil),
+	}
+	for _, limiter := range limiters {
+		if got := CapCost(limiter, 10); got != 5 {
+			t.Errorf("%T: CapCost = %d, want the limit of 5", limiter, got)
+		}
+	}
+	if calls := store.calls.Load(); calls != 0 {
+		t.Fatalf("capping costs made %d calls to the store, want none", calls)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Decision describes the outcome of a rate limiting check along with the
+// quota left over, so callers can tell clients when to come back
+type Decision struct {
+	Allowed bool
+	// Limit is the quota the limiter enforces; zero means unlimited
+	Limit int
+	// Remaining is the quota left after this decision
+	Remaining int
+	// Reset is the time until the quota is fully restored
+	Reset time.Duration
+	// RetryAfter is the time until a denied request would be admitted.
+	// It is zero for allowed requests and InfDuration if it never would be.
+	RetryAfter time.Duration
+}
+
+// SetRateLimitHeaders writes the IETF draft RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers for d, plus Retry-After for denied requests
+func SetRateLimitHeaders(h http.Header, d Decision) {
+	if d.Limit <= 0 {
+		return
+	}
+	h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(max(0, d.Remaining)))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+	if !d.Allowed && d.RetryAfter != InfDuration {
+		h.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(d.RetryAfter))))
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds, never going below zero
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// until returns the time from now to t, clamped at zero
+func until(now, t time.Time) time.Duration {
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDecideReportsQuota(t *testing.T) {
+	limiters := map[string]RateLimiter{
+		"token_bucket":           NewTokenBucket(3, time.Minute),
+		"leaky_bucket":           NewLeakyBucket(3, time.Minute),
+		"gcra":                   NewGCRA(3, time.Minute),
+		"sliding_window":         NewSlidingWindow(3, time.Minute),
+		"fixed_window":           NewFixedWindow(3, time.Minute),
+		"sliding_window_counter": NewSlidingWindowCounter(3, time.Minute),
+	}
+	for name, limiter := range limiters {
+		for want := 2; want >= 0; want-- {
+			d := limiter.Decide(1)
+			if !d.Allowed || d.Limit != 3 || d.Remaining != want {
+				t.Errorf("%s: got %+v, want allowed with %d remaining", name, d, want)
+			}
+		}
+		d := limiter.Decide(1)
+		// The sliding window counter can take up to two windows to forget a request
+		if d.Allowed || d.RetryAfter <= 0 || d.RetryAfter > 2*time.Minute || d.Reset <= 0 {
+			t.Errorf("%s: got %+v, want denied with a retry within two windows", name, d)
+		}
+		if d := limiter.Decide(4); d.RetryAfter != InfDuration {
+			t.Errorf("%s: request larger than the limit should never be retried, got %v", name, d.RetryAfter)
+		}
+	}
+}
+
+func TestProxyHandlerSetsRateLimitHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("fixed_window", 1, 1)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	rec := httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first request got status %d", rec.Code)
+	}
+	if got := rec.Header().Get("RateLimit-Limit"); got != "1" {
+		t.Errorf("RateLimit-Limit = %q, want 1", got)
+	}
+	if got := rec.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining = %q, want 0", got)
+	}
+
+	rec = httptest.NewRecorder()
+	ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request got status %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+	if got := rec.Header().Get("RateLimit-Reset"); got != "1" {
+		t.Errorf("RateLimit-Reset = %q, want 1", got)
+	}
+}
@@ -0,0 +1,568 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrStoreContention is returned when a value in the store kept changing
+// under a limiter trying to update it
+var ErrStoreContention = errors.New("rate: store value changed too often to update")
+
+// casAttempts bounds how many times a compare-and-swap is retried
+const casAttempts = 16
+
+// storeFailure is the decision made when the store can't be reached
+func storeFailure(limit int, failClosed bool) Decision {
+	if failClosed {
+		return Decision{Limit: limit}
+	}
+	return Decision{Allowed: true, Limit: limit, Remaining: limit}
+}
+
+// storeReserveFailure is what ReserveN returns when the store can't be
+// reached. Failing open admits the requests without a time, as nothing was
+// reserved that CancelN could hand back.
+func storeReserveFailure(failClosed bool) (time.Time, bool) {
+	return time.Time{}, !failClosed
+}
+
+// StoreTokenBucket struct for a token bucket whose state is kept in a Store,
+// so that every instance using the same store and key shares one bucket. Like
+// the GCRA it only stores the theoretical arrival time of the next request,
+// updated with compare-and-swap. Instances should have synchronised clocks.
+type StoreTokenBucket struct {
+	store      Store
+	key        string
+	burst      int
+	interval   time.Duration
+	failClosed bool
+	clock      Clock
+	mutex      sync.Mutex
+}
+
+// NewStoreTokenBucket creates a new StoreTokenBucket holding capacity tokens
+// and refilling at rate tokens per second
+func NewStoreTokenBucket(store Store, key string, capacity int, rate float64, opts ...Option) *StoreTokenBucket {
+	o := newOptions(opts)
+	return &StoreTokenBucket{
+		store:      store,
+		key:        key,
+		burst:      capacity,
+		interval:   RateInterval(rate),
+		failClosed: o.failClosed,
+		clock:      o.clock,
+	}
+}
+
+// Allow checks if a request can proceed under the shared token bucket
+func (stb *StoreTokenBucket) Allow() bool {
+	return stb.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the shared token bucket
+func (stb *StoreTokenBucket) AllowN(n int) bool {
+	return stb.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the tokens left. If the
+// store fails the request is let through, or denied WithFailClosed.
+func (stb *StoreTokenBucket) Decide(n int) Decision {
+	d, err := stb.DecideContext(context.Background(), n)
+	if err != nil {
+		return storeFailure(stb.burst, stb.failClosed)
+	}
+	return d
+}
+
+// DecideContext is Decide, returning the store's error instead of failing
+// open or closed
+func (stb *StoreTokenBucket) DecideContext(ctx context.Context, n int) (Decision, error) {
+	n = max(0, n)
+
+	interval := stb.emissionInterval()
+	for range casAttempts {
+		now := stb.clock.Now()
+		old, tat, err := stb.load(ctx, now)
+		if err != nil {
+			return Decision{}, err
+		}
+		next := tat.Add(time.Duration(n) * interval)
+
+		d := Decision{Limit: stb.burst}
+		if n > stb.burst {
+			d.RetryAfter = InfDuration
+		} else if allowAt := next.Add(-time.Duration(stb.burst) * interval); allowAt.After(now) {
+			d.RetryAfter = allowAt.Sub(now)
+		} else {
+			swapped, err := stb.store.CompareAndSwap(ctx, stb.key, old, formatTAT(next), until(now, next))
+			if err != nil {
+				return Decision{}, err
+			}
+			if !swapped {
+				continue
+			}
+			tat = next
+			d.Allowed = true
+		}
+		d.Reset = until(now, tat)
+		d.Remaining = stb.burst - int((d.Reset+interval-1)/interval)
+		return d, nil
+	}
+	return Decision{}, ErrStoreContention
+}
+
+// Reserve claims a request, reporting how long until the shared bucket would admit it
+func (stb *StoreTokenBucket) Reserve() *Reservation {
+	return NewReservation(stb, stb.clock, 1)
+}
+
+// Wait blocks until the shared bucket admits a request or ctx is done
+func (stb *StoreTokenBucket) Wait(ctx context.Context) error {
+	return WaitN(ctx, stb, stb.clock, 1)
+}
+
+// Rate returns the refill rate in tokens per second
+func (stb *StoreTokenBucket) Rate() float64 {
+	return float64(time.Second) / float64(stb.emissionInterval())
+}
+
+// SetRate changes the refill rate used by this instance
+func (stb *StoreTokenBucket) SetRate(rate float64) {
+	stb.mutex.Lock()
+	defer stb.mutex.Unlock()
+	stb.interval = RateInterval(rate)
+}
+
+func (stb *StoreTokenBucket) emissionInterval() time.Duration {
+	stb.mutex.Lock()
+	defer stb.mutex.Unlock()
+	return stb.interval
+}
+
+// load returns the stored TAT as it was written, for the compare-and-swap,
+// and as a time no earlier than now
+func (stb *StoreTokenBucket) load(ctx context.Context, now time.Time) (string, time.Time, error) {
+	old, ok, err := stb.store.Get(ctx, stb.key)
+	if err != nil || !ok {
+		return "", now, err
+	}
+	nanos, err := strconv.ParseInt(old, 10, 64)
+	if err != nil {
+		return "", now, err
+	}
+	if tat := time.Unix(0, nanos); tat.After(now) {
+		return old, tat, nil
+	}
+	return old, now, nil
+}
+
+// update applies change to the stored TAT with compare-and-swap
+func (stb *StoreTokenBucket) update(ctx context.Context, now time.Time, change func(tat time.Time) time.Time) (time.Time, error) {
+	for range casAttempts {
+		old, tat, err := stb.load(ctx, now)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := change(tat)
+		swapped, err := stb.store.CompareAndSwap(ctx, stb.key, old, formatTAT(next), until(now, next))
+		if err != nil || swapped {
+			return next, err
+		}
+	}
+	return time.Time{}, ErrStoreContention
+}
+
+// ReserveN moves the stored arrival time on by n requests and returns when
+// they conform
+func (stb *StoreTokenBucket) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	if n > stb.burst {
+		return time.Time{}, false
+	}
+	interval := stb.emissionInterval()
+	tat, err := stb.update(context.Background(), now, func(tat time.Time) time.Time {
+		return tat.Add(time.Duration(n) * interval)
+	})
+	if err != nil {
+		return storeReserveFailure(stb.failClosed)
+	}
+	if allowAt := tat.Add(-time.Duration(stb.burst) * interval); allowAt.After(now) {
+		return allowAt, true
+	}
+	return now, true
+}
+
+// CancelN moves the stored arrival time back by n requests
+func (stb *StoreTokenBucket) CancelN(now, at time.Time, n int) {
+	if at.IsZero() {
+		return
+	}
+	interval := stb.emissionInterval()
+	stb.update(context.Background(), now, func(tat time.Time) time.Time {
+		return tat.Add(-time.Duration(n) * interval)
+	})
+}
+
+func formatTAT(tat time.Time) string {
+	return strconv.FormatInt(tat.UnixNano(), 10)
+}
+
+// storeWindows is the grid of fixed windows shared by the store-backed window
+// algorithms. Windows are aligned to the Unix epoch so that every instance
+// agrees on them, and each has its own counter in the store.
+type storeWindows struct {
+	store      Store
+	key        string
+	windowSize time.Duration
+}
+
+func (sw storeWindows) index(t time.Time) int64 {
+	return t.UnixNano() / int64(sw.windowSize)
+}
+
+func (sw storeWindows) start(i int64) time.Time {
+	return time.Unix(0, i*int64(sw.windowSize))
+}
+
+func (sw storeWindows) counter(i int64) string {
+	return sw.key + ":" + strconv.FormatInt(i, 10)
+}
+
+// incr adds n to window i's counter, which is kept until keep windows after
+// window i has ended
+func (sw storeWindows) incr(ctx context.Context, now time.Time, i int64, n, keep int) (int, error) {
+	ttl := sw.start(i + 1 + int64(keep)).Sub(now)
+	count, err := sw.store.Incr(ctx, sw.counter(i), int64(n), ttl)
+	return int(count), err
+}
+
+// count returns window i's counter
+func (sw storeWindows) count(ctx context.Context, i int64) (int, error) {
+	value, ok, err := sw.store.Get(ctx, sw.counter(i))
+	if err != nil || !ok {
+		return 0, err
+	}
+	count, err := strconv.Atoi(value)
+	return count, err
+}
+
+// StoreFixedWindow struct for a fixed window counter kept in a Store, shared
+// by every instance using the same store and key. A request is counted before
+// it is checked and handed back if denied, so concurrent requests near the
+// limit may be denied when one of them alone would have fit.
+type StoreFixedWindow struct {
+	windows    storeWindows
+	limit      int
+	failClosed bool
+	clock      Clock
+	mutex      sync.Mutex
+}
+
+// NewStoreFixedWindow creates a new StoreFixedWindow
+func NewStoreFixedWindow(store Store, key string, limit int, windowSize time.Duration, opts ...Option) *StoreFixedWindow {
+	o := newOptions(opts)
+	return &StoreFixedWindow{
+		windows:    storeWindows{store: store, key: key, windowSize: windowSize},
+		limit:      limit,
+		failClosed: o.failClosed,
+		clock:      o.clock,
+	}
+}
+
+// Allow checks if a request can proceed under the shared fixed window
+func (sfw *StoreFixedWindow) Allow() bool {
+	return sfw.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the shared fixed window
+func (sfw *StoreFixedWindow) AllowN(n int) bool {
+	return sfw.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the slots left in the
+// window. If the store fails the request is let through, or denied
+// WithFailClosed.
+func (sfw *StoreFixedWindow) Decide(n int) Decision {
+	d, err := sfw.DecideContext(context.Background(), n)
+	if err != nil {
+		return storeFailure(sfw.windowLimit(), sfw.failClosed)
+	}
+	return d
+}
+
+// DecideContext is Decide, returning the store's error instead of failing
+// open or closed
+func (sfw *StoreFixedWindow) DecideContext(ctx context.Context, n int) (Decision, error) {
+	n = max(0, n)
+
+	limit := sfw.windowLimit()
+	now := sfw.clock.Now()
+	i := sfw.windows.index(now)
+
+	count, err := sfw.windows.incr(ctx, now, i, n, 0)
+	if err != nil {
+		return Decision{}, err
+	}
+	d := Decision{Limit: limit, Reset: until(now, sfw.windows.start(i+1))}
+	if count <= limit {
+		d.Allowed = true
+	} else {
+		if count, err = sfw.windows.incr(ctx, now, i, -n, 0); err != nil {
+			return Decision{}, err
+		}
+		if n > limit {
+			d.RetryAfter = InfDuration
+		} else {
+			d.RetryAfter = d.Reset
+		}
+	}
+	d.Remaining = max(0, limit-count)
+	return d, nil
+}
+
+// Reserve claims a request, reporting how long until a window has room for it
+func (sfw *StoreFixedWindow) Reserve() *Reservation {
+	return NewReservation(sfw, sfw.clock, 1)
+}
+
+// Wait blocks until a window has room for a request or ctx is done
+func (sfw *StoreFixedWindow) Wait(ctx context.Context) error {
+	return WaitN(ctx, sfw, sfw.clock, 1)
+}
+
+// Rate returns the limit spread over the window, in requests per second
+func (sfw *StoreFixedWindow) Rate() float64 {
+	return float64(sfw.windowLimit()) / sfw.windows.windowSize.Seconds()
+}
+
+// SetRate changes the limit this instance applies to rate requests per second
+// over the window, allowing at least one request per window
+func (sfw *StoreFixedWindow) SetRate(rate float64) {
+	sfw.mutex.Lock()
+	defer sfw.mutex.Unlock()
+	sfw.limit = windowLimit(rate, sfw.windows.windowSize)
+}
+
+func (sfw *StoreFixedWindow) windowLimit() int {
+	sfw.mutex.Lock()
+	defer sfw.mutex.Unlock()
+	return sfw.limit
+}
+
+// ReserveN counts n requests in the store against the first window from
+// now with room for them, and returns when it starts
+func (sfw *StoreFixedWindow) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	limit := sfw.windowLimit()
+	if n > limit {
+		return time.Time{}, false
+	}
+	ctx := context.Background()
+	for i := sfw.windows.index(now); ; i++ {
+		count, err := sfw.windows.incr(ctx, now, i, n, 0)
+		if err != nil {
+			return storeReserveFailure(sfw.failClosed)
+		}
+		if count <= limit {
+			if start := sfw.windows.start(i); start.After(now) {
+				return start, true
+			}
+			return now, true
+		}
+		sfw.windows.incr(ctx, now, i, -n, 0)
+	}
+}
+
+// CancelN takes n requests off the stored count of the window at falls in
+func (sfw *StoreFixedWindow) CancelN(now, at time.Time, n int) {
+	if at.IsZero() {
+		return
+	}
+	sfw.windows.incr(context.Background(), now, sfw.windows.index(at), -n, 0)
+}
+
+// StoreSlidingWindowCounter struct for the approximate sliding window kept in
+// a Store, shared by every instance using the same store and key. As with
+// StoreFixedWindow, a request is counted before it is checked and handed
+// back if denied.
+type StoreSlidingWindowCounter struct {
+	windows    storeWindows
+	limit      int
+	failClosed bool
+	clock      Clock
+	mutex      sync.Mutex
+}
+
+// NewStoreSlidingWindowCounter creates a new StoreSlidingWindowCounter
+func NewStoreSlidingWindowCounter(store Store, key string, limit int, windowSize time.Duration, opts ...Option) *StoreSlidingWindowCounter {
+	o := newOptions(opts)
+	return &StoreSlidingWindowCounter{
+		windows:    storeWindows{store: store, key: key, windowSize: windowSize},
+		limit:      limit,
+		failClosed: o.failClosed,
+		clock:      o.clock,
+	}
+}
+
+// Allow checks if a request can proceed under the shared sliding window counter
+func (sswc *StoreSlidingWindowCounter) Allow() bool {
+	return sswc.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the shared sliding window counter
+func (sswc *StoreSlidingWindowCounter) AllowN(n int) bool {
+	return sswc.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the estimated slots
+// left. If the store fails the request is let through, or denied
+// WithFailClosed.
+func (sswc *StoreSlidingWindowCounter) Decide(n int) Decision {
+	d, err := sswc.DecideContext(context.Background(), n)
+	if err != nil {
+		return storeFailure(sswc.windowLimit(), sswc.failClosed)
+	}
+	return d
+}
+
+// DecideContext is Decide, returning the store's error instead of failing
+// open or closed
+func (sswc *StoreSlidingWindowCounter) DecideContext(ctx context.Context, n int) (Decision, error) {
+	n = max(0, n)
+
+	limit := sswc.windowLimit()
+	now := sswc.clock.Now()
+	i := sswc.windows.index(now)
+
+	count, err := sswc.windows.incr(ctx, now, i, n, 1)
+	if err != nil {
+		return Decision{}, err
+	}
+	prev, err := sswc.windows.count(ctx, i-1)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	d := Decision{Limit: limit}
+	if sswc.estimate(now, i, prev, count) <= float64(limit) {
+		d.Allowed = true
+	} else {
+		if count, err = sswc.windows.incr(ctx, now, i, -n, 1); err != nil {
+			return Decision{}, err
+		}
+		if n > limit {
+			d.RetryAfter = InfDuration
+		} else if d.RetryAfter, err = sswc.retryAfter(ctx, now, i, prev, count, n); err != nil {
+			return Decision{}, err
+		}
+	}
+	d.Remaining = max(0, limit-int(math.Ceil(sswc.estimate(now, i, prev, count))))
+
+	// The current count stops weighing on the window once the next one ends
+	switch {
+	case count > 0:
+		d.Reset = until(now, sswc.windows.start(i+2))
+	case prev > 0:
+		d.Reset = until(now, sswc.windows.start(i+1))
+	}
+	return d, nil
+}
+
+// Reserve claims a request, reporting how long until the estimate makes room for it
+func (sswc *StoreSlidingWindowCounter) Reserve() *Reservation {
+	return NewReservation(sswc, sswc.clock, 1)
+}
+
+// Wait blocks until the estimate makes room for a request or ctx is done
+func (sswc *StoreSlidingWindowCounter) Wait(ctx context.Context) error {
+	return WaitN(ctx, sswc, sswc.clock, 1)
+}
+
+// Rate returns the limit spread over the window, in requests per second
+func (sswc *StoreSlidingWindowCounter) Rate() float64 {
+	return float64(sswc.windowLimit()) / sswc.windows.windowSize.Seconds()
+}
+
+// SetRate changes the limit this instance applies to rate requests per second
+// over the window, allowing at least one request per window
+func (sswc *StoreSlidingWindowCounter) SetRate(rate float64) {
+	sswc.mutex.Lock()
+	defer sswc.mutex.Unlock()
+	sswc.limit = windowLimit(rate, sswc.windows.windowSize)
+}
+
+func (sswc *StoreSlidingWindowCounter) windowLimit() int {
+	sswc.mutex.Lock()
+	defer sswc.mutex.Unlock()
+	return sswc.limit
+}
+
+// estimate returns the weighted number of requests in the window ending at
+// now, which falls in window i
+func (sswc *StoreSlidingWindowCounter) estimate(now time.Time, i int64, prev, count int) float64 {
+	elapsed := float64(now.Sub(sswc.windows.start(i))) / float64(sswc.windows.windowSize)
+	return float64(prev)*(1-elapsed) + float64(count)
+}
+
+// retryAfter returns how long until n more requests fit, looking at the
+// current window and the next, which may hold reservations
+func (sswc *StoreSlidingWindowCounter) retryAfter(ctx context.Context, now time.Time, i int64, prev, count, n int) (time.Duration, error) {
+	limit, size := sswc.windowLimit(), sswc.windows.windowSize
+	if at, ok := slideAt(sswc.windows.start(i), size, limit, prev, count, n); ok {
+		return until(now, at), nil
+	}
+	next, err := sswc.windows.count(ctx, i+1)
+	if err != nil {
+		return 0, err
+	}
+	if at, ok := slideAt(sswc.windows.start(i+1), size, limit, count, next, n); ok {
+		return until(now, at), nil
+	}
+	return until(now, sswc.windows.start(i+2)), nil
+}
+
+// ReserveN counts n requests in the store against the first window from
+// now whose estimate has room for them, and returns when they fit
+func (sswc *StoreSlidingWindowCounter) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	limit := sswc.windowLimit()
+	if n > limit {
+		return time.Time{}, false
+	}
+	ctx := context.Background()
+	for i := sswc.windows.index(now); ; i++ {
+		count, err := sswc.windows.incr(ctx, now, i, n, 1)
+		if err != nil {
+			return storeReserveFailure(sswc.failClosed)
+		}
+		prev, err := sswc.windows.count(ctx, i-1)
+		if err != nil {
+			sswc.windows.incr(ctx, now, i, -n, 1)
+			return storeReserveFailure(sswc.failClosed)
+		}
+		// count already includes the n being reserved
+		if at, ok := slideAt(sswc.windows.start(i), sswc.windows.windowSize, limit, prev, count-n, n); ok {
+			if at.Before(now) {
+				at = now
+			}
+			return at, true
+		}
+		sswc.windows.incr(ctx, now, i, -n, 1)
+	}
+}
+
+// CancelN takes n requests off the stored count of the window at falls in
+func (sswc *StoreSlidingWindowCounter) CancelN(now, at time.Time, n int) {
+	if at.IsZero() {
+		return
+	}
+	sswc.windows.incr(context.Background(), now, sswc.windows.index(at), -n, 1)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// GCRA struct for the generic cell rate algorithm. It admits the same traffic
+// as a token bucket but only stores the theoretical arrival time (TAT) of the
+// next request, which is when the bucket would next be full.
+type GCRA struct {
+	burst            int
+	emissionInterval time.Duration
+	tat              time.Time
+	clock            Clock
+	mutex            sync.Mutex
+}
+
+// NewGCRA creates a new GCRA that allows burst requests at once and one
+// request per emissionInterval after that
+func NewGCRA(burst int, emissionInterval time.Duration, opts ...Option) *GCRA {
+	o := newOptions(opts)
+	return &GCRA{
+		burst:            burst,
+		emissionInterval: emissionInterval,
+		tat:              o.clock.Now(),
+		clock:            o.clock,
+	}
+}
+
+// Allow checks if a request can proceed under the GCRA
+func (g *GCRA) Allow() bool {
+	return g.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the GCRA
+func (g *GCRA) AllowN(n int) bool {
+	return g.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the burst left
+func (g *GCRA) Decide(n int) Decision {
+	n = max(0, n)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	now := g.clock.Now()
+	tat, allowAt := g.next(now, n)
+
+	d := Decision{Limit: g.burst}
+	if n > g.burst {
+		d.RetryAfter = InfDuration
+	} else if allowAt.After(now) {
+		d.RetryAfter = allowAt.Sub(now)
+	} else {
+		g.tat = tat
+		d.Allowed = true
+	}
+	d.Reset = until(now, g.tat)
+	d.Remaining = g.burst - int((d.Reset+g.emissionInterval-1)/g.emissionInterval)
+	return d
+}
+
+// Reserve claims a request, reporting how long until the GCRA would admit it
+func (g *GCRA) Reserve() *Reservation {
+	return NewReservation(g, g.clock, 1)
+}
+
+// Wait blocks until the GCRA admits a request or ctx is done
+func (g *GCRA) Wait(ctx context.Context) error {
+	return WaitN(ctx, g, g.clock, 1)
+}
+
+// Rate returns the sustained requests per second
+func (g *GCRA) Rate() float64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return float64(time.Second) / float64(g.emissionInterval)
+}
+
+// SetRate changes the sustained requests per second from now on
+func (g *GCRA) SetRate(rate float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.emissionInterval = RateInterval(rate)
+}
+
+// next returns the TAT after admitting n requests at now, and the earliest
+// time at which they conform
+func (g *GCRA) next(now time.Time, n int) (tat, allowAt time.Time) {
+	tat = g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	tat = tat.Add(time.Duration(n) * g.emissionInterval)
+	return tat, tat.Add(-time.Duration(g.burst) * g.emissionInterval)
+}
+
+// ReserveN moves the theoretical arrival time on by n requests and returns
+// when they conform
+func (g *GCRA) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if n > g.burst {
+		return time.Time{}, false
+	}
+	tat, allowAt := g.next(now, n)
+	g.tat = tat
+	if allowAt.Before(now) {
+		return now, true
+	}
+	return allowAt, true
+}
+
+// CancelN moves the theoretical arrival time back by n requests
+func (g *GCRA) CancelN(now, at time.Time, n int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.tat = g.tat.Add(-time.Duration(n) * g.emissionInterval)
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// GossipHeader carries the shared secret between gossiping nodes
+const GossipHeader = "X-Limitly-Gossip-Secret"
+
+// GossipConfig holds the parameters of a Gossip
+type GossipConfig struct {
+	// NodeID names this node in the messages it sends
+	NodeID string
+	// Peers are the URLs of the other nodes' gossip handlers
+	Peers []string
+	// Interval is how often local consumption is sent to the peers
+	Interval time.Duration
+	// Timeout bounds each exchange with a peer
+	Timeout time.Duration
+	// Secret, if set, must be sent by peers in GossipHeader
+	Secret string
+	// MaxKeys caps the keys a peer may send deltas for in one message
+	MaxKeys int
+}
+
+// DefaultGossipConfig returns a GossipConfig that syncs every 100ms, giving up
+// on a peer after 50ms, and accepts deltas for up to 10000 keys a message
+func DefaultGossipConfig() GossipConfig {
+	return GossipConfig{
+		Interval: 100 * time.Millisecond,
+		Timeout:  50 * time.Millisecond,
+		MaxKeys:  10000,
+	}
+}
+
+// gossipMaxBody bounds the size of a message a peer may post
+const gossipMaxBody = 1 << 20
+
+// PeerStats describes the exchanges with one peer
+type PeerStats struct {
+	Peer string `json:"peer"`
+	// Failures counts the exchanges that failed since the last success
+	Failures int       `json:"failures"`
+	LastSync time.Time `json:"last_sync"`
+	Sent     int64     `json:"sent"`
+}
+
+// gossipMessage is the body a node posts to its peers
+type gossipMessage struct {
+	From   string         `json:"from"`
+	Deltas map[string]int `json:"deltas"`
+}
+
+// Gossip approximately enforces a limit across several nodes without a
+// shared store. Each node limits keys with its own KeyedLimiter configured
+// with the global limit, and every interval tells its peers how many
+// requests it admitted per key since the last round. Peers charge those
+// requests to their own limiters for the keys, so each node sees roughly the
+// consumption of the whole cluster, lagging by up to an interval.
+//
+// A peer that can't be reached misses the deltas of that round rather than
+// receiving them late, since requests it never saw in time would only
+// penalise clients after the fact. Nodes only forward their own admissions,
+// so peers must be fully meshed.
+type Gossip struct {
+	keyed   *KeyedLimiter
+	config  GossipConfig
+	client  *http.Client
+	pending map[string]int
+	peers   map[string]*PeerStats
+	clock   Clock
+	mutex   sync.Mutex
+}
+
+// NewGossip creates a new Gossip sharing the consumption of keyed's keys
+func NewGossip(keyed *KeyedLimiter, config GossipConfig, opts ...Option) *Gossip {
+	o := newOptions(opts)
+	g := &Gossip{
+		keyed:   keyed,
+		config:  config,
+		client:  &http.Client{Timeout: config.Timeout},
+		pending: make(map[string]int),
+		peers:   make(map[string]*PeerStats),
+		clock:   o.clock,
+	}
+	for _, peer := range config.Peers {
+		g.peers[peer] = &PeerStats{Peer: peer}
+	}
+	return g
+}
+
+// Decide checks if n requests for key can proceed, n being capped at the
+// key's limit, and records them for the peers if they are admitted
+func (g *Gossip) Decide(key string, n int) (Decision, error) {
+	limiter, err := g.keyed.Limiter(key)
+	if err != nil {
+		return Decision{}, err
+	}
+	n = CapCost(limiter, n)
+	d := limiter.Decide(n)
+	if d.Allowed {
+		g.mutex.Lock()
+		g.pending[key] += n
+		g.mutex.Unlock()
+	}
+	return d, nil
+}
+
+// Handler returns the handler peers post their deltas to
+func (g *Gossip) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if g.config.Secret != "" &&
+			subtle.ConstantTimeCompare([]byte(r.Header.Get(GossipHeader)), []byte(g.config.Secret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var msg gossipMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, gossipMaxBody)).Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if g.config.MaxKeys > 0 && len(msg.Deltas) > g.config.MaxKeys {
+			http.Error(w, "too many keys", http.StatusRequestEntityTooLarge)
+			return
+		}
+		g.apply(msg.Deltas)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// apply charges requests admitted by a peer to the local limiters. They are
+// reserved rather than allowed, so they count even past the limit and leave
+// the key in debt. A peer can't have admitted more than a limiter's capacity
+// in one interval, so larger deltas are clamped to it rather than leaving a
+// key in debt for longer than the limit allows.
+func (g *Gossip) apply(deltas map[string]int) {
+	now := g.clock.Now()
+	for key, n := range deltas {
+		if n <= 0 {
+			continue
+		}
+		limiter, err := g.keyed.Limiter(key)
+		if err != nil {
+			continue
+		}
+		lim, ok := limiter.(Reserver)
+		if !ok {
+			continue
+		}
+		n = CapCost(limiter, n)
+		lim.ReserveN(now, n)
+	}
+}
+
+// Sync sends the consumption recorded since the last round to every peer at
+// once and waits for them to answer or time out
+func (g *Gossip) Sync(ctx context.Context) {
+	g.mutex.Lock()
+	deltas := g.pending
+	g.pending = make(map[string]int)
+	g.mutex.Unlock()
+	if len(deltas) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(gossipMessage{From: g.config.NodeID, Deltas: deltas})
+	if err != nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range g.config.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			err := g.send(ctx, peer, body)
+
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			stats := g.peers[peer]
+			if err != nil {
+				stats.Failures++
+				return
+			}
+			stats.Failures = 0
+			stats.LastSync = g.clock.Now()
+			stats.Sent++
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (g *Gossip) send(ctx context.Context, peer string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.config.Secret != "" {
+		req.Header.Set(GossipHeader, g.config.Secret)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("rate: peer %s answered %s", peer, resp.Status)
+	}
+	return nil
+}
+
+// Run syncs with the peers every interval until ctx is done
+func (g *Gossip) Run(ctx context.Context) {
+	for {
+		timer := g.clock.NewTimer(g.config.Interval)
+		select {
+		case <-timer.C():
+			g.Sync(ctx)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Peers returns the state of the exchanges with each peer
+func (g *Gossip) Peers() []PeerStats {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	stats := make([]PeerStats, 0, len(g.config.Peers))
+	for _, peer := range g.config.Peers {
+		stats = append(stats, *g.peers[peer])
+	}
+	return stats
+}
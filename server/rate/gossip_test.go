@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type gossipNode struct {
+	gossip *Gossip
+	server *httptest.Server
+}
+
+// newGossipCluster starts size nodes that each allow limit requests a minute
+// per key and gossip with all the others
+func newGossipCluster(t *testing.T, size, limit int, secret string) []*gossipNode {
+	clock := NewFakeClock(epoch)
+	nodes := make([]*gossipNode, size)
+	mux := make([]*http.ServeMux, size)
+	for i := range nodes {
+		mux[i] = http.NewServeMux()
+		nodes[i] = &gossipNode{server: httptest.NewServer(mux[i])}
+		t.Cleanup(nodes[i].server.Close)
+	}
+	for i, node := range nodes {
+		config := DefaultGossipConfig()
+		config.NodeID = string(rune('a' + i))
+		config.Secret = secret
+		for j, peer := range nodes {
+			if j != i {
+				config.Peers = append(config.Peers, peer.server.URL+"/gossip")
+			}
+		}
+		keyed := NewKeyedLimiter(ClientIP, func(string) RateLimiter {
+			return NewFixedWindow(limit, time.Minute, WithClock(clock))
+		}, DefaultKeyedConfig(), WithClock(clock))
+		node.gossip = NewGossip(keyed, config, WithClock(clock))
+		mux[i].Handle("/gossip", node.gossip.Handler())
+	}
+	return nodes
+}
+
+func admitted(node *gossipNode, key string, attempts int) int {
+	n := 0
+	for range attempts {
+		if d, err := node.gossip.Decide(key, 1); err == nil && d.Allowed {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGossipSharesConsumption(t *testing.T) {
+	nodes := newGossipCluster(t, 3, 6, "")
+
+	// Each node admits two requests for the key on its own
+	for _, node := range nodes {
+		if n := admitted(node, "client", 2); n != 2 {
+			t.Fatalf("node admitted %d of 2 requests", n)
+		}
+	}
+	for _, node := range nodes {
+		node.gossip.Sync(context.Background())
+	}
+
+	// Every node has now seen the cluster use the whole limit of 6
+	for i, node := range nodes {
+		if n := admitted(node, "client", 1); n != 0 {
+			t.Fatalf("node %d admitted a request past the global limit", i)
+		}
+	}
+	if n := admitted(nodes[0], "other", 6); n != 6 {
+		t.Fatalf("a different key got %d of its own 6 requests", n)
+	}
+}
+
+func TestGossipToleratesPeerLoss(t *testing.T) {
+	nodes := newGossipCluster(t, 3, 6, "")
+	nodes[2].server.Close()
+
+	admitted(nodes[0], "client", 3)
+	nodes[0].gossip.Sync(context.Background())
+
+	if n := admitted(nodes[1], "client", 6); n != 3 {
+		t.Fatalf("surviving peer admitted %d, want the 3 left of the global limit", n)
+	}
+	for _, stats := range nodes[0].gossip.Peers() {
+		lost := strings.HasPrefix(stats.Peer, nodes[2].server.URL)
+		if lost && (stats.Failures != 1 || stats.Sent != 0) {
+			t.Fatalf("lost peer stats %+v, want one failure", stats)
+		}
+		if !lost && (stats.Failures != 0 || stats.Sent != 1) {
+			t.Fatalf("live peer stats %+v, want one message sent", stats)
+		}
+	}
+}
+
+func TestGossipRequiresSecret(t *testing.T) {
+	nodes := newGossipCluster(t, 2, 6, "s3cret")
+
+	resp, err := http.Post(nodes[1].server.URL+"/gossip", "application/json",
+		strings.NewReader(`{"from":"intruder","deltas":{"client":100}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got status %d without the secret, want 403", resp.StatusCode)
+	}
+
+	admitted(nodes[0], "client", 6)
+	nodes[0].gossip.Sync(context.Background())
+	if n := admitted(nodes[1], "client", 1); n != 0 {
+		t.Fatal("deltas sent with the secret were not applied")
+	}
+}
+
+func TestGossipClampsDeltas(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	keyed := NewKeyedLimiter(ClientIP, func(string) RateLimiter {
+		return NewSlidingWindow(10, time.Second, WithClock(clock))
+	}, DefaultKeyedConfig(), WithClock(clock))
+	config := DefaultGossipConfig()
+	config.MaxKeys = 2
+	handler := NewGossip(keyed, config, WithClock(clock)).Handler()
+	post := func(body string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/gossip", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	// A delta past the limit charges no more than the limit
+	if code := post(`{"from":"b","deltas":{"client":200000}}`); code != http.StatusNoContent {
+		t.Fatalf("got status %d, want 204", code)
+	}
+	limiter, _ := keyed.Limiter("client")
+	if d := limiter.Decide(1); d.Allowed || d.RetryAfter > time.Second {
+		t.Fatalf("got %+v, want denied for at most the window", d)
+	}
+
+	if code := post(`{"from":"b","deltas":{"a":1,"b":1,"c":1}}`); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got status %d for too many keys, want 413", code)
+	}
+	if stats := keyed.Stats(); stats.Keys != 1 {
+		t.Fatalf("%d keys tracked, want the oversized message ignored", stats.Keys)
+	}
+}
+
+func TestGossipRunSyncsEachInterval(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	received := make(chan struct{}, 1)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		received <- struct{}{}
+	}))
+	defer peer.Close()
+
+	keyed := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return &NoRateLimiter{} }, DefaultKeyedConfig())
+	config := DefaultGossipConfig()
+	config.Peers = []string{peer.URL}
+	g := NewGossip(keyed, config, WithClock(clock))
+	g.Decide("client", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.Run(ctx)
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(config.Interval)
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not sync after an interval")
+	}
+}
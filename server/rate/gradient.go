@@ -0,0 +1,160 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// GradientConfig holds the parameters of a GradientLimiter
+type GradientConfig struct {
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// QueueSize is the number of requests allowed to wait for a slot
+	QueueSize int
+	// QueueTimeout is the longest a request waits for a slot, or as long as
+	// its context allows if zero
+	QueueTimeout time.Duration
+	// Smoothing is the weight given to each new limit estimate, in (0, 1]
+	Smoothing float64
+	// Tolerance is how much the RTT may exceed the no-load RTT before the
+	// limit starts to shrink
+	Tolerance float64
+	// Backoff multiplies the limit when a request fails
+	Backoff float64
+	// RTTSmoothing is the weight given to each RTT sample in the moving average
+	RTTSmoothing float64
+	// NoLoadWindow is how many samples the no-load RTT is the lowest of. It
+	// is taken over the current and previous windows, so that one unusually
+	// fast sample is forgotten and a lasting change in the backend's latency
+	// is followed. Zero keeps the lowest RTT ever seen.
+	NoLoadWindow int
+}
+
+// DefaultGradientConfig returns the GradientConfig used by the gradient algorithm
+func DefaultGradientConfig() GradientConfig {
+	return GradientConfig{
+		InitialLimit: 4,
+		MinLimit:     1,
+		MaxLimit:     1000,
+		Smoothing:    0.2,
+		Tolerance:    1.5,
+		Backoff:      0.9,
+		RTTSmoothing: 0.1,
+		NoLoadWindow: 10000,
+	}
+}
+
+// GradientStats is a snapshot of a GradientLimiter's estimates
+type GradientStats struct {
+	Limit     int           `json:"limit"`
+	InFlight  int           `json:"in_flight"`
+	RTTNoLoad time.Duration `json:"rtt_no_load"`
+	RTTActual time.Duration `json:"rtt_actual"`
+}
+
+// GradientLimiter is a concurrency limiter that sizes its limit from the
+// gradient between the backend's no-load RTT and its current RTT, in the
+// style of Netflix's concurrency-limits. While latency stays near the no-load
+// RTT the limit grows by roughly its square root; as requests start to queue
+// in the backend and latency rises, the limit shrinks in proportion.
+type GradientLimiter struct {
+	*ConcurrencyLimiter
+	config    GradientConfig
+	limit     float64
+	rttNoLoad time.Duration
+	// windowMin and prevMin are the lowest RTTs of the current and previous
+	// NoLoadWindow samples, of which rttNoLoad is the lower
+	windowMin     time.Duration
+	prevMin       time.Duration
+	windowSamples int
+	rttActual     float64
+	mutex         sync.Mutex
+}
+
+// NewGradientLimiter creates a new GradientLimiter
+func NewGradientLimiter(config GradientConfig) *GradientLimiter {
+	return &GradientLimiter{
+		ConcurrencyLimiter: NewConcurrencyLimiter(config.InitialLimit, config.QueueSize, config.QueueTimeout),
+		config:             config,
+		limit:              float64(config.InitialLimit),
+	}
+}
+
+// Observe records the RTT of a request that held a slot and resizes the limit
+func (g *GradientLimiter) Observe(rtt time.Duration, failed bool) {
+	if rtt <= 0 {
+		return
+	}
+	inFlight := g.InFlight()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.observeNoLoad(rtt)
+	if g.rttActual == 0 {
+		g.rttActual = float64(rtt)
+	} else {
+		g.rttActual += g.config.RTTSmoothing * (float64(rtt) - g.rttActual)
+	}
+
+	var newLimit float64
+	if failed {
+		newLimit = g.limit * g.config.Backoff
+	} else {
+		gradient := math.Max(0.5, math.Min(1, g.config.Tolerance*float64(g.rttNoLoad)/g.rttActual))
+		newLimit = g.limit*gradient + math.Sqrt(g.limit)
+	}
+
+	// Don't grow on the strength of a backend that isn't being pushed
+	if newLimit > g.limit && float64(inFlight) < g.limit/2 {
+		return
+	}
+
+	g.limit = (1-g.config.Smoothing)*g.limit + g.config.Smoothing*newLimit
+	g.limit = math.Max(float64(g.config.MinLimit), math.Min(float64(g.config.MaxLimit), g.limit))
+	g.SetLimit(int(g.limit))
+}
+
+// observeNoLoad folds rtt into the lowest RTT of the current window, starting
+// a new window every NoLoadWindow samples
+func (g *GradientLimiter) observeNoLoad(rtt time.Duration) {
+	if g.windowMin == 0 || rtt < g.windowMin {
+		g.windowMin = rtt
+	}
+	g.windowSamples++
+	if g.config.NoLoadWindow > 0 && g.windowSamples >= g.config.NoLoadWindow {
+		g.prevMin, g.windowMin, g.windowSamples = g.windowMin, 0, 0
+	}
+
+	g.rttNoLoad = g.windowMin
+	if g.rttNoLoad == 0 || (g.prevMin > 0 && g.prevMin < g.rttNoLoad) {
+		g.rttNoLoad = g.prevMin
+	}
+}
+
+// RTTNoLoad returns the lowest RTT observed recently, taken as the backend's RTT
+// when nothing is queued
+func (g *GradientLimiter) RTTNoLoad() time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.rttNoLoad
+}
+
+// RTTActual returns the moving average of recent RTTs
+func (g *GradientLimiter) RTTActual() time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return time.Duration(g.rttActual)
+}
+
+// Stats returns the current limit and RTT estimates
+func (g *GradientLimiter) Stats() GradientStats {
+	return GradientStats{
+		Limit:     g.Limit(),
+		InFlight:  g.InFlight(),
+		RTTNoLoad: g.RTTNoLoad(),
+		RTTActual: g.RTTActual(),
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeBackend answers in base time until more than capacity requests are in
+// flight, after which requests queue and latency grows with concurrency
+type fakeBackend struct {
+	base     time.Duration
+	capacity int
+}
+
+func (fb fakeBackend) latency(inFlight int) time.Duration {
+	if inFlight <= fb.capacity {
+		return fb.base
+	}
+	return fb.base * time.Duration(inFlight) / time.Duration(fb.capacity)
+}
+
+func TestGradientLimiterConvergesOnBackendCapacity(t *testing.T) {
+	backend := fakeBackend{base: 10 * ms, capacity: 8}
+	g := NewGradientLimiter(DefaultGradientConfig())
+
+	// Keep every slot busy and complete them together, round after round
+	for round := 0; round < 300; round++ {
+		var releases []func()
+		for {
+			release, ok := g.TryAcquire()
+			if !ok {
+				break
+			}
+			releases = append(releases, release)
+		}
+		rtt := backend.latency(len(releases))
+		for _, release := range releases {
+			g.Observe(rtt, false)
+			release()
+		}
+	}
+
+	stats := g.Stats()
+	if stats.Limit < backend.capacity || stats.Limit > 2*backend.capacity {
+		t.Fatalf("limit settled at %d, want close to the backend's capacity of %d", stats.Limit, backend.capacity)
+	}
+	if stats.RTTNoLoad != backend.base {
+		t.Fatalf("no-load RTT %v, want %v", stats.RTTNoLoad, backend.base)
+	}
+	if stats.RTTActual < backend.base {
+		t.Fatalf("actual RTT %v below no-load RTT", stats.RTTActual)
+	}
+}
+
+func TestGradientLimiterForgetsOldNoLoadRTT(t *testing.T) {
+	config := DefaultGradientConfig()
+	config.NoLoadWindow = 10
+	g := NewGradientLimiter(config)
+
+	// One unusually fast sample only counts for this window and the next
+	g.Observe(1*ms, false)
+	for i := 0; i < 19; i++ {
+		g.Observe(10*ms, false)
+	}
+	if got := g.RTTNoLoad(); got != 10*ms {
+		t.Fatalf("no-load RTT %v two windows after an outlier, want 10ms", got)
+	}
+
+	// A lasting rise in the backend's latency becomes its no-load RTT
+	for i := 0; i < 20; i++ {
+		g.Observe(30*ms, false)
+	}
+	if got := g.RTTNoLoad(); got != 30*ms {
+		t.Fatalf("no-load RTT %v after the backend slowed, want 30ms", got)
+	}
+}
+
+func TestGradientLimiterBacksOffOnFailure(t *testing.T) {
+	config := DefaultGradientConfig()
+	config.InitialLimit = 100
+	g := NewGradientLimiter(config)
+
+	var releases []func()
+	for i := 0; i < 100; i++ {
+		release, _ := g.TryAcquire()
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		g.Observe(10*ms, true)
+		release()
+	}
+	if g.Limit() >= 50 {
+		t.Fatalf("limit still %d after 100 failures", g.Limit())
+	}
+}
+
+func TestGradientLimiterDoesNotGrowWhenIdle(t *testing.T) {
+	g := NewGradientLimiter(DefaultGradientConfig())
+	for i := 0; i < 100; i++ {
+		release, _ := g.TryAcquire()
+		g.Observe(10*ms, false)
+		release()
+	}
+	if g.Limit() != DefaultGradientConfig().InitialLimit {
+		t.Fatalf("limit grew to %d with a single request in flight", g.Limit())
+	}
+}
+
+func TestGradientAlgorithmUsesQueueTimeout(t *testing.T) {
+	algorithm, _ := LookupAlgorithm("gradient")
+	g := algorithm.NewInFlight(LimiterConfig{Burst: 1, QueueSize: 1, QueueTimeout: 10 * ms})
+	release, _ := g.Acquire(context.Background())
+	defer release()
+
+	if _, err := g.Acquire(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("queued Acquire got %v, want a timeout", err)
+	}
+}
+
+func TestProxyHandlerFeedsGradientLimiter(t *testing.T) {
+	var inFlight int32
+	backendModel := fakeBackend{base: 2 * ms, capacity: 4}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		time.Sleep(backendModel.latency(int(n)))
+	}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("gradient", 0, 4)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+	g := loadConfig().concurrencyLimiter.(*GradientLimiter)
+
+	var wg sync.WaitGroup
+	for c := 0; c < 16; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				ProxyHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := g.Stats()
+	if stats.RTTNoLoad < backendModel.base || stats.RTTActual == 0 {
+		t.Fatalf("RTT estimates not fed from the proxy: %+v", stats)
+	}
+	if stats.InFlight != 0 {
+		t.Fatalf("%d slots still held after all requests finished", stats.InFlight)
+	}
+}
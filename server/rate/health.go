@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheckConfig holds the parameters of a pool's active health checks
+type HealthCheckConfig struct {
+	// Path is requested from every backend to check it; empty turns health
+	// checks off. A 2xx or 3xx answer is healthy.
+	Path string `json:"path"`
+	// Interval is how often each backend is checked
+	Interval time.Duration `json:"-"`
+	// Timeout is how long a check may take before it counts as failed
+	Timeout time.Duration `json:"-"`
+	// HealthyThreshold is how many checks in a row must pass before an
+	// unhealthy backend rejoins the pool
+	HealthyThreshold int `json:"healthy_threshold"`
+	// UnhealthyThreshold is how many checks in a row must fail before a
+	// backend is taken out of the pool
+	UnhealthyThreshold int `json:"unhealthy_threshold"`
+}
+
+// DefaultHealthCheckConfig returns a HealthCheckConfig that checks every 10
+// seconds once given a Path, allowing 2 seconds per check, and takes a
+// backend out after 3 failures and back after 2 passes
+func DefaultHealthCheckConfig() HealthCheckConfig {
+	return HealthCheckConfig{
+		Interval:           10 * time.Second,
+		Timeout:            2 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+// Check probes every backend once, taking backends out of rotation or back
+// into it once they pass the thresholds. It does nothing if health checks
+// are off.
+func (p *Pool) Check(ctx context.Context) {
+	config := p.config.HealthCheck
+	if config.Path == "" {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, backend := range p.backends {
+		wg.Add(1)
+		go func(backend *Backend) {
+			defer wg.Done()
+			err := p.probe(ctx, backend)
+
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			backend.lastCheck = p.clock.Now()
+			if err != nil {
+				backend.lastError = err.Error()
+				backend.checksPassed = 0
+				backend.checksFailed++
+				if backend.checksFailed >= config.UnhealthyThreshold {
+					backend.unhealthy = true
+				}
+				return
+			}
+			backend.lastError = ""
+			backend.checksFailed = 0
+			backend.checksPassed++
+			if backend.checksPassed >= config.HealthyThreshold {
+				backend.unhealthy = false
+			}
+		}(backend)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(ctx context.Context, backend *Backend) error {
+	ctx, cancel := context.WithTimeout(ctx, p.config.HealthCheck.Timeout)
+	defer cancel()
+
+	target := backend.URL.JoinPath(p.config.HealthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("rate: health check answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Run checks the backends every interval until ctx is done. It returns
+// straight away if health checks are off.
+func (p *Pool) Run(ctx context.Context) {
+	if p.config.HealthCheck.Path == "" {
+		return
+	}
+	for {
+		timer := p.clock.NewTimer(p.config.HealthCheck.Interval)
+		select {
+		case <-timer.C():
+			p.Check(ctx)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// StatusHandler returns a handler that reports the state of every backend
+// as JSON
+func (p *Pool) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Backends []BackendStats `json:"backends"`
+		}{p.Backends()})
+	})
+}
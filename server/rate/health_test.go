@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flippingBackend is a backend whose health check can be made to fail
+type flippingBackend struct {
+	*httptest.Server
+	failing atomic.Bool
+	checks  atomic.Int64
+}
+
+func newFlippingBackend(t *testing.T, name string) *flippingBackend {
+	fb := &flippingBackend{}
+	fb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.Header().Set("X-Backend", name)
+			return
+		}
+		fb.checks.Add(1)
+		if fb.failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(fb.Close)
+	return fb
+}
+
+func newCheckedPool(t *testing.T, clock Clock, backends ...*flippingBackend) *Pool {
+	config := DefaultPoolConfig()
+	config.HealthCheck.Path = "/healthz"
+	config.HealthCheck.UnhealthyThreshold = 2
+	config.HealthCheck.HealthyThreshold = 2
+	for _, backend := range backends {
+		config.Backends = append(config.Backends, BackendConfig{URL: backend.URL})
+	}
+	pool, err := NewPool(config, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	a, b := newFlippingBackend(t, "a"), newFlippingBackend(t, "b")
+	pool := newCheckedPool(t, clock, a, b)
+	ctx := context.Background()
+
+	b.failing.Store(true)
+	pool.Check(ctx)
+	if stats := pool.Backends(); !stats[1].Healthy {
+		t.Fatal("backend taken out after one failed check, want two")
+	}
+	pool.Check(ctx)
+	stats := pool.Backends()
+	if stats[0].Healthy != true || stats[1].Healthy || stats[1].LastError == "" || !stats[1].LastCheck.Equal(epoch) {
+		t.Fatalf("got %+v, want b unhealthy", stats)
+	}
+	for i := 0; i < 3; i++ {
+		if backend, _ := served(pool); backend != "a" {
+			t.Fatalf("request went to %q, want only the healthy backend", backend)
+		}
+	}
+
+	b.failing.Store(false)
+	pool.Check(ctx)
+	if stats := pool.Backends(); stats[1].Healthy {
+		t.Fatal("backend back after one passed check, want two")
+	}
+	pool.Check(ctx)
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		backend, _ := served(pool)
+		seen[backend] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Fatalf("requests went to %v, want b back in rotation", seen)
+	}
+
+	// With every backend unhealthy there is nowhere to send requests
+	a.failing.Store(true)
+	b.failing.Store(true)
+	pool.Check(ctx)
+	pool.Check(ctx)
+	if _, code := served(pool); code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d with every backend unhealthy, want 503", code)
+	}
+}
+
+func TestNewPoolRejectsHealthThresholds(t *testing.T) {
+	for _, thresholds := range [][2]int{{0, 3}, {2, 0}, {-1, 3}} {
+		config := DefaultPoolConfig()
+		config.Backends = []BackendConfig{{URL: "http://a:8080"}}
+		config.HealthCheck.Path = "/healthz"
+		config.HealthCheck.HealthyThreshold, config.HealthCheck.UnhealthyThreshold = thresholds[0], thresholds[1]
+		if _, err := NewPool(config); err == nil {
+			t.Errorf("NewPool accepted thresholds %v", thresholds)
+		}
+	}
+}
+
+func TestPoolHealthCheckTimeout(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	config := DefaultPoolConfig()
+	config.Backends = []BackendConfig{{URL: slow.URL}}
+	config.HealthCheck.Path = "/healthz"
+	config.HealthCheck.Timeout = 10 * time.Millisecond
+	config.HealthCheck.UnhealthyThreshold = 1
+	pool, _ := NewPool(config)
+
+	pool.Check(context.Background())
+	if stats := pool.Backends(); stats[0].Healthy {
+		t.Fatal("a backend that didn't answer in time is still healthy")
+	}
+}
+
+func TestPoolRunChecksEachInterval(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	a := newFlippingBackend(t, "a")
+	pool := newCheckedPool(t, clock, a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.Run(ctx)
+	for i := int64(1); i <= 2; i++ {
+		for clock.Timers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clock.Advance(pool.config.HealthCheck.Interval)
+		for deadline := time.Now().Add(5 * time.Second); a.checks.Load() < i; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Run made %d checks after %d intervals", a.checks.Load(), i)
+			}
+		}
+	}
+}
+
+func TestPoolStatusHandler(t *testing.T) {
+	a := newFlippingBackend(t, "a")
+	pool := newCheckedPool(t, NewFakeClock(epoch), a)
+	a.failing.Store(true)
+	pool.Check(context.Background())
+	pool.Check(context.Background())
+
+	rec := httptest.NewRecorder()
+	pool.StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/_limitly/backends", nil))
+	var body struct {
+		Backends []BackendStats `json:"backends"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Backends) != 1 || body.Backends[0].URL != a.URL || body.Backends[0].Healthy {
+		t.Fatalf("got %+v, want the backend reported unhealthy", body.Backends)
+	}
+}
+
+func TestLoadPoolConfigHealthCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.json")
+	os.WriteFile(path, []byte(`{
+		"backends": [{"url": "http://a:8080"}],
+		"health_check": {"path": "/healthz", "interval": "5s", "unhealthy_threshold": 1}
+	}`), 0o644)
+	config, err := LoadPoolConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultHealthCheckConfig()
+	want.Path, want.Interval, want.UnhealthyThreshold = "/healthz", 5*time.Second, 1
+	if config.HealthCheck != want {
+		t.Fatalf("loaded %+v, want %+v", config.HealthCheck, want)
+	}
+
+	os.WriteFile(path, []byte(`{"health_check": {"timeout": "soon"}}`), 0o644)
+	if _, err := LoadPoolConfig(path); err == nil {
+		t.Fatal("LoadPoolConfig accepted a bad timeout")
+	}
+}
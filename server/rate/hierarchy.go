@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"hash/maphash"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// hierarchyStripes is how many locks a Hierarchy without a global level
+// spreads its tenants over
+const hierarchyStripes = 64
+
+// Hierarchy limits a request by its client, by the tenant the client belongs
+// to and by a global limit, so that a noisy client can't use up its tenant's
+// share, a noisy tenant can't starve the others and the backend stays
+// protected overall. Like a Composite, a request is only charged if it
+// passes every level.
+//
+// With borrowing a client past its own limit may still use capacity its
+// tenant has to spare, and is then charged only to the tenant and global
+// limits. Tenants never borrow from the global limit.
+type Hierarchy struct {
+	clients *KeyedLimiter
+	tenants *KeyedLimiter
+	global  RateLimiter
+	borrow  bool
+	clock   Clock
+	// mutex is held from reserving on every level to handing the
+	// reservations back when there is a global level, so that no request
+	// sees capacity held by one that is then denied. Without one only
+	// requests of the same tenant share a limiter, and they hold their
+	// tenant's stripe of tenantMutexes instead.
+	mutex         sync.Mutex
+	tenantMutexes [hierarchyStripes]sync.Mutex
+	seed          maphash.Seed
+}
+
+// NewHierarchy creates a new Hierarchy. Any level may be nil to leave it out.
+// The limiters of every level must implement Reserver, as all the
+// limiters in this package do, and should share the Hierarchy's clock.
+func NewHierarchy(clients, tenants *KeyedLimiter, global RateLimiter, borrow bool, opts ...Option) *Hierarchy {
+	o := newOptions(opts)
+	return &Hierarchy{
+		clients: clients,
+		tenants: tenants,
+		global:  global,
+		borrow:  borrow,
+		clock:   o.clock,
+		seed:    maphash.MakeSeed(),
+	}
+}
+
+// Decide checks if n requests can proceed under the request's client and
+// tenant limits and the global limit
+func (h *Hierarchy) Decide(r *http.Request, n int) (Decision, error) {
+	var client, tenant string
+	if h.clients != nil {
+		client = h.clients.Key(r)
+	}
+	if h.tenants != nil {
+		tenant = h.tenants.Key(r)
+	}
+	return h.DecideKeys(client, tenant, n)
+}
+
+// Exhausted reports whether a level the request must pass has nothing left
+// for even a request costing one unit, as Exhausted does for a single
+// limiter. The client's level is only checked when it can't borrow from its
+// tenant. Levels whose limiter can't be had are left to Decide to report.
+func (h *Hierarchy) Exhausted(r *http.Request) (Decision, bool) {
+	var limiters []RateLimiter
+	if h.clients != nil && !(h.borrow && h.tenants != nil) {
+		if limiter, err := h.clients.LimiterFor(r); err == nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	if h.tenants != nil {
+		if limiter, err := h.tenants.LimiterFor(r); err == nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	if h.global != nil {
+		limiters = append(limiters, h.global)
+	}
+	for _, limiter := range limiters {
+		if d, exhausted := Exhausted(limiter); exhausted {
+			return d, true
+		}
+	}
+	return Decision{}, false
+}
+
+// DecideKeys checks if n requests can proceed under the limits of client,
+// tenant and the global limit, n being capped at the smallest of them. The quota reported is that of the level
+// closest to running out. An error is returned if a client or tenant
+// limiter can't be had, such as when too many keys are tracked.
+func (h *Hierarchy) DecideKeys(client, tenant string, n int) (Decision, error) {
+	limiters := make([]RateLimiter, 0, 3)
+	// clientLevel is whether limiters[0] is the client's, which may be
+	// borrowed around
+	clientLevel := false
+	if h.clients != nil {
+		limiter, err := h.clients.Limiter(client)
+		if err != nil {
+			return Decision{RetryAfter: InfDuration}, err
+		}
+		limiters = append(limiters, limiter)
+		clientLevel = true
+	}
+	if h.tenants != nil {
+		limiter, err := h.tenants.Limiter(tenant)
+		if err != nil {
+			return Decision{RetryAfter: InfDuration}, err
+		}
+		limiters = append(limiters, limiter)
+	}
+	if h.global != nil {
+		limiters = append(limiters, h.global)
+	}
+	// A request costing more than a level could ever admit uses it all up
+	for _, limiter := range limiters {
+		n = CapCost(limiter, n)
+	}
+
+	parts := make([]Reserver, len(limiters))
+	for i, limiter := range limiters {
+		part, ok := limiter.(Reserver)
+		if !ok {
+			return Decision{}, fmt.Errorf("rate: %T can't be part of a hierarchy", limiter)
+		}
+		parts[i] = part
+	}
+
+	if mutex := h.lockFor(tenant); mutex != nil {
+		mutex.Lock()
+		defer mutex.Unlock()
+	}
+
+	now := h.clock.Now()
+	ats := make([]time.Time, len(parts))
+	oks := make([]bool, len(parts))
+	cancels := make([]func(now time.Time), len(parts))
+	for i, part := range parts {
+		ats[i], oks[i], cancels[i] = reserve(part, now, n)
+	}
+
+	// The levels the request must pass, which leaves out the client's when
+	// it can borrow from a tenant with capacity to spare. Without a tenant
+	// level there is nothing to borrow from.
+	required := 0
+	if h.borrow && clientLevel && h.tenants != nil && (!oks[0] || ats[0].After(now)) {
+		required = 1
+	}
+	allowed, retryAfter := true, time.Duration(0)
+	for i := required; i < len(parts); i++ {
+		switch {
+		case !oks[i]:
+			allowed, retryAfter = false, InfDuration
+		case ats[i].After(now):
+			allowed = false
+			if wait := ats[i].Sub(now); wait > retryAfter && retryAfter != InfDuration {
+				retryAfter = wait
+			}
+		}
+	}
+
+	// Hand back every reservation a denied request made, and the client's
+	// when it borrowed
+	for i, cancel := range cancels {
+		if oks[i] && (!allowed || i < required) {
+			cancel(now)
+		}
+	}
+
+	d := tightest(limiters[required:])
+	d.Allowed, d.RetryAfter = allowed, retryAfter
+	return d, nil
+}
+
+// lockFor returns the mutex to hold across the reservations of a request
+// from tenant, or nil when its only level is its client's, which it shares
+// with no other request
+func (h *Hierarchy) lockFor(tenant string) *sync.Mutex {
+	switch {
+	case h.global != nil:
+		return &h.mutex
+	case h.tenants != nil:
+		return &h.tenantMutexes[maphash.String(h.seed, tenant)%hierarchyStripes]
+	}
+	return nil
+}
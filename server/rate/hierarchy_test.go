@@ -0,0 +1,231 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestHierarchy limits each client to 2, each tenant to 3 and everyone to
+// 5 requests an hour
+func newTestHierarchy(clock Clock, borrow bool) (*Hierarchy, *KeyedLimiter, *KeyedLimiter, RateLimiter) {
+	window := func(limit int) LimiterFactory {
+		return func(string) RateLimiter { return NewFixedWindow(limit, time.Hour, WithClock(clock)) }
+	}
+	clients := NewKeyedLimiter(ClientIP, window(2), DefaultKeyedConfig(), WithClock(clock))
+	tenants := NewKeyedLimiter(HeaderKey("X-Tenant"), window(3), DefaultKeyedConfig(), WithClock(clock))
+	global := NewFixedWindow(5, time.Hour, WithClock(clock))
+	return NewHierarchy(clients, tenants, global, borrow, WithClock(clock)), clients, tenants, global
+}
+
+func remaining(kl *KeyedLimiter, key string) int {
+	limiter, _ := kl.Limiter(key)
+	return limiter.Decide(0).Remaining
+}
+
+func TestHierarchyEnforcesEveryLevel(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	h, clients, tenants, global := newTestHierarchy(clock, false)
+	allow := func(client, tenant string) bool {
+		d, err := h.DecideKeys(client, tenant, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Allowed
+	}
+
+	// a is stopped by its own limit, leaving its tenant's last request
+	if !allow("a", "red") || !allow("a", "red") || allow("a", "red") {
+		t.Fatal("client a wasn't held to its own limit")
+	}
+	if got := remaining(tenants, "red"); got != 1 {
+		t.Fatalf("tenant red has %d left, want 1", got)
+	}
+	// b is stopped by the tenant, keeping its own second request
+	if !allow("b", "red") || allow("b", "red") {
+		t.Fatal("client b wasn't held to its tenant's limit")
+	}
+	if got := remaining(clients, "b"); got != 1 {
+		t.Fatalf("client b has %d left, want 1", got)
+	}
+	// The other tenant is unaffected until the global limit runs out
+	if !allow("c", "blue") || !allow("c", "blue") {
+		t.Fatal("tenant blue was starved by tenant red")
+	}
+	d, _ := h.DecideKeys("d", "blue", 1)
+	if d.Allowed || d.Limit != 5 || d.RetryAfter != time.Hour {
+		t.Fatalf("got %+v, want denied by the global limit for an hour", d)
+	}
+	if got := global.Decide(0).Remaining; got != 0 {
+		t.Fatalf("global limit has %d left, want 0", got)
+	}
+	if got := remaining(tenants, "blue"); got != 1 {
+		t.Fatalf("tenant blue has %d left, want 1", got)
+	}
+}
+
+func TestHierarchyBorrowsFromTenant(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	h, clients, tenants, _ := newTestHierarchy(clock, true)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1000"
+	r.Header.Set("X-Tenant", "red")
+	for i := 0; i < 3; i++ {
+		if d, _ := h.Decide(r, 1); !d.Allowed {
+			t.Fatalf("request %d denied, want the client to borrow its tenant's spare capacity", i+1)
+		}
+	}
+	if d, _ := h.Decide(r, 1); d.Allowed || d.Limit != 3 {
+		t.Fatalf("got %+v, want denied once the tenant ran out", d)
+	}
+	if got := remaining(tenants, "red"); got != 0 {
+		t.Fatalf("tenant red has %d left, want 0", got)
+	}
+	if got := remaining(clients, "10.0.0.1"); got != 0 {
+		t.Fatalf("client has %d left, want only its own 2 taken", got)
+	}
+
+	// Tenants don't borrow from the global limit
+	if d, _ := h.DecideKeys("10.0.0.2", "red", 1); d.Allowed {
+		t.Fatal("a client of an exhausted tenant was let through")
+	}
+	if got := remaining(clients, "10.0.0.2"); got != 2 {
+		t.Fatalf("denied client has %d left, want 2", got)
+	}
+}
+
+func TestHierarchyExhausted(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	h, _, _, _ := newTestHierarchy(clock, false)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1000"
+	r.Header.Set("X-Tenant", "red")
+	if _, exhausted := h.Exhausted(r); exhausted {
+		t.Fatal("a fresh hierarchy is exhausted")
+	}
+	h.Decide(r, 2)
+	if d, exhausted := h.Exhausted(r); !exhausted || d.Allowed || d.RetryAfter != time.Hour {
+		t.Fatalf("got %+v, %v, want the client exhausted for an hour", d, exhausted)
+	}
+
+	// A client that can borrow is only exhausted with its tenant
+	h, _, _, _ = newTestHierarchy(clock, true)
+	h.Decide(r, 2)
+	if _, exhausted := h.Exhausted(r); exhausted {
+		t.Fatal("a client that can borrow from its tenant is exhausted")
+	}
+	h.Decide(r, 1)
+	if _, exhausted := h.Exhausted(r); !exhausted {
+		t.Fatal("a client of an exhausted tenant isn't exhausted")
+	}
+}
+
+func TestHierarchyDoesNotBorrowFromGlobal(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	_, clients, _, global := newTestHierarchy(clock, true)
+	h := NewHierarchy(clients, nil, global, true, WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		if d, _ := h.DecideKeys("a", "", 1); !d.Allowed {
+			t.Fatalf("request %d denied", i+1)
+		}
+	}
+	if d, _ := h.DecideKeys("a", "", 1); d.Allowed || d.Limit != 2 {
+		t.Fatalf("got %+v, want the client held to its own limit without a tenant to borrow from", d)
+	}
+	if got := global.Decide(0).Remaining; got != 3 {
+		t.Fatalf("global limit has %d left, want 3", got)
+	}
+}
+
+func TestHierarchyDeniedRequestsHoldNoCapacity(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	h, _, _, _ := newTestHierarchy(clock, false)
+	// Client a is out of requests, but keeps trying
+	h.DecideKeys("a", "red", 2)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, tenant := "a", "red"
+			if i%20 == 0 {
+				// One request each from five clients of their own tenants
+				client, tenant = strconv.Itoa(i), strconv.Itoa(i)
+			}
+			d, _ := h.DecideKeys(client, tenant, 1)
+			if d.Allowed && client != "a" {
+				mutex.Lock()
+				allowed++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	// The global limit has 3 left, none of which a's denied requests take
+	if allowed != 3 {
+		t.Fatalf("%d other clients allowed, want 3", allowed)
+	}
+}
+
+func TestProxyHandlerUsesHierarchy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("no_rate_limit", 0, 0)
+	h, _, _, _ := newTestHierarchy(RealClock, false)
+	SetHierarchy(h)
+	defer SetHierarchy(nil)
+
+	status := func(tenant string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Tenant", tenant)
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, r)
+		return rec.Code
+	}
+	if status("red") != http.StatusOK || status("red") != http.StatusOK {
+		t.Fatal("first requests should pass")
+	}
+	if status("red") != http.StatusTooManyRequests {
+		t.Fatal("third request from the same client should be limited")
+	}
+}
+
+func TestHierarchyLocksOnlySharedLevels(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	h, clients, tenants, _ := newTestHierarchy(clock, false)
+	if h.lockFor("red") != &h.mutex || h.lockFor("blue") != &h.mutex {
+		t.Fatal("requests sharing the global level should share its lock")
+	}
+	if NewHierarchy(clients, nil, nil, false).lockFor("") != nil {
+		t.Fatal("requests limited only by their client need no lock")
+	}
+
+	// Without a global level a tenant's requests don't wait on another's
+	h = NewHierarchy(clients, tenants, nil, false, WithClock(clock))
+	held := h.lockFor("red")
+	other := "blue"
+	for i := 0; h.lockFor(other) == held; i++ {
+		other = "blue" + strconv.Itoa(i)
+	}
+	held.Lock()
+	defer held.Unlock()
+	done := make(chan struct{})
+	go func() {
+		h.DecideKeys("a", other, 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a request from another tenant waited on red's lock")
+	}
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooManyKeys is returned when a new key arrives while the maximum number
+// of keys is already tracked
+var ErrTooManyKeys = errors.New("rate: too many keys tracked")
+
+// OverflowPolicy decides what happens to a new key that arrives while
+// MaxKeys keys are already tracked
+type OverflowPolicy int
+
+const (
+	// OverflowReject fails the lookup with ErrTooManyKeys
+	OverflowReject OverflowPolicy = iota
+	// OverflowEvict drops the least recently used key to make room
+	OverflowEvict
+	// OverflowShared limits the new key with one limiter shared by every key
+	// that didn't fit
+	OverflowShared
+)
+
+var overflowPolicyNames = []string{"reject", "evict", "shared"}
+
+// ParseOverflowPolicy returns the OverflowPolicy called name
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for i, policyName := range overflowPolicyNames {
+		if name == policyName {
+			return OverflowPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("rate: unknown overflow policy %q", name)
+}
+
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(overflowPolicyNames) {
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+	return overflowPolicyNames[p]
+}
+
+// KeyFunc extracts the key a request is limited by, such as the client IP
+type KeyFunc func(r *http.Request) string
+
+// LimiterFactory creates the limiter for a key seen for the first time. The
+// limiter shared by keys that overflow MaxKeys is created with an empty key.
+type LimiterFactory func(key string) RateLimiter
+
+// KeyedConfig holds the parameters of a KeyedLimiter
+type KeyedConfig struct {
+	// TTL is how long a key may go unseen before its limiter is dropped
+	TTL time.Duration
+	// MaxKeys caps the number of keys tracked at once; zero means no cap
+	MaxKeys int
+	// Overflow is what happens to new keys once MaxKeys are tracked
+	Overflow OverflowPolicy
+	// Shards is the number of independently locked partitions of the keys;
+	// zero uses DefaultShards
+	Shards int
+}
+
+// DefaultShards is the number of partitions a KeyedLimiter splits its keys into
+const DefaultShards = 64
+
+// DefaultKeyedConfig returns the KeyedConfig the server has always used:
+// clients are forgotten after five minutes and there is no cap
+func DefaultKeyedConfig() KeyedConfig {
+	return KeyedConfig{TTL: 5 * time.Minute}
+}
+
+// KeyedStats counts what a KeyedLimiter has done with the keys it has seen
+type KeyedStats struct {
+	Keys int `json:"keys"`
+	// Expired counts keys dropped for being idle for the TTL
+	Expired int64 `json:"expired"`
+	// Evicted counts keys dropped to make room for new ones
+	Evicted int64 `json:"evicted"`
+	// Shared counts lookups of new keys given the shared limiter
+	Shared int64 `json:"shared"`
+	// Rejected counts lookups of new keys that failed with ErrTooManyKeys
+	Rejected int64 `json:"rejected"`
+}
+
+// keyedEntry is a tracked key's limiter and when the key was last seen, in
+// Unix nanoseconds so lookups can update it under a read lock. referenced is
+// the CLOCK bit, set on every lookup and cleared as the eviction hand passes.
+type keyedEntry struct {
+	key        string
+	limiter    RateLimiter
+	lastSeen   atomic.Int64
+	referenced atomic.Bool
+}
+
+func (e *keyedEntry) touch(now time.Time) {
+	e.lastSeen.Store(now.UnixNano())
+	if !e.referenced.Load() {
+		e.referenced.Store(true)
+	}
+}
+
+// keyedShard is one hash partition of a KeyedLimiter's keys. ring holds the
+// same entries as the map, in the order the CLOCK hand visits them.
+type keyedShard struct {
+	entries   map[string]*keyedEntry
+	ring      []*keyedEntry
+	hand      int
+	lastSweep time.Time
+	mutex     sync.RWMutex
+}
+
+// KeyedLimiter keeps a separate limiter per key, creating them on first use
+// and dropping them once their key has been idle for the TTL. Keys are
+// hash-partitioned into shards with their own locks, so requests for
+// different keys rarely contend, and lookups of known keys only take a read
+// lock. Each shard is swept for idle keys at most once per TTL by the first
+// request to reach it, so eviction work is spread out rather than done in
+// one pass over every key.
+//
+// With MaxKeys set the number of keys is a hard cap. What happens to a new
+// key past it depends on the Overflow policy; OverflowEvict approximates LRU
+// with the CLOCK algorithm, preferring a victim from the new key's own shard.
+type KeyedLimiter struct {
+	keyFunc  KeyFunc
+	factory  LimiterFactory
+	config   KeyedConfig
+	shards   []*keyedShard
+	seed     maphash.Seed
+	keys     atomic.Int64
+	shared   RateLimiter
+	expired  atomic.Int64
+	evicted  atomic.Int64
+	overflow atomic.Int64
+	rejected atomic.Int64
+	clock    Clock
+}
+
+// NewKeyedLimiter creates a new KeyedLimiter
+func NewKeyedLimiter(keyFunc KeyFunc, factory LimiterFactory, config KeyedConfig, opts ...Option) *KeyedLimiter {
+	o := newOptions(opts)
+	if config.Shards <= 0 {
+		config.Shards = DefaultShards
+	}
+	kl := &KeyedLimiter{
+		keyFunc: keyFunc,
+		factory: factory,
+		config:  config,
+		shards:  make([]*keyedShard, config.Shards),
+		seed:    maphash.MakeSeed(),
+		clock:   o.clock,
+	}
+	if config.Overflow == OverflowShared {
+		kl.shared = factory("")
+	}
+	now := o.clock.Now()
+	for i := range kl.shards {
+		kl.shards[i] = &keyedShard{entries: make(map[string]*keyedEntry), lastSweep: now}
+	}
+	return kl
+}
+
+// Limiter returns the limiter for key, creating it if the key is new
+func (kl *KeyedLimiter) Limiter(key string) (RateLimiter, error) {
+	shard := kl.shardFor(key)
+	now := kl.clock.Now()
+
+	shard.mutex.RLock()
+	entry, exists := shard.entries[key]
+	sweepDue := kl.sweepDue(shard, now)
+	shard.mutex.RUnlock()
+	if exists && !sweepDue {
+		entry.touch(now)
+		return entry.limiter, nil
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if kl.sweepDue(shard, now) {
+		kl.sweep(shard, now)
+	}
+
+	if entry, exists := shard.entries[key]; exists {
+		entry.touch(now)
+		return entry.limiter, nil
+	}
+
+	if !kl.admit() {
+		kl.sweep(shard, now)
+		if !kl.admit() {
+			switch kl.config.Overflow {
+			case OverflowEvict:
+				if kl.evict(shard) && kl.admit() {
+					break
+				}
+				kl.rejected.Add(1)
+				return nil, ErrTooManyKeys
+			case OverflowShared:
+				kl.overflow.Add(1)
+				return kl.shared, nil
+			default:
+				kl.rejected.Add(1)
+				return nil, ErrTooManyKeys
+			}
+		}
+	}
+
+	entry = &keyedEntry{key: key, limiter: kl.factory(key)}
+	entry.lastSeen.Store(now.UnixNano())
+	shard.entries[key] = entry
+	shard.ring = append(shard.ring, entry)
+	return entry.limiter, nil
+}
+
+// LimiterFor returns the limiter for the request's key
+func (kl *KeyedLimiter) LimiterFor(r *http.Request) (RateLimiter, error) {
+	return kl.Limiter(kl.keyFunc(r))
+}
+
+// Key returns the key the request is limited by
+func (kl *KeyedLimiter) Key(r *http.Request) string {
+	return kl.keyFunc(r)
+}
+
+// Cleanup drops every key that has been idle for the TTL and returns how many
+// were dropped. Shards are locked one at a time.
+func (kl *KeyedLimiter) Cleanup() int {
+	dropped := 0
+	for _, shard := range kl.shards {
+		shard.mutex.Lock()
+		dropped += kl.sweep(shard, kl.clock.Now())
+		shard.mutex.Unlock()
+	}
+	return dropped
+}
+
+// Len returns the number of keys tracked
+func (kl *KeyedLimiter) Len() int {
+	return int(kl.keys.Load())
+}
+
+// Stats returns the number of keys tracked and how many have been dropped,
+// shared or rejected
+func (kl *KeyedLimiter) Stats() KeyedStats {
+	return KeyedStats{
+		Keys:     kl.Len(),
+		Expired:  kl.expired.Load(),
+		Evicted:  kl.evicted.Load(),
+		Shared:   kl.overflow.Load(),
+		Rejected: kl.rejected.Load(),
+	}
+}
+
+func (kl *KeyedLimiter) shardFor(key string) *keyedShard {
+	return kl.shards[maphash.String(kl.seed, key)%uint64(len(kl.shards))]
+}
+
+func (kl *KeyedLimiter) sweepDue(shard *keyedShard, now time.Time) bool {
+	return kl.config.TTL > 0 && now.Sub(shard.lastSweep) >= kl.config.TTL
+}
+
+// admit counts a new key, unless that would go over MaxKeys
+func (kl *KeyedLimiter) admit() bool {
+	keys := kl.keys.Add(1)
+	if kl.config.MaxKeys > 0 && keys > int64(kl.config.MaxKeys) {
+		kl.keys.Add(-1)
+		return false
+	}
+	return true
+}
+
+// sweep drops the shard's idle keys; the caller holds its write lock
+func (kl *KeyedLimiter) sweep(shard *keyedShard, now time.Time) int {
+	shard.lastSweep = now
+	if kl.config.TTL <= 0 {
+		return 0
+	}
+
+	cutoff := now.Add(-kl.config.TTL).UnixNano()
+	kept := shard.ring[:0]
+	for i, entry := range shard.ring {
+		if entry.lastSeen.Load() >= cutoff {
+			kept = append(kept, entry)
+			continue
+		}
+		delete(shard.entries, entry.key)
+		if i < shard.hand {
+			shard.hand--
+		}
+	}
+	dropped := len(shard.ring) - len(kept)
+	clear(shard.ring[len(kept):])
+	shard.ring = kept
+
+	kl.keys.Add(-int64(dropped))
+	kl.expired.Add(int64(dropped))
+	return dropped
+}
+
+// evict drops one key to make room, from shard if it has any and otherwise
+// from the first other shard that isn't busy. The caller holds shard's write
+// lock, so other shards are only tried, never waited on.
+func (kl *KeyedLimiter) evict(shard *keyedShard) bool {
+	if len(shard.ring) > 0 {
+		kl.evictFrom(shard)
+		return true
+	}
+	for _, other := range kl.shards {
+		if other == shard || !other.mutex.TryLock() {
+			continue
+		}
+		evicted := len(other.ring) > 0
+		if evicted {
+			kl.evictFrom(other)
+		}
+		other.mutex.Unlock()
+		if evicted {
+			return true
+		}
+	}
+	return false
+}
+
+// evictFrom advances the shard's CLOCK hand, giving referenced keys a second
+// chance, and drops the first key that hasn't been looked up since the hand
+// last passed it
+func (kl *KeyedLimiter) evictFrom(shard *keyedShard) {
+	for {
+		if shard.hand >= len(shard.ring) {
+			shard.hand = 0
+		}
+		entry := shard.ring[shard.hand]
+		if entry.referenced.Swap(false) {
+			shard.hand++
+			continue
+		}
+
+		delete(shard.entries, entry.key)
+		last := len(shard.ring) - 1
+		shard.ring[shard.hand] = shard.ring[last]
+		shard.ring[last] = nil
+		shard.ring = shard.ring[:last]
+
+		kl.keys.Add(-1)
+		kl.evicted.Add(1)
+		return
+	}
+}
+
+// ClientIP is a KeyFunc that keys requests by the IP address in RemoteAddr
+func ClientIP(r *http.Request) string {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+// HeaderKey returns a KeyFunc that keys requests by the value of the named
+// header. Requests without it share the empty key.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
@@ -0,0 +1,389 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiterSeparatesKeys(t *testing.T) {
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewFixedWindow(1, time.Minute) }, DefaultKeyedConfig())
+
+	a, _ := kl.Limiter("10.0.0.1")
+	b, _ := kl.Limiter("10.0.0.2")
+	if !a.Allow() || !b.Allow() {
+		t.Fatal("each key should get its own quota")
+	}
+	if again, _ := kl.Limiter("10.0.0.1"); again != a || again.Allow() {
+		t.Fatal("a key should keep its limiter between requests")
+	}
+	if kl.Len() != 2 {
+		t.Fatalf("tracking %d keys, want 2", kl.Len())
+	}
+}
+
+func TestKeyedLimiterEvictsIdleKeys(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	config := KeyedConfig{TTL: time.Minute, Shards: 1}
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return &NoRateLimiter{} }, config, WithClock(clock))
+
+	kl.Limiter("idle")
+	clock.Advance(30 * time.Second)
+	kl.Limiter("active")
+	clock.Advance(40 * time.Second)
+	kl.Limiter("active")
+
+	// The sweep on the last lookup only drops keys idle for over a minute
+	if kl.Len() != 1 {
+		t.Fatalf("tracking %d keys, want only the active one", kl.Len())
+	}
+	clock.Advance(2 * time.Minute)
+	if dropped := kl.Cleanup(); dropped != 1 || kl.Len() != 0 {
+		t.Fatalf("Cleanup dropped %d keys, %d left", dropped, kl.Len())
+	}
+}
+
+func TestKeyedLimiterSweepsShardsIncrementally(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	config := KeyedConfig{TTL: time.Minute, Shards: 8}
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return &NoRateLimiter{} }, config, WithClock(clock))
+
+	for i := 0; i < 100; i++ {
+		kl.Limiter(fmt.Sprintf("10.0.0.%d", i))
+	}
+	clock.Advance(2 * time.Minute)
+
+	// Touching one key only sweeps the shard it lives in
+	kl.Limiter("10.0.0.0")
+	if n := kl.Len(); n <= 1 || n >= 100 {
+		t.Fatalf("tracking %d keys after one lookup, want only one shard swept", n)
+	}
+	kl.Cleanup()
+	if n := kl.Len(); n != 1 {
+		t.Fatalf("tracking %d keys after Cleanup, want 1", n)
+	}
+}
+
+func TestKeyedLimiterCapsKeys(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	// A new key at the cap only sweeps its own shard, so use one
+	config := KeyedConfig{TTL: time.Minute, MaxKeys: 2, Shards: 1}
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return &NoRateLimiter{} }, config, WithClock(clock))
+
+	kl.Limiter("a")
+	kl.Limiter("b")
+	if _, err := kl.Limiter("c"); !errors.Is(err, ErrTooManyKeys) {
+		t.Fatalf("got %v, want ErrTooManyKeys", err)
+	}
+	if _, err := kl.Limiter("a"); err != nil {
+		t.Fatalf("known key refused at the cap: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, err := kl.Limiter("c"); err != nil {
+		t.Fatalf("new key refused after the others went idle: %v", err)
+	}
+}
+
+func TestKeyedLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	config := KeyedConfig{TTL: time.Minute, MaxKeys: 3, Overflow: OverflowEvict, Shards: 1}
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return &NoRateLimiter{} }, config)
+
+	first, _ := kl.Limiter("a")
+	kl.Limiter("b")
+	kl.Limiter("c")
+	kl.Limiter("a")
+	kl.Limiter("b")
+
+	// c is the only key not looked up again, so it makes room for d
+	if _, err := kl.Limiter("d"); err != nil {
+		t.Fatalf("new key refused with eviction enabled: %v", err)
+	}
+	if kl.Len() != 3 {
+		t.Fatalf("tracking %d keys, want the cap of 3", kl.Len())
+	}
+	if again, _ := kl.Limiter("a"); again != first {
+		t.Fatal("a recently used key was evicted")
+	}
+	if stats := kl.Stats(); stats.Evicted != 1 || stats.Rejected != 0 {
+		t.Fatalf("stats %+v, want one eviction", stats)
+	}
+}
+
+func TestKeyedLimiterEvictsAcrossShards(t *testing.T) {
+	config := KeyedConfig{TTL: time.Minute, MaxKeys: 10, Overflow: OverflowEvict, Shards: 8}
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return &NoRateLimiter{} }, config)
+
+	for i := 0; i < 100; i++ {
+		if _, err := kl.Limiter(fmt.Sprintf("10.0.0.%d", i)); err != nil {
+			t.Fatalf("key %d refused: %v", i, err)
+		}
+		if kl.Len() > 10 {
+			t.Fatalf("tracking %d keys, over the cap of 10", kl.Len())
+		}
+	}
+	if stats := kl.Stats(); stats.Evicted != 90 {
+		t.Fatalf("stats %+v, want 90 evictions", stats)
+	}
+}
+
+func TestKeyedLimiterSharesOverflowLimiter(t *testing.T) {
+	config := KeyedConfig{TTL: time.Minute, MaxKeys: 1, Overflow: OverflowShared, Shards: 1}
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewFixedWindow(1, time.Minute) }, config)
+
+	own, _ := kl.Limiter("a")
+	b, err := kl.Limiter("b")
+	if err != nil {
+		t.Fatalf("overflow key refused: %v", err)
+	}
+	c, _ := kl.Limiter("c")
+	if b != c || b == own {
+		t.Fatal("keys past the cap should share one limiter")
+	}
+	if !b.Allow() || c.Allow() {
+		t.Fatal("the shared limiter should hold one quota for all overflow keys")
+	}
+	if !own.Allow() {
+		t.Fatal("a tracked key should keep its own quota")
+	}
+	if stats := kl.Stats(); stats.Keys != 1 || stats.Shared != 2 {
+		t.Fatalf("stats %+v, want one key and two shared lookups", stats)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowReject, OverflowEvict, OverflowShared} {
+		if parsed, err := ParseOverflowPolicy(policy.String()); err != nil || parsed != policy {
+			t.Fatalf("ParseOverflowPolicy(%q) = %v, %v", policy, parsed, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop"); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cases := map[string]string{
+		"192.168.1.5:5000": "192.168.1.5",
+		"[::1]:8080":       "::1",
+		"10.0.0.1":         "10.0.0.1",
+	}
+	for remoteAddr, want := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if got := ClientIP(r); got != want {
+			t.Errorf("ClientIP(%q) = %q, want %q", remoteAddr, got, want)
+		}
+	}
+}
+
+func TestProxyHandlerLimitsPerKey(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("no_rate_limit", 0, 0)
+	SetKeyedLimiter(NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewFixedWindow(1, time.Minute) }, DefaultKeyedConfig()))
+	defer SetKeyedLimiter(nil)
+
+	status := func(remoteAddr string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, r)
+		return rec.Code
+	}
+	if status("10.0.0.1:1000") != http.StatusOK || status("10.0.0.2:1000") != http.StatusOK {
+		t.Fatal("first request from each client should pass")
+	}
+	if status("10.0.0.1:2000") != http.StatusTooManyRequests {
+		t.Fatal("second request from the same client should be limited")
+	}
+}
+
+func TestProxyHandlerGlobalDenialKeepsClientQuota(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("fixed_window", 1, 0)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+	client := NewFixedWindow(3, time.Minute)
+	SetKeyedLimiter(NewKeyedLimiter(ClientIP, func(string) RateLimiter { return client }, DefaultKeyedConfig()))
+	defer SetKeyedLimiter(nil)
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.1:1000"
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, r)
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests || codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("got %v, want the global limit to admit only the first", codes)
+	}
+	if remaining := client.Decide(0).Remaining; remaining != 2 {
+		t.Errorf("client has %d remaining, want 2 as the global limit denied the rest", remaining)
+	}
+}
+
+func TestDecideKeyedLocksOnlyGlobalReservation(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	client := NewFixedWindow(1, time.Minute, WithClock(clock))
+	global := NewFixedWindow(10, time.Minute, WithClock(clock))
+	client.Allow()
+
+	// A client its own limit denies never touches the global limiter
+	var mutex sync.Mutex
+	mutex.Lock()
+	done := make(chan Decision)
+	go func() { done <- decideKeyed(client, global, &mutex, clock.Now(), 1) }()
+	select {
+	case d := <-done:
+		if d.Allowed || d.Limit != 1 {
+			t.Fatalf("got %+v, want denied by the client's limit", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a denied client waited on the global mutex")
+	}
+	mutex.Unlock()
+	if remaining := global.Decide(0).Remaining; remaining != 10 {
+		t.Fatalf("global limit has %d remaining, want 10", remaining)
+	}
+}
+
+func TestProxyHandlerSkipsUnlimitedGlobal(t *testing.T) {
+	SetRateLimiter("no_rate_limit", 0, 0)
+	if loadConfig().rateMutex != nil {
+		t.Fatal("an unlimited global limit should not serialise clients")
+	}
+	SetRateLimiter("token_bucket", 10, 10)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+	if loadConfig().rateMutex == nil {
+		t.Fatal("a global limit needs a mutex for its reservations")
+	}
+}
+
+// mutexKeyed is the per-client map server/main.go used before KeyedLimiter,
+// with one mutex taken around every lookup, kept as a benchmark baseline
+type mutexKeyed struct {
+	clients map[string]*mutexKeyedClient
+	mutex   sync.Mutex
+}
+
+type mutexKeyedClient struct {
+	limiter  RateLimiter
+	lastSeen time.Time
+}
+
+func (mk *mutexKeyed) Limiter(key string) (RateLimiter, error) {
+	mk.mutex.Lock()
+	defer mk.mutex.Unlock()
+
+	if client, exists := mk.clients[key]; exists {
+		client.lastSeen = time.Now()
+		return client.limiter, nil
+	}
+	client := &mutexKeyedClient{limiter: NewTokenBucketRate(1000, 1e6), lastSeen: time.Now()}
+	mk.clients[key] = client
+	return client.limiter, nil
+}
+
+// BenchmarkKeyedLookup compares lookups on the single-mutex map against the
+// sharded KeyedLimiter. Run with -cpu 1,2,4,8 to see how each scales.
+func BenchmarkKeyedLookup(b *testing.B) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff)
+	}
+	designs := map[string]func() interface {
+		Limiter(string) (RateLimiter, error)
+	}{
+		"mutex_map": func() interface {
+			Limiter(string) (RateLimiter, error)
+		} {
+			return &mutexKeyed{clients: make(map[string]*mutexKeyedClient)}
+		},
+		"sharded": func() interface {
+			Limiter(string) (RateLimiter, error)
+		} {
+			return NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewTokenBucketRate(1000, 1e6) }, DefaultKeyedConfig())
+		},
+	}
+	for _, name := range []string{"mutex_map", "sharded"} {
+		b.Run(name, func(b *testing.B) {
+			store := designs[name]()
+			for _, key := range keys {
+				store.Limiter(key)
+			}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(7919))
+				for pb.Next() {
+					limiter, _ := store.Limiter(keys[i%len(keys)])
+					limiter.Allow()
+					i++
+				}
+			})
+		})
+	}
+}
+
+// roundTripFunc answers requests without a backend, so that benchmarks of
+// ProxyHandler measure the limiting rather than the network
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// BenchmarkProxyHandlerKeyed runs requests from many clients through
+// ProxyHandler in parallel, with the default unlimited global limit and with
+// a global limit too high to deny any. Run with -cpu 1,2,4,8 to see whether
+// clients are serialised behind one another.
+func BenchmarkProxyHandlerKeyed(b *testing.B) {
+	SetTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header), Request: r}, nil
+	}))
+	defer SetTransport(nil)
+	SetBackendURL("http://backend.invalid")
+	SetKeyedLimiter(NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewTokenBucketRate(1000, 1e6) }, DefaultKeyedConfig()))
+	defer SetKeyedLimiter(nil)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	remoteAddrs := make([]string, 1000)
+	for i := range remoteAddrs {
+		remoteAddrs[i] = fmt.Sprintf("10.0.%d.%d:1000", i>>8, i&0xff)
+	}
+	globals := map[string]LimiterConfig{
+		"unlimited_global": {Algorithm: "no_rate_limit"},
+		"limited_global":   {Algorithm: "token_bucket", Rate: 1e9, Burst: 1e9},
+	}
+	for _, name := range []string{"unlimited_global", "limited_global"} {
+		b.Run(name, func(b *testing.B) {
+			if err := SetLimiterConfig(globals[name]); err != nil {
+				b.Fatal(err)
+			}
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(7919))
+				for pb.Next() {
+					r := httptest.NewRequest("GET", "/", nil)
+					r.RemoteAddr = remoteAddrs[i%len(remoteAddrs)]
+					rec := httptest.NewRecorder()
+					ProxyHandler(rec, r)
+					if rec.Code != http.StatusOK {
+						b.Errorf("got %d", rec.Code)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when a request arrives to a full queue
+	ErrQueueFull = errors.New("rate: queue is full")
+	// ErrQueueTimeout is returned when a request would wait longer than allowed
+	ErrQueueTimeout = errors.New("rate: queued request would wait too long")
+)
+
+// LeakyQueue struct for the leaky bucket used as a queue rather than a meter.
+// Instead of rejecting once the bucket is full, requests wait in it and leave
+// one per interval, so bursts are smoothed into a constant rate. Requests are
+// scheduled as they arrive, so only the release time of the last one is kept.
+type LeakyQueue struct {
+	capacity    int
+	interval    time.Duration
+	maxWait     time.Duration
+	nextRelease time.Time
+	clock       Clock
+	mutex       sync.Mutex
+}
+
+// NewLeakyQueue creates a new LeakyQueue holding up to capacity waiting
+// requests, each of which waits at most maxWait. A zero maxWait only bounds
+// the wait by the queue length.
+func NewLeakyQueue(capacity int, interval, maxWait time.Duration, opts ...Option) *LeakyQueue {
+	o := newOptions(opts)
+	return &LeakyQueue{
+		capacity:    capacity,
+		interval:    interval,
+		maxWait:     maxWait,
+		nextRelease: o.clock.Now(),
+		clock:       o.clock,
+	}
+}
+
+// Enqueue blocks until the request's turn to leave the queue. It fails
+// straight away with ErrQueueFull or ErrQueueTimeout if the request cannot
+// be released in time, and with ctx's error if ctx is done while waiting.
+func (lq *LeakyQueue) Enqueue(ctx context.Context) error {
+	lq.mutex.Lock()
+	now := lq.clock.Now()
+	if lq.waiting(now) >= lq.capacity {
+		lq.mutex.Unlock()
+		return ErrQueueFull
+	}
+	release := lq.nextRelease
+	if release.Before(now) {
+		release = now
+	}
+	wait := release.Sub(now)
+	if lq.maxWait > 0 && wait > lq.maxWait {
+		lq.mutex.Unlock()
+		return ErrQueueTimeout
+	}
+	lq.nextRelease = release.Add(lq.interval)
+	lq.mutex.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := lq.clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		// Give the slot back if nobody has queued behind it
+		lq.mutex.Lock()
+		if lq.nextRelease.Equal(release.Add(lq.interval)) {
+			lq.nextRelease = release
+		}
+		lq.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Len returns the number of requests waiting to be released
+func (lq *LeakyQueue) Len() int {
+	lq.mutex.Lock()
+	defer lq.mutex.Unlock()
+	return lq.waiting(lq.clock.Now())
+}
+
+// waiting counts the scheduled releases still in the future
+func (lq *LeakyQueue) waiting(now time.Time) int {
+	last := lq.nextRelease.Add(-lq.interval)
+	if !last.After(now) {
+		return 0
+	}
+	return int((last.Sub(now) + lq.interval - 1) / lq.interval)
+}
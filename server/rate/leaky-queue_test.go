@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeakyQueueReleasesAtConstantInterval(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	lq := NewLeakyQueue(2, time.Second, 0, WithClock(clock))
+
+	if err := lq.Enqueue(context.Background()); err != nil {
+		t.Fatalf("first request should go straight through: %v", err)
+	}
+
+	released := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		go func() {
+			if err := lq.Enqueue(context.Background()); err != nil {
+				t.Error(err)
+			}
+			released <- i
+		}()
+		for clock.Timers() != i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if lq.Len() != 2 {
+		t.Fatalf("queue length %d, want 2", lq.Len())
+	}
+	if err := lq.Enqueue(context.Background()); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+
+	clock.Advance(time.Second)
+	if got := <-released; got != 1 {
+		t.Fatalf("request %d released first", got)
+	}
+	select {
+	case got := <-released:
+		t.Fatalf("request %d released before its interval", got)
+	default:
+	}
+	clock.Advance(time.Second)
+	if got := <-released; got != 2 {
+		t.Fatalf("request %d released second", got)
+	}
+	if lq.Len() != 0 {
+		t.Fatalf("queue length %d after draining", lq.Len())
+	}
+}
+
+func TestLeakyQueueMaxWait(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	lq := NewLeakyQueue(10, time.Second, 1500*ms, WithClock(clock))
+
+	lq.Enqueue(context.Background())
+	go lq.Enqueue(context.Background())
+	for clock.Timers() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := lq.Enqueue(context.Background()); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("request due in 2s got %v, want ErrQueueTimeout", err)
+	}
+	clock.Advance(time.Second)
+}
+
+func TestLeakyQueueCanceledRequestGivesUpSlot(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	lq := NewLeakyQueue(1, time.Second, 0, WithClock(clock))
+	lq.Enqueue(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- lq.Enqueue(ctx) }()
+	for clock.Timers() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if lq.Len() != 0 {
+		t.Fatal("canceled request still holds its place in the queue")
+	}
+}
+
+func TestProxyHandlerSmoothsBursts(t *testing.T) {
+	var mutex sync.Mutex
+	var arrivals []time.Time
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		arrivals = append(arrivals, time.Now())
+		mutex.Unlock()
+	}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	SetRateLimiter("leaky_queue", 50, 3)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	codes := make(chan int, 6)
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	// One goes straight through, three queue and the rest find the queue full
+	if counts[http.StatusOK] != 4 || counts[http.StatusTooManyRequests] != 2 {
+		t.Fatalf("got status counts %v", counts)
+	}
+
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Before(arrivals[j]) })
+	for i := 1; i < len(arrivals); i++ {
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < 10*ms {
+			t.Errorf("requests %d and %d reached the backend %v apart, want ~20ms", i-1, i, gap)
+		}
+	}
+}
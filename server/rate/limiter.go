@@ -0,0 +1,221 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+var (
+	// ErrUnknownAlgorithm is returned for an algorithm name that isn't recognised
+	ErrUnknownAlgorithm = errors.New("rate: unknown algorithm")
+	// ErrInvalidParameter is wrapped by every ParamError
+	ErrInvalidParameter = errors.New("rate: invalid parameter")
+	// ErrStoreUnsupported is returned for an algorithm that can't keep its
+	// state in a Store
+	ErrStoreUnsupported = errors.New("rate: algorithm can't keep its state in a store")
+)
+
+// ParamError reports a parameter an algorithm can't work with
+type ParamError struct {
+	Algorithm string
+	Param     string
+	Value     any
+	Reason    string
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("rate: %s: %s %v %s", e.Algorithm, e.Param, e.Value, e.Reason)
+}
+
+func (e *ParamError) Unwrap() error {
+	return ErrInvalidParameter
+}
+
+// LimiterConfig describes a rate limiter by algorithm name and parameters.
+// Which parameters matter depends on the algorithm; see its Params.
+type LimiterConfig struct {
+	Algorithm string `json:"algorithm"`
+	// Rate is the sustained rate in requests per second, and may be
+	// fractional. The window algorithms instead allow Rate requests per
+	// Window, rounded down to at least one.
+	Rate float64 `json:"rate"`
+	// Burst is the capacity of the bucket algorithms, or the requests allowed
+	// in flight or queued by the concurrency, gradient and leaky_queue ones
+	Burst int `json:"burst"`
+	// Window is the window of the window algorithms; zero means one second
+	Window time.Duration `json:"-"`
+	// QueueSize is how many requests may wait for a slot with the in-flight
+	// algorithms
+	QueueSize int `json:"queue_size"`
+	// QueueTimeout is the longest a request may wait in a queue; zero waits
+	// until the client gives up
+	QueueTimeout time.Duration `json:"-"`
+	// Limits are the limits the composite algorithm enforces together
+	Limits []LimiterConfig `json:"limits"`
+	// Period is the hour, day or month the quota algorithm allows Burst
+	// requests in; empty means a day
+	Period string `json:"period"`
+	// Timezone is the IANA name of the timezone quota periods follow, such
+	// as Europe/Paris; empty means UTC
+	Timezone string `json:"timezone"`
+}
+
+// UnmarshalJSON reads a LimiterConfig written as for LoadLimiterConfig, with
+// its durations as strings such as "30s"
+func (c *LimiterConfig) UnmarshalJSON(data []byte) error {
+	// plain has LimiterConfig's fields without this method, which would
+	// otherwise call itself
+	type plain LimiterConfig
+	file := struct {
+		*plain
+		Window       string `json:"window"`
+		QueueTimeout string `json:"queue_timeout"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	for _, duration := range []struct {
+		name  string
+		text  string
+		value *time.Duration
+	}{
+		{"window", file.Window, &c.Window},
+		{"queue_timeout", file.QueueTimeout, &c.QueueTimeout},
+	} {
+		if duration.text == "" {
+			continue
+		}
+		var err error
+		if *duration.value, err = time.ParseDuration(duration.text); err != nil {
+			return fmt.Errorf("%s: %w", duration.name, err)
+		}
+	}
+	return nil
+}
+
+// LoadLimiterConfig reads a LimiterConfig from a JSON file such as
+//
+//	{
+//		"algorithm": "composite",
+//		"limits": [
+//			{"algorithm": "token_bucket", "rate": 10, "burst": 20},
+//			{"algorithm": "fixed_window", "rate": 500, "window": "1m"}
+//		]
+//	}
+//
+// and checks it with Validate, so that any registered algorithm can be
+// selected by name.
+func LoadLimiterConfig(path string) (LimiterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return LimiterConfig{}, err
+	}
+	var config LimiterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return LimiterConfig{}, fmt.Errorf("rate: %s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return LimiterConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// WindowLimit returns the requests the window algorithms allow per window,
+// which is Rate rounded down to at least one
+func (c LimiterConfig) WindowLimit() int {
+	switch {
+	case math.IsNaN(c.Rate) || c.Rate < 1:
+		return 1
+	case c.Rate > math.MaxInt32:
+		return math.MaxInt32
+	}
+	return int(c.Rate)
+}
+
+// QuotaPeriod returns the period and location of the quota algorithm
+func (c LimiterConfig) QuotaPeriod() (Period, *time.Location, error) {
+	period := PeriodDay
+	if c.Period != "" {
+		var err error
+		if period, err = ParsePeriod(c.Period); err != nil {
+			return 0, nil, &ParamError{c.Algorithm, "period", c.Period, "must be hour, day or month"}
+		}
+	}
+	location, err := loadLocation(c.Timezone)
+	if err != nil {
+		return 0, nil, &ParamError{c.Algorithm, "timezone", c.Timezone, "is not a known timezone"}
+	}
+	return period, location, nil
+}
+
+// Validate checks that the algorithm is registered and has the parameters it
+// needs
+func (c LimiterConfig) Validate() error {
+	algorithm, ok := LookupAlgorithm(c.Algorithm)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownAlgorithm, c.Algorithm)
+	}
+	for _, param := range algorithm.Params {
+		switch {
+		case param == ParamRate && (math.IsNaN(c.Rate) || math.IsInf(c.Rate, 0) || c.Rate <= 0):
+			if algorithm.windowed() {
+				return &ParamError{c.Algorithm, string(param), c.Rate, "must be a positive number of requests per window"}
+			}
+			return &ParamError{c.Algorithm, string(param), c.Rate, "must be a positive number of requests per second"}
+		case param == ParamBurst && c.Burst < 1:
+			return &ParamError{c.Algorithm, string(param), c.Burst, "must be at least 1"}
+		case param == ParamWindow && c.Window < 0:
+			return &ParamError{c.Algorithm, string(param), c.Window, "must not be negative"}
+		}
+	}
+	if c.QueueSize < 0 {
+		return &ParamError{c.Algorithm, "queue size", c.QueueSize, "must not be negative"}
+	}
+	if c.QueueTimeout < 0 {
+		return &ParamError{c.Algorithm, "queue timeout", c.QueueTimeout, "must not be negative"}
+	}
+	if algorithm.Validate != nil {
+		return algorithm.Validate(c)
+	}
+	return nil
+}
+
+// resolve validates the config and fills in the default window
+func (c LimiterConfig) resolve() (Algorithm, LimiterConfig, error) {
+	if err := c.Validate(); err != nil {
+		return Algorithm{}, c, err
+	}
+	if c.Window == 0 {
+		c.Window = time.Second
+	}
+	algorithm, _ := LookupAlgorithm(c.Algorithm)
+	return algorithm, c, nil
+}
+
+// NewLimiter creates the rate limiter config describes, or returns why it
+// can't. Algorithms that only limit requests in flight or queue them, such
+// as concurrency and leaky_queue, get a NoRateLimiter.
+func NewLimiter(config LimiterConfig, opts ...Option) (RateLimiter, error) {
+	algorithm, config, err := config.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return algorithm.New(config, opts...), nil
+}
+
+// NewStoreLimiter creates the rate limiter config describes with its state
+// kept in store under key, for the algorithms that support it
+func NewStoreLimiter(store Store, key string, config LimiterConfig, opts ...Option) (RateLimiter, error) {
+	algorithm, config, err := config.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if algorithm.NewStore == nil {
+		return nil, fmt.Errorf("%w: %s", ErrStoreUnsupported, config.Algorithm)
+	}
+	return algorithm.NewStore(store, key, config, opts...), nil
+}
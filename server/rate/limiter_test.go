@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewLimiterValidates(t *testing.T) {
+	cases := []struct {
+		config LimiterConfig
+		param  string
+	}{
+		{LimiterConfig{Algorithm: "token_bucket", Rate: 0, Burst: 5}, "rate"},
+		{LimiterConfig{Algorithm: "gcra", Rate: -1, Burst: 5}, "rate"},
+		{LimiterConfig{Algorithm: "leaky_bucket", Rate: math.NaN(), Burst: 5}, "rate"},
+		{LimiterConfig{Algorithm: "token_bucket", Rate: math.Inf(1), Burst: 5}, "rate"},
+		{LimiterConfig{Algorithm: "token_bucket", Rate: 10, Burst: 0}, "burst"},
+		{LimiterConfig{Algorithm: "concurrency", Burst: -1}, "burst"},
+		{LimiterConfig{Algorithm: "fixed_window", Rate: 10, Window: -time.Second}, "window"},
+		{LimiterConfig{Algorithm: "concurrency", Burst: 4, QueueTimeout: -time.Second}, "queue timeout"},
+	}
+	for _, tc := range cases {
+		_, err := NewLimiter(tc.config)
+		var paramErr *ParamError
+		if !errors.As(err, &paramErr) || paramErr.Param != tc.param || !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("NewLimiter(%+v) = %v, want a ParamError for %s", tc.config, err, tc.param)
+		}
+	}
+
+	if _, err := NewLimiter(LimiterConfig{Algorithm: "token_buckets", Rate: 10, Burst: 5}); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("got %v, want ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestNewLimiterBuildsEachAlgorithm(t *testing.T) {
+	for _, algorithm := range []string{
+		"token_bucket", "leaky_bucket", "gcra", "sliding_window", "sliding_window_counter",
+		"fixed_window", "quota", "leaky_queue", "concurrency", "gradient", "no_rate_limit",
+	} {
+		limiter, err := NewLimiter(LimiterConfig{Algorithm: algorithm, Rate: 0.5, Burst: 1})
+		if err != nil || limiter == nil {
+			t.Fatalf("NewLimiter(%s): %v", algorithm, err)
+		}
+		// Even below one request per window, a window allows one
+		if !limiter.Allow() {
+			t.Fatalf("%s denied its first request", algorithm)
+		}
+	}
+}
+
+func TestWindowLimitIsRatePerWindow(t *testing.T) {
+	limiter, err := NewLimiter(LimiterConfig{Algorithm: "fixed_window", Rate: 10, Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := limiter.Decide(0); d.Limit != 10 {
+		t.Fatalf("a minute window allows %d, want 10 as given by rate", d.Limit)
+	}
+	if got := (LimiterConfig{Rate: 2.9}).WindowLimit(); got != 2 {
+		t.Fatalf("WindowLimit() = %d, want 2", got)
+	}
+}
+
+func TestLoadLimiterConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limiter.json")
+	os.WriteFile(path, []byte(`{
+		"algorithm": "composite",
+		"limits": [
+			{"algorithm": "token_bucket", "rate": 10, "burst": 20},
+			{"algorithm": "fixed_window", "rate": 500, "window": "1m"}
+		]
+	}`), 0o644)
+	config, err := LoadLimiterConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Algorithm != "composite" || len(config.Limits) != 2 ||
+		config.Limits[0].Rate != 10 || config.Limits[0].Burst != 20 ||
+		config.Limits[1].Window != time.Minute {
+		t.Fatalf("loaded %+v", config)
+	}
+	if _, err := NewLimiter(config); err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte(`{"algorithm": "concurrency", "burst": 4, "queue_timeout": "soon"}`), 0o644)
+	if _, err := LoadLimiterConfig(path); err == nil {
+		t.Fatal("LoadLimiterConfig accepted a bad queue timeout")
+	}
+	os.WriteFile(path, []byte(`{"algorithm": "token_bucket", "rate": 10}`), 0o644)
+	if _, err := LoadLimiterConfig(path); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("got %v, want the missing burst rejected", err)
+	}
+}
+
+func TestSetRateLimiterKeepsLimiterOnError(t *testing.T) {
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+	if err := SetRateLimiter("fixed_window", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	before := loadConfig().rateLimiter
+	if err := SetRateLimiter("token_bucket", 0, 1); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("got %v, want ErrInvalidParameter", err)
+	}
+	if err := SetRateLimiter("unknown", 1, 1); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("got %v, want ErrUnknownAlgorithm", err)
+	}
+	if loadConfig().rateLimiter != before {
+		t.Fatal("a failed SetRateLimiter replaced the limiter")
+	}
+}
+
+func TestSetLimiterConfigWhileServing(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	// Run with -race to catch requests reading a half-swapped configuration
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ProxyHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		algorithm := []string{"token_bucket", "concurrency", "leaky_queue"}[i%3]
+		if err := SetLimiterConfig(LimiterConfig{Algorithm: algorithm, Rate: 1000, Burst: 100}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+package server
+
+// Option configures optional behaviour of a limiter
+type Option func(*options)
+
+type options struct {
+	clock      Clock
+	failClosed bool
+}
+
+// WithClock makes a limiter read the time from clock instead of the wall clock
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithFailClosed makes a store-backed limiter deny requests when its store
+// can't be reached, rather than let them through
+func WithFailClosed() Option {
+	return func(o *options) {
+		o.failClosed = true
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{clock: RealClock}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
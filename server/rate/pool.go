@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoBackend is returned when every backend in a pool is ejected or
+// unhealthy
+var ErrNoBackend = errors.New("rate: no backend available")
+
+// Balancer decides which of a pool's backends a request goes to
+type Balancer int
+
+const (
+	// BalanceRoundRobin sends requests to each backend in turn
+	BalanceRoundRobin Balancer = iota
+	// BalanceLeastConn sends requests to the backend with the fewest in
+	// flight for its weight
+	BalanceLeastConn
+	// BalanceWeightedRandom picks backends at random in proportion to their
+	// weights
+	BalanceWeightedRandom
+)
+
+var balancerNames = []string{"round_robin", "least_conn", "weighted_random"}
+
+// ParseBalancer returns the Balancer called name
+func ParseBalancer(name string) (Balancer, error) {
+	for i, balancerName := range balancerNames {
+		if name == balancerName {
+			return Balancer(i), nil
+		}
+	}
+	return 0, fmt.Errorf("rate: unknown balancer %q", name)
+}
+
+func (b Balancer) String() string {
+	if b < 0 || int(b) >= len(balancerNames) {
+		return fmt.Sprintf("Balancer(%d)", int(b))
+	}
+	return balancerNames[b]
+}
+
+// MarshalText makes a Balancer its name in JSON
+func (b Balancer) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText reads a Balancer from its name in JSON
+func (b *Balancer) UnmarshalText(text []byte) error {
+	balancer, err := ParseBalancer(string(text))
+	if err != nil {
+		return err
+	}
+	*b = balancer
+	return nil
+}
+
+// BackendConfig describes one backend of a pool
+type BackendConfig struct {
+	URL string `json:"url"`
+	// Weight is the backend's share of requests relative to the others
+	// under least_conn and weighted_random; zero means one
+	Weight int `json:"weight,omitempty"`
+}
+
+// PoolConfig holds the parameters of a Pool
+type PoolConfig struct {
+	Backends []BackendConfig `json:"backends"`
+	Balancer Balancer        `json:"balancer"`
+	// MaxFailures is how many requests in a row may fail on a backend, with
+	// a 5xx response or no response at all, before it is ejected; zero
+	// never ejects
+	MaxFailures int `json:"max_failures"`
+	// EjectTime is how long an ejected backend is left out of the pool
+	EjectTime time.Duration `json:"-"`
+	// HealthCheck configures active checks of the backends
+	HealthCheck HealthCheckConfig `json:"health_check"`
+	// Transport is what requests and health checks are sent over, such as
+	// one from NewTransport; nil uses the shared default
+	Transport http.RoundTripper `json:"-"`
+}
+
+// DefaultPoolConfig returns a PoolConfig that balances round robin, ejects
+// a backend for 30 seconds after 5 failures in a row and has the default
+// health checks, which are off until given a path
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		Balancer:    BalanceRoundRobin,
+		MaxFailures: 5,
+		EjectTime:   30 * time.Second,
+		HealthCheck: DefaultHealthCheckConfig(),
+	}
+}
+
+// ParseBackends parses a comma-separated list of backend URLs, each
+// optionally followed by its weight, as in "http://a:8080=3,http://b:8080"
+func ParseBackends(spec string) ([]BackendConfig, error) {
+	var backends []BackendConfig
+	for _, part := range strings.Split(spec, ",") {
+		backend := BackendConfig{URL: strings.TrimSpace(part)}
+		if rawURL, weight, found := strings.Cut(backend.URL, "="); found {
+			var err error
+			if backend.Weight, err = strconv.Atoi(weight); err != nil || backend.Weight < 1 {
+				return nil, fmt.Errorf("rate: backend %q needs a positive weight", part)
+			}
+			backend.URL = rawURL
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// LoadPoolConfig reads a PoolConfig from a JSON file such as
+//
+//	{
+//		"backends": [{"url": "http://10.0.0.1:8080", "weight": 2}, {"url": "http://10.0.0.2:8080"}],
+//		"balancer": "least_conn",
+//		"max_failures": 3,
+//		"eject_time": "1m",
+//		"health_check": {"path": "/healthz", "interval": "5s", "timeout": "1s"}
+//	}
+//
+// Settings left out keep their DefaultPoolConfig values.
+func LoadPoolConfig(path string) (PoolConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return PoolConfig{}, err
+	}
+	config := DefaultPoolConfig()
+	// Durations are written as strings such as "30s"
+	file := struct {
+		*PoolConfig
+		EjectTime   string `json:"eject_time"`
+		HealthCheck struct {
+			*HealthCheckConfig
+			Interval string `json:"interval"`
+			Timeout  string `json:"timeout"`
+		} `json:"health_check"`
+	}{PoolConfig: &config}
+	file.HealthCheck.HealthCheckConfig = &config.HealthCheck
+	if err := json.Unmarshal(data, &file); err != nil {
+		return PoolConfig{}, fmt.Errorf("rate: %s: %w", path, err)
+	}
+	for _, duration := range []struct {
+		name  string
+		text  string
+		value *time.Duration
+	}{
+		{"eject_time", file.EjectTime, &config.EjectTime},
+		{"health_check.interval", file.HealthCheck.Interval, &config.HealthCheck.Interval},
+		{"health_check.timeout", file.HealthCheck.Timeout, &config.HealthCheck.Timeout},
+	} {
+		if duration.text == "" {
+			continue
+		}
+		if *duration.value, err = time.ParseDuration(duration.text); err != nil {
+			return PoolConfig{}, fmt.Errorf("rate: %s: %s: %w", path, duration.name, err)
+		}
+	}
+	return config, nil
+}
+
+// Backend is one server of a Pool
+type Backend struct {
+	URL    *url.URL
+	Weight int
+
+	proxy *httputil.ReverseProxy
+
+	active       atomic.Int64
+	failures     int
+	ejectedUntil time.Time
+	ejections    int64
+	requests     atomic.Int64
+
+	// The state of the active health checks; backends start out healthy
+	unhealthy    bool
+	checksPassed int
+	checksFailed int
+	lastCheck    time.Time
+	lastError    string
+}
+
+// BackendStats reports what a Pool has seen of one backend
+type BackendStats struct {
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	Active   int64  `json:"active"`
+	Requests int64  `json:"requests"`
+	// Failures is how many requests in a row have failed
+	Failures  int   `json:"failures"`
+	Ejected   bool  `json:"ejected"`
+	Ejections int64 `json:"ejections"`
+	// EjectedUntil is when an ejected backend rejoins the pool
+	EjectedUntil time.Time `json:"ejected_until"`
+	// Healthy is whether the backend passes its health checks
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Pool forwards requests to a set of backends chosen by its Balancer,
+// leaving out for a while any backend whose requests keep failing, and any
+// backend failing its health checks until it passes them again
+type Pool struct {
+	backends []*Backend
+	config   PoolConfig
+	client   *http.Client
+	next     atomic.Uint64
+	clock    Clock
+	mutex    sync.Mutex
+}
+
+// NewPool creates a new Pool, or returns why a backend can't be used
+func NewPool(config PoolConfig, opts ...Option) (*Pool, error) {
+	o := newOptions(opts)
+	if len(config.Backends) == 0 {
+		return nil, errors.New("rate: a pool needs at least one backend")
+	}
+	if config.HealthCheck.Path != "" && (config.HealthCheck.Interval <= 0 || config.HealthCheck.Timeout <= 0) {
+		return nil, errors.New("rate: health checks need a positive interval and timeout")
+	}
+	if config.HealthCheck.Path != "" && (config.HealthCheck.HealthyThreshold < 1 || config.HealthCheck.UnhealthyThreshold < 1) {
+		return nil, errors.New("rate: health check thresholds must be at least 1")
+	}
+	if config.Transport == nil {
+		config.Transport = defaultTransport
+	}
+	p := &Pool{config: config, client: &http.Client{Transport: config.Transport}, clock: o.clock}
+	for _, backendConfig := range config.Backends {
+		target, err := url.Parse(backendConfig.URL)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("rate: backend %q is not an absolute URL", backendConfig.URL)
+		}
+		if backendConfig.Weight < 0 {
+			return nil, fmt.Errorf("rate: backend %q has a negative weight", backendConfig.URL)
+		}
+		weight := backendConfig.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		p.backends = append(p.backends, &Backend{URL: target, Weight: weight, proxy: p.newProxy(target)})
+	}
+	return p, nil
+}
+
+// Next chooses the backend for a request, or returns ErrNoBackend if every
+// backend is ejected or unhealthy
+func (p *Pool) Next() (*Backend, error) {
+	available := p.available()
+	if len(available) == 0 {
+		return nil, ErrNoBackend
+	}
+
+	switch p.config.Balancer {
+	case BalanceLeastConn:
+		// Start from a rotating backend so ties are spread out
+		start := int(p.next.Add(1) % uint64(len(available)))
+		best := available[start]
+		for i := 1; i < len(available); i++ {
+			backend := available[(start+i)%len(available)]
+			if backend.active.Load()*int64(best.Weight) < best.active.Load()*int64(backend.Weight) {
+				best = backend
+			}
+		}
+		return best, nil
+	case BalanceWeightedRandom:
+		total := 0
+		for _, backend := range available {
+			total += backend.Weight
+		}
+		pick := rand.Intn(total)
+		for _, backend := range available {
+			if pick -= backend.Weight; pick < 0 {
+				return backend, nil
+			}
+		}
+		return available[len(available)-1], nil
+	default:
+		return available[(p.next.Add(1)-1)%uint64(len(available))], nil
+	}
+}
+
+// available returns the backends that are healthy and aren't ejected
+func (p *Pool) available() []*Backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	available := make([]*Backend, 0, len(p.backends))
+	for _, backend := range p.backends {
+		if !backend.unhealthy && !now.Before(backend.ejectedUntil) {
+			available = append(available, backend)
+		}
+	}
+	return available
+}
+
+// report records how a request to backend went, ejecting it after
+// MaxFailures failures in a row
+func (p *Pool) report(backend *Backend, failed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !failed {
+		backend.failures = 0
+		return
+	}
+	backend.failures++
+	if p.config.MaxFailures > 0 && backend.failures >= p.config.MaxFailures {
+		backend.ejectedUntil = p.clock.Now().Add(p.config.EjectTime)
+		backend.failures = 0
+		backend.ejections++
+	}
+}
+
+// ServeHTTP forwards the request to the next backend. If every backend is
+// ejected or unhealthy the client gets a 503.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend, err := p.Next()
+	if err != nil {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	backend.active.Add(1)
+	defer backend.active.Add(-1)
+	backend.requests.Add(1)
+
+	failed := false
+	backend.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyFailedKey{}, &failed)))
+	// A client that went away says nothing about the backend either way
+	if r.Context().Err() == nil {
+		p.report(backend, failed)
+	}
+}
+
+// proxyFailedKey is the context key of the flag a backend's proxy sets when
+// a request fails, so that one proxy can be shared by every request
+type proxyFailedKey struct{}
+
+func setProxyFailed(r *http.Request, failed bool) {
+	if flag, ok := r.Context().Value(proxyFailedKey{}).(*bool); ok {
+		*flag = failed
+	}
+}
+
+// newProxy builds the proxy for a backend, noting 5xx responses and
+// requests the backend didn't answer as failures. Requests the client
+// cancelled aren't the backend's fault.
+func (p *Pool) newProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := NewReverseProxy(target, p.config.Transport)
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		setProxyFailed(resp.Request, resp.StatusCode >= http.StatusInternalServerError)
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		setProxyFailed(r, r.Context().Err() == nil && !errors.Is(err, context.Canceled))
+		proxyError(w, r, err)
+	}
+	return proxy
+}
+
+// Backends reports what the pool has seen of each backend
+func (p *Pool) Backends() []BackendStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := p.clock.Now()
+	stats := make([]BackendStats, len(p.backends))
+	for i, backend := range p.backends {
+		stats[i] = BackendStats{
+			URL:       backend.URL.String(),
+			Weight:    backend.Weight,
+			Active:    backend.active.Load(),
+			Requests:  backend.requests.Load(),
+			Failures:  backend.failures,
+			Ejected:   now.Before(backend.ejectedUntil),
+			Ejections: backend.ejections,
+			Healthy:   !backend.unhealthy,
+			LastCheck: backend.lastCheck,
+			LastError: backend.lastError,
+		}
+		if stats[i].Ejected {
+			stats[i].EjectedUntil = backend.ejectedUntil
+		}
+	}
+	return stats
+}
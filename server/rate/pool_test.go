@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newBackends starts n backends that answer with their index in a header
+func newBackends(t *testing.T, n int) []*httptest.Server {
+	backends := make([]*httptest.Server, n)
+	for i := range backends {
+		name := string(rune('a' + i))
+		backends[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", name)
+		}))
+		t.Cleanup(backends[i].Close)
+	}
+	return backends
+}
+
+func newTestPool(t *testing.T, config PoolConfig, backends []*httptest.Server, opts ...Option) *Pool {
+	for _, backend := range backends {
+		config.Backends = append(config.Backends, BackendConfig{URL: backend.URL})
+	}
+	pool, err := NewPool(config, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// served sends a request through handler and returns the backend that answered
+func served(handler http.Handler) (string, int) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Header().Get("X-Backend"), rec.Code
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := newTestPool(t, DefaultPoolConfig(), newBackends(t, 3))
+	var order string
+	for i := 0; i < 6; i++ {
+		backend, _ := served(pool)
+		order += backend
+	}
+	if order != "abcabc" {
+		t.Fatalf("requests went to %s, want abcabc", order)
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	config := DefaultPoolConfig()
+	config.Balancer = BalanceLeastConn
+	pool := newTestPool(t, config, newBackends(t, 3))
+	pool.backends[0].active.Add(2)
+	pool.backends[2].active.Add(1)
+	for i := 0; i < 3; i++ {
+		if backend, _ := pool.Next(); backend != pool.backends[1] {
+			t.Fatalf("picked %v, want the idle backend", backend.URL)
+		}
+	}
+
+	// A backend with twice the weight may have twice the requests in flight
+	pool.backends[1].Weight = 2
+	pool.backends[1].active.Add(3)
+	if backend, _ := pool.Next(); backend != pool.backends[2] {
+		t.Fatalf("picked %v, want the least loaded for its weight", backend.URL)
+	}
+}
+
+func TestPoolWeightedRandom(t *testing.T) {
+	pool, err := NewPool(PoolConfig{
+		Balancer: BalanceWeightedRandom,
+		Backends: []BackendConfig{{URL: "http://a.test"}, {URL: "http://b.test", Weight: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	picks := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		backend, _ := pool.Next()
+		picks[backend.URL.Host]++
+	}
+	if picks["b.test"] < 2700 || picks["b.test"] > 3300 {
+		t.Fatalf("b picked %d times in 4000, want about 3000", picks["b.test"])
+	}
+}
+
+func TestPoolEjectsFailingBackend(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	healthy := newBackends(t, 1)[0]
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	config := DefaultPoolConfig()
+	config.MaxFailures = 2
+	config.EjectTime = time.Minute
+	pool := newTestPool(t, config, []*httptest.Server{healthy, failing, gone}, WithClock(clock))
+
+	codes := map[int]int{}
+	for i := 0; i < 6; i++ {
+		_, code := served(pool)
+		codes[code]++
+	}
+	if codes[http.StatusInternalServerError] != 2 || codes[http.StatusBadGateway] != 2 {
+		t.Fatalf("got %v, want each failing backend tried until ejected", codes)
+	}
+	stats := pool.Backends()
+	if stats[0].Ejected || !stats[1].Ejected || !stats[2].Ejected || stats[1].Ejections != 1 {
+		t.Fatalf("got %+v, want both failing backends ejected", stats)
+	}
+	for i := 0; i < 3; i++ {
+		if backend, code := served(pool); backend != "a" || code != http.StatusOK {
+			t.Fatalf("request went to %q with %d, want only the healthy backend", backend, code)
+		}
+	}
+
+	clock.Advance(time.Minute)
+	if stats := pool.Backends(); stats[1].Ejected {
+		t.Fatal("backend still ejected after the eject time")
+	}
+}
+
+func TestPoolIgnoresCancelledRequests(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	config := DefaultPoolConfig()
+	config.MaxFailures = 1
+	pool := newTestPool(t, config, []*httptest.Server{slow})
+
+	// The client gives up before the backend answers
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if stats := pool.Backends(); stats[0].Ejected || stats[0].Failures != 0 {
+		t.Fatalf("got %+v, want a cancelled request not counted against the backend", stats[0])
+	}
+	if _, err := pool.Next(); err != nil {
+		t.Fatalf("Next() = %v after a cancelled request", err)
+	}
+}
+
+func TestPoolWithoutBackends(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+	config := DefaultPoolConfig()
+	config.MaxFailures = 1
+	pool := newTestPool(t, config, []*httptest.Server{gone}, WithClock(clock))
+
+	served(pool)
+	if _, code := served(pool); code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d with every backend ejected, want 503", code)
+	}
+	if _, err := NewPool(DefaultPoolConfig()); err == nil {
+		t.Fatal("NewPool accepted a pool without backends")
+	}
+}
+
+func TestPoolConfig(t *testing.T) {
+	backends, err := ParseBackends("http://a:8080=3, http://b:8080")
+	if err != nil || len(backends) != 2 || backends[0] != (BackendConfig{"http://a:8080", 3}) || backends[1] != (BackendConfig{"http://b:8080", 0}) {
+		t.Fatalf("got %+v, %v", backends, err)
+	}
+	if _, err := ParseBackends("http://a:8080=0"); err == nil {
+		t.Fatal("ParseBackends accepted a zero weight")
+	}
+
+	path := filepath.Join(t.TempDir(), "backends.json")
+	os.WriteFile(path, []byte(`{
+		"backends": [{"url": "http://a:8080", "weight": 2}, {"url": "http://b:8080"}],
+		"balancer": "least_conn",
+		"eject_time": "1m"
+	}`), 0o644)
+	config, err := LoadPoolConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Backends) != 2 || config.Backends[0].Weight != 2 || config.Balancer != BalanceLeastConn ||
+		config.EjectTime != time.Minute || config.MaxFailures != DefaultPoolConfig().MaxFailures {
+		t.Fatalf("loaded %+v", config)
+	}
+
+	os.WriteFile(path, []byte(`{"balancer": "fastest"}`), 0o644)
+	if _, err := LoadPoolConfig(path); err == nil {
+		t.Fatal("LoadPoolConfig accepted an unknown balancer")
+	}
+}
+
+func TestProxyHandlerUsesBackendPool(t *testing.T) {
+	SetRateLimiter("no_rate_limit", 0, 0)
+	SetBackendPool(newTestPool(t, DefaultPoolConfig(), newBackends(t, 2)))
+	defer SetBackendPool(nil)
+
+	first, _ := served(http.HandlerFunc(ProxyHandler))
+	second, _ := served(http.HandlerFunc(ProxyHandler))
+	if first+second != "ab" {
+		t.Fatalf("requests went to %s and %s, want each backend in turn", first, second)
+	}
+}
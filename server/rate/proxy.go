@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// TransportConfig holds the parameters of the transport requests are
+// forwarded to backends with
+type TransportConfig struct {
+	// DialTimeout bounds connecting to a backend
+	DialTimeout time.Duration
+	// KeepAlive is the interval between TCP keep-alive probes
+	KeepAlive time.Duration
+	// MaxIdleConns caps the idle connections kept across every backend
+	MaxIdleConns int
+	// MaxIdleConnsPerHost caps the idle connections kept to each backend;
+	// it should cover the requests in flight to one backend at a time
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept
+	IdleConnTimeout time.Duration
+	// TLSHandshakeTimeout bounds the TLS handshake with an https backend
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout bounds the wait for a backend's response
+	// headers, past which the client gets a 504; zero waits as long as the
+	// client does
+	ResponseHeaderTimeout time.Duration
+	// UnencryptedHTTP2 speaks HTTP/2 without TLS, known as h2c, to http
+	// backends. Every backend must then speak HTTP/2, as there is no
+	// falling back to HTTP/1.1.
+	UnencryptedHTTP2 bool
+}
+
+// DefaultTransportConfig returns a TransportConfig that keeps up to 128 idle
+// connections to each backend and gives backends 30 seconds to respond
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		DialTimeout:           5 * time.Second,
+		KeepAlive:             30 * time.Second,
+		MaxIdleConns:          1024,
+		MaxIdleConnsPerHost:   128,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+}
+
+// NewTransport creates a transport for forwarding requests to backends.
+// https backends are spoken to over HTTP/2 where they support it, and http
+// ones over HTTP/1.1 unless config asks for h2c.
+func NewTransport(config TransportConfig) *http.Transport {
+	dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: config.KeepAlive}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if config.UnencryptedHTTP2 {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return transport
+}
+
+// defaultTransport is shared by the proxies that aren't given a transport,
+// so that they share its connections
+var defaultTransport = NewTransport(DefaultTransportConfig())
+
+// NewReverseProxy creates a proxy forwarding requests to target over
+// transport, or the shared default transport if it is nil. A backend that
+// can't be reached gets the client a 502, and one that doesn't answer in
+// time a 504. The proxy is meant to be built once and reused, so that
+// connections to the backend are kept alive between requests.
+func NewReverseProxy(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	if transport == nil {
+		transport = defaultTransport
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.ErrorHandler = proxyError
+	return proxy
+}
+
+// proxyError answers a request the backend failed with a 504 if it timed
+// out and a 502 otherwise
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := proxyErrorStatus(err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+func proxyErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyHandlerErrorStatus(t *testing.T) {
+	SetRateLimiter("no_rate_limit", 0, 0)
+	config := DefaultTransportConfig()
+	config.ResponseHeaderTimeout = 20 * time.Millisecond
+	SetTransport(NewTransport(config))
+	defer SetTransport(nil)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	for _, tc := range []struct {
+		name    string
+		backend string
+		want    int
+	}{
+		{"unreachable", gone.URL, http.StatusBadGateway},
+		{"slow", slow.URL, http.StatusGatewayTimeout},
+	} {
+		SetBackendURL(tc.backend)
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s backend: got %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestProxyHandlerReusesConnections(t *testing.T) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	SetRateLimiter("no_rate_limit", 0, 0)
+	SetTransport(NewTransport(DefaultTransportConfig()))
+	defer SetTransport(nil)
+	SetBackendURL(backend.URL)
+
+	for i := 0; i < 20; i++ {
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d got %d", i+1, rec.Code)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("backend saw %d connections for 20 requests in a row, want 1", n)
+	}
+}
+
+func TestNewTransportSpeaksH2C(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	for _, tc := range []struct {
+		h2c  bool
+		want string
+	}{
+		{false, "HTTP/1.1"},
+		{true, "HTTP/2.0"},
+	} {
+		config := DefaultTransportConfig()
+		config.UnencryptedHTTP2 = tc.h2c
+		rec := httptest.NewRecorder()
+		NewReverseProxy(target, NewTransport(config)).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if got := rec.Body.String(); got != tc.want {
+			t.Errorf("UnencryptedHTTP2 %v: backend saw %q, want %q", tc.h2c, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkProxy compares building a proxy for every request, as
+// ProxyHandler used to, with sharing one over a tuned transport. Requests run
+// in parallel, so the per-request proxies churn through connections beyond
+// the two idle ones http.DefaultTransport keeps per host.
+func BenchmarkProxy(b *testing.B) {
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	serve := func(b *testing.B, handler func() http.Handler) {
+		b.ReportAllocs()
+		b.SetParallelism(8)
+		conns.Store(0)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				rec := httptest.NewRecorder()
+				handler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				if rec.Code != http.StatusOK {
+					b.Errorf("got %d", rec.Code)
+				}
+			}
+		})
+		b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+	}
+
+	b.Run("per_request", func(b *testing.B) {
+		serve(b, func() http.Handler {
+			return httputil.NewSingleHostReverseProxy(target)
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		proxy := NewReverseProxy(target, NewTransport(DefaultTransportConfig()))
+		serve(b, func() http.Handler { return proxy })
+	})
+}
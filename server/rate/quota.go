@@ -0,0 +1,481 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Period is the calendar period a Quota resets on
+type Period int
+
+const (
+	// PeriodHour resets at the start of every hour
+	PeriodHour Period = iota
+	// PeriodDay resets at midnight
+	PeriodDay
+	// PeriodMonth resets at midnight on the first of the month
+	PeriodMonth
+)
+
+var periodNames = []string{"hour", "day", "month"}
+
+// ParsePeriod returns the Period called name
+func ParsePeriod(name string) (Period, error) {
+	for i, periodName := range periodNames {
+		if name == periodName {
+			return Period(i), nil
+		}
+	}
+	return 0, fmt.Errorf("rate: unknown period %q", name)
+}
+
+func (p Period) String() string {
+	if p < 0 || int(p) >= len(periodNames) {
+		return fmt.Sprintf("Period(%d)", int(p))
+	}
+	return periodNames[p]
+}
+
+// Start returns the start of the period containing t, in location
+func (p Period) Start(t time.Time, location *time.Location) time.Time {
+	t = t.In(location)
+	switch p {
+	case PeriodHour:
+		// Not t.Truncate, which is aligned to UTC rather than location
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case PeriodMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	}
+}
+
+// Next returns the start of the period after the one starting at start
+func (p Period) Next(start time.Time) time.Time {
+	switch p {
+	case PeriodHour:
+		return start.Add(time.Hour)
+	case PeriodMonth:
+		return time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, start.Location())
+	default:
+		return time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, start.Location())
+	}
+}
+
+var locations sync.Map
+
+// loadLocation is time.LoadLocation, remembering the locations it has loaded
+// so that creating a limiter per client doesn't read the zone database
+func loadLocation(name string) (*time.Location, error) {
+	if location, ok := locations.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, location)
+	return location, nil
+}
+
+// QuotaUsage reports how much of a quota has been used in the current period
+type QuotaUsage struct {
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	Period    string    `json:"period"`
+	Start     time.Time `json:"period_start"`
+	Reset     time.Time `json:"reset"`
+}
+
+// QuotaReporter is implemented by limiters that can report their usage
+type QuotaReporter interface {
+	Usage() QuotaUsage
+}
+
+// Quotas returns the usage of limiter if it is a QuotaReporter, or of the
+// quotas among its limits if it is a Composite
+func Quotas(limiter RateLimiter) []QuotaUsage {
+	switch limiter := limiter.(type) {
+	case QuotaReporter:
+		return []QuotaUsage{limiter.Usage()}
+	case *Composite:
+		var usage []QuotaUsage
+		for _, limit := range limiter.Limiters() {
+			usage = append(usage, Quotas(limit)...)
+		}
+		return usage
+	}
+	return nil
+}
+
+// UsageHandler returns a handler that reports the quotas of the requesting
+// key as JSON, for clients on a plan to check what they have left
+func UsageHandler(kl *KeyedLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter, err := kl.LimiterFor(r)
+		if err != nil {
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		usage := Quotas(limiter)
+		if usage == nil {
+			usage = []QuotaUsage{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Quotas []QuotaUsage `json:"quotas"`
+		}{usage})
+	})
+}
+
+// Quota struct for a quota of requests per calendar period, such as 10000 a
+// day, resetting at the start of each period in its location rather than a
+// window after the first request. reserved holds counts claimed in later
+// periods.
+type Quota struct {
+	limit    int
+	period   Period
+	location *time.Location
+	used     int
+	reserved []int
+	start    time.Time
+	clock    Clock
+	mutex    sync.Mutex
+}
+
+// NewQuota creates a new Quota of limit requests per period in location; a
+// nil location means UTC
+func NewQuota(limit int, period Period, location *time.Location, opts ...Option) *Quota {
+	o := newOptions(opts)
+	if location == nil {
+		location = time.UTC
+	}
+	return &Quota{
+		limit:    limit,
+		period:   period,
+		location: location,
+		start:    period.Start(o.clock.Now(), location),
+		clock:    o.clock,
+	}
+}
+
+// Allow checks if a request can proceed within the quota
+func (q *Quota) Allow() bool {
+	return q.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed within the quota
+func (q *Quota) AllowN(n int) bool {
+	return q.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports what is left of the
+// period's quota
+func (q *Quota) Decide(n int) Decision {
+	n = max(0, n)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := q.clock.Now()
+	q.advance(now)
+
+	d := Decision{Limit: q.limit}
+	if q.used+n <= q.limit {
+		q.used += n
+		d.Allowed = true
+	} else if n > q.limit {
+		d.RetryAfter = InfDuration
+	} else {
+		d.RetryAfter = until(now, q.periodAt(q.openPeriod(n)))
+	}
+	d.Remaining = q.limit - q.used
+	d.Reset = until(now, q.periodAt(1))
+	return d
+}
+
+// Reserve claims a request in the first period with room for it
+func (q *Quota) Reserve() *Reservation {
+	return NewReservation(q, q.clock, 1)
+}
+
+// Wait blocks until a period has room for a request or ctx is done
+func (q *Quota) Wait(ctx context.Context) error {
+	return WaitN(ctx, q, q.clock, 1)
+}
+
+// Usage reports what has been used of the current period's quota
+func (q *Quota) Usage() QuotaUsage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.advance(q.clock.Now())
+	return QuotaUsage{
+		Limit:     q.limit,
+		Used:      q.used,
+		Remaining: q.limit - q.used,
+		Period:    q.period.String(),
+		Start:     q.start,
+		Reset:     q.periodAt(1),
+	}
+}
+
+// advance moves the current period forward until it contains now
+func (q *Quota) advance(now time.Time) {
+	next := q.period.Next(q.start)
+	if now.Before(next) {
+		return
+	}
+	if len(q.reserved) == 0 {
+		q.start, q.used = q.period.Start(now, q.location), 0
+		return
+	}
+
+	// Step through the periods, carrying over anything reserved for them
+	for !now.Before(next) {
+		q.start, next = next, q.period.Next(next)
+		q.used = 0
+		if len(q.reserved) > 0 {
+			q.used, q.reserved = q.reserved[0], q.reserved[1:]
+		}
+	}
+}
+
+// openPeriod returns the index of the first period after the current one
+// with room for n more requests
+func (q *Quota) openPeriod(n int) int {
+	for i, used := range q.reserved {
+		if used+n <= q.limit {
+			return i + 1
+		}
+	}
+	return len(q.reserved) + 1
+}
+
+// periodAt returns the start of the i'th period after the current one
+func (q *Quota) periodAt(i int) time.Time {
+	start := q.start
+	for ; i > 0; i-- {
+		start = q.period.Next(start)
+	}
+	return start
+}
+
+// ReserveN charges n requests to the first period from now with quota
+// left for them, and returns when it starts
+func (q *Quota) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if n > q.limit {
+		return time.Time{}, false
+	}
+	q.advance(now)
+
+	if q.used+n <= q.limit {
+		q.used += n
+		return now, true
+	}
+	i := q.openPeriod(n)
+	for len(q.reserved) < i {
+		q.reserved = append(q.reserved, 0)
+	}
+	q.reserved[i-1] += n
+	return q.periodAt(i), true
+}
+
+// CancelN hands n requests back to the period at falls in
+func (q *Quota) CancelN(now, at time.Time, n int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.advance(now)
+	if at.Before(q.start) {
+		return
+	}
+	i := 0
+	for start := q.period.Next(q.start); !at.Before(start); start = q.period.Next(start) {
+		i++
+	}
+	if i == 0 {
+		q.used = max(0, q.used-n)
+	} else if i <= len(q.reserved) {
+		q.reserved[i-1] = max(0, q.reserved[i-1]-n)
+	}
+}
+
+// quotaGrace is how long a StoreQuota's counter is kept past the end of its
+// period, so that instances whose clocks lag still find it
+const quotaGrace = time.Hour
+
+// StoreQuota struct for a calendar quota counted in a Store, shared by every
+// instance using the same store and key, each period with its own counter.
+// As with StoreFixedWindow a request is counted before it is checked and
+// handed back if denied.
+type StoreQuota struct {
+	store      Store
+	key        string
+	limit      int
+	period     Period
+	location   *time.Location
+	failClosed bool
+	clock      Clock
+}
+
+// NewStoreQuota creates a new StoreQuota of limit requests per period in
+// location; a nil location means UTC
+func NewStoreQuota(store Store, key string, limit int, period Period, location *time.Location, opts ...Option) *StoreQuota {
+	o := newOptions(opts)
+	if location == nil {
+		location = time.UTC
+	}
+	return &StoreQuota{
+		store:      store,
+		key:        key,
+		limit:      limit,
+		period:     period,
+		location:   location,
+		failClosed: o.failClosed,
+		clock:      o.clock,
+	}
+}
+
+// Allow checks if a request can proceed within the shared quota
+func (sq *StoreQuota) Allow() bool {
+	return sq.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed within the shared quota
+func (sq *StoreQuota) AllowN(n int) bool {
+	return sq.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports what is left of the
+// period's quota. If the store fails the request is let through, or denied
+// WithFailClosed.
+func (sq *StoreQuota) Decide(n int) Decision {
+	d, err := sq.DecideContext(context.Background(), n)
+	if err != nil {
+		return storeFailure(sq.limit, sq.failClosed)
+	}
+	return d
+}
+
+// DecideContext is Decide, returning the store's error instead of failing
+// open or closed
+func (sq *StoreQuota) DecideContext(ctx context.Context, n int) (Decision, error) {
+	n = max(0, n)
+
+	now := sq.clock.Now()
+	start := sq.period.Start(now, sq.location)
+	next := sq.period.Next(start)
+
+	used, err := sq.incr(ctx, now, start, n)
+	if err != nil {
+		return Decision{}, err
+	}
+	d := Decision{Limit: sq.limit, Reset: until(now, next)}
+	if used <= sq.limit {
+		d.Allowed = true
+	} else {
+		if used, err = sq.incr(ctx, now, start, -n); err != nil {
+			return Decision{}, err
+		}
+		if n > sq.limit {
+			d.RetryAfter = InfDuration
+		} else {
+			d.RetryAfter = d.Reset
+		}
+	}
+	d.Remaining = max(0, sq.limit-used)
+	return d, nil
+}
+
+// Reserve claims a request, reporting how long until a period has room for it
+func (sq *StoreQuota) Reserve() *Reservation {
+	return NewReservation(sq, sq.clock, 1)
+}
+
+// Wait blocks until a period has room for a request or ctx is done
+func (sq *StoreQuota) Wait(ctx context.Context) error {
+	return WaitN(ctx, sq, sq.clock, 1)
+}
+
+// Usage reports what has been used of the current period's quota. If the
+// store fails nothing is reported as used.
+func (sq *StoreQuota) Usage() QuotaUsage {
+	usage, _ := sq.UsageContext(context.Background())
+	return usage
+}
+
+// UsageContext is Usage, returning the store's error
+func (sq *StoreQuota) UsageContext(ctx context.Context) (QuotaUsage, error) {
+	start := sq.period.Start(sq.clock.Now(), sq.location)
+	usage := QuotaUsage{
+		Limit:     sq.limit,
+		Remaining: sq.limit,
+		Period:    sq.period.String(),
+		Start:     start,
+		Reset:     sq.period.Next(start),
+	}
+	value, ok, err := sq.store.Get(ctx, sq.counter(start))
+	if err != nil || !ok {
+		return usage, err
+	}
+	if usage.Used, err = strconv.Atoi(value); err != nil {
+		return usage, err
+	}
+	usage.Remaining = max(0, sq.limit-usage.Used)
+	return usage, nil
+}
+
+func (sq *StoreQuota) counter(start time.Time) string {
+	return sq.key + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// incr adds n to the counter of the period starting at start
+func (sq *StoreQuota) incr(ctx context.Context, now, start time.Time, n int) (int, error) {
+	ttl := sq.period.Next(start).Sub(now) + quotaGrace
+	used, err := sq.store.Incr(ctx, sq.counter(start), int64(n), ttl)
+	return int(used), err
+}
+
+// ReserveN charges n requests in the store to the first period from now
+// with quota left for them, and returns when it starts
+func (sq *StoreQuota) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	if n > sq.limit {
+		return time.Time{}, false
+	}
+	ctx := context.Background()
+	for start := sq.period.Start(now, sq.location); ; start = sq.period.Next(start) {
+		used, err := sq.incr(ctx, now, start, n)
+		if err != nil {
+			return storeReserveFailure(sq.failClosed)
+		}
+		if used <= sq.limit {
+			if start.After(now) {
+				return start, true
+			}
+			return now, true
+		}
+		sq.incr(ctx, now, start, -n)
+	}
+}
+
+// CancelN hands n requests back to the stored period at falls in
+func (sq *StoreQuota) CancelN(now, at time.Time, n int) {
+	if at.IsZero() {
+		return
+	}
+	sq.incr(context.Background(), now, sq.period.Start(at, sq.location), -n)
+}
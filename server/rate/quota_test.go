@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone %s not available: %v", name, err)
+	}
+	return location
+}
+
+func TestPeriodBoundaries(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+	cases := []struct {
+		period      Period
+		t           time.Time
+		start, next time.Time
+	}{
+		// Kolkata is UTC+5:30, so its hours start on the half hour in UTC
+		{PeriodHour, time.Date(2024, 1, 1, 10, 10, 0, 0, time.UTC),
+			time.Date(2024, 1, 1, 9, 30, 0, 0, time.UTC), time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)},
+		// New York's day starts at 04:00 UTC in summer, and the day
+		// clocks go back is 25 hours long
+		{PeriodDay, time.Date(2024, 11, 3, 12, 0, 0, 0, newYork),
+			time.Date(2024, 11, 3, 4, 0, 0, 0, time.UTC), time.Date(2024, 11, 4, 5, 0, 0, 0, time.UTC)},
+		{PeriodMonth, time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC),
+			time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{PeriodMonth, time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC),
+			time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		location := time.UTC
+		if tc.period == PeriodHour {
+			location = kolkata
+		} else if tc.period == PeriodDay {
+			location = newYork
+		}
+		start := tc.period.Start(tc.t, location)
+		if !start.Equal(tc.start) {
+			t.Errorf("%s containing %v starts %v, want %v", tc.period, tc.t, start.UTC(), tc.start)
+		}
+		if next := tc.period.Next(start); !next.Equal(tc.next) {
+			t.Errorf("%s after %v starts %v, want %v", tc.period, start, next.UTC(), tc.next)
+		}
+	}
+
+	if _, err := ParsePeriod("week"); err == nil {
+		t.Error("ParsePeriod accepted week")
+	}
+}
+
+func TestQuotaResetsOnCalendarBoundary(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	// 23:00 in New York, an hour before the day's quota resets
+	clock := NewFakeClock(time.Date(2024, 3, 1, 23, 0, 0, 0, newYork))
+	q := NewQuota(3, PeriodDay, newYork, WithClock(clock))
+
+	if !q.AllowN(2) || !q.Allow() {
+		t.Fatal("requests within the quota denied")
+	}
+	if d := q.Decide(1); d.Allowed || d.RetryAfter != time.Hour || d.Reset != time.Hour {
+		t.Fatalf("got %+v, want denied until midnight", d)
+	}
+	usage := q.Usage()
+	want := QuotaUsage{Limit: 3, Used: 3, Remaining: 0, Period: "day",
+		Start: time.Date(2024, 3, 1, 0, 0, 0, 0, newYork), Reset: time.Date(2024, 3, 2, 0, 0, 0, 0, newYork)}
+	if usage.Limit != want.Limit || usage.Used != want.Used || usage.Period != want.Period ||
+		!usage.Start.Equal(want.Start) || !usage.Reset.Equal(want.Reset) {
+		t.Fatalf("usage %+v, want %+v", usage, want)
+	}
+
+	clock.Advance(time.Hour)
+	if d := q.Decide(1); !d.Allowed || d.Remaining != 2 || d.Reset != 24*time.Hour {
+		t.Fatalf("got %+v after midnight, want a fresh day", d)
+	}
+	// A month idle skips straight to the current day
+	clock.Advance(31 * 24 * time.Hour)
+	if usage := q.Usage(); usage.Used != 0 || !usage.Start.Equal(time.Date(2024, 4, 2, 0, 0, 0, 0, newYork)) {
+		t.Fatalf("usage %+v after a month, want the current day unused", usage)
+	}
+}
+
+func TestQuotaReservesNextPeriod(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	q := NewQuota(1, PeriodHour, nil, WithClock(clock))
+	q.Allow()
+
+	r := q.Reserve()
+	if !r.OK() || r.Delay() != time.Hour {
+		t.Fatalf("reservation delayed %v, want until the next hour", r.Delay())
+	}
+	r.Cancel()
+	clock.Advance(time.Hour)
+	if !q.Allow() {
+		t.Fatal("a cancelled reservation still held the next hour's quota")
+	}
+}
+
+func TestStoreQuotaSharesOneQuota(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	store := NewMemoryStore(WithClock(clock))
+	a := NewStoreQuota(store, "plan:alice", 3, PeriodMonth, nil, WithClock(clock))
+	b := NewStoreQuota(store, "plan:alice", 3, PeriodMonth, nil, WithClock(clock))
+
+	if !a.AllowN(2) || !b.Allow() || a.Allow() {
+		t.Fatal("instances didn't share a quota of 3")
+	}
+	if usage := b.Usage(); usage.Used != 3 || !usage.Reset.Equal(time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("usage %+v, want 3 used until February", usage)
+	}
+	clock.Advance(31 * 24 * time.Hour)
+	if d := b.Decide(1); !d.Allowed || d.Remaining != 2 {
+		t.Fatalf("got %+v in February, want a fresh quota", d)
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	kl := NewKeyedLimiter(ClientIP, func(string) RateLimiter {
+		configs, _ := ParseLimits("10/s,quota:100/day", "token_bucket")
+		limiter, _ := NewLimiter(LimiterConfig{Algorithm: "composite", Limits: configs})
+		return limiter
+	}, DefaultKeyedConfig())
+	limiter, _ := kl.Limiter("192.0.2.1")
+	limiter.AllowN(4)
+
+	r := httptest.NewRequest("GET", "/_limitly/usage", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	UsageHandler(kl).ServeHTTP(rec, r)
+
+	var body struct {
+		Quotas []QuotaUsage `json:"quotas"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Quotas) != 1 || body.Quotas[0].Used != 4 || body.Quotas[0].Remaining != 96 || body.Quotas[0].Period != "day" {
+		t.Fatalf("got %+v, want the daily quota with 4 used", body.Quotas)
+	}
+}
+
+func TestQuotaConfigValidates(t *testing.T) {
+	for _, config := range []LimiterConfig{
+		{Algorithm: "quota", Burst: 5, Period: "week"},
+		{Algorithm: "quota", Burst: 5, Timezone: "Mars/Olympus_Mons"},
+		{Algorithm: "quota", Burst: 0},
+	} {
+		if _, err := NewLimiter(config); !errors.Is(err, ErrInvalidParameter) {
+			t.Errorf("NewLimiter(%+v) = %v, want ErrInvalidParameter", config, err)
+		}
+	}
+	if _, err := ParseLimits("quota:5/week", ""); err == nil {
+		t.Error("ParseLimits accepted a quota per week")
+	}
+}
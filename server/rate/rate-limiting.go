@@ -1,6 +1,10 @@
 package server
 
 import (
+	"context"
+	"math"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,49 +17,211 @@ func (nrl *NoRateLimiter) Allow() bool {
 	return true
 }
 
-// RateLimiter interface defines the Allow method to be used by all algorithms
+// AllowN always returns true for NoRateLimiter
+func (nrl *NoRateLimiter) AllowN(n int) bool {
+	return true
+}
+
+// Decide always allows and reports no limit
+func (nrl *NoRateLimiter) Decide(n int) Decision {
+	return Decision{Allowed: true}
+}
+
+// Reserve returns a reservation that can act immediately
+func (nrl *NoRateLimiter) Reserve() *Reservation {
+	return NewReservation(nrl, RealClock, 1)
+}
+
+// Wait returns immediately unless ctx is already done
+func (nrl *NoRateLimiter) Wait(ctx context.Context) error {
+	return WaitN(ctx, nrl, RealClock, 1)
+}
+
+// ReserveN admits n requests now without keeping count
+func (nrl *NoRateLimiter) ReserveN(now time.Time, n int) (time.Time, bool) {
+	return now, true
+}
+
+// CancelN does nothing, as nothing was reserved
+func (nrl *NoRateLimiter) CancelN(now, at time.Time, n int) {}
+
+// RateLimiter interface defines the methods to be used by all algorithms
 type RateLimiter interface {
+	// Allow reports whether a single request may proceed now
 	Allow() bool
+	// AllowN reports whether n requests may proceed now. An n of zero or
+	// less takes nothing.
+	AllowN(n int) bool
+	// Decide is AllowN that also reports the quota left over. Deciding on
+	// no requests reports the quota without taking any.
+	Decide(n int) Decision
+	// Reserve claims a request and reports how long to wait before acting on it
+	Reserve() *Reservation
+	// Wait blocks until a request is admitted or ctx is done
+	Wait(ctx context.Context) error
 }
 
-// TokenBucket struct for token bucket algorithm
+// TokenBucket struct for token bucket algorithm. Tokens are tracked as a
+// fraction so that partial refill intervals carry over between requests.
 type TokenBucket struct {
 	capacity    int
-	tokens      int
-	refillRate  time.Duration
+	tokens      float64
+	rate        float64 // tokens added per second
 	lastRefill  time.Time
+	clock       Clock
 	refillMutex sync.Mutex
 }
 
-// NewTokenBucket creates a new TokenBucket
-func NewTokenBucket(capacity int, refillRate time.Duration) *TokenBucket {
+// NewTokenBucket creates a new TokenBucket that gains a token every refillRate
+func NewTokenBucket(capacity int, refillRate time.Duration, opts ...Option) *TokenBucket {
+	return NewTokenBucketRate(capacity, float64(time.Second)/float64(refillRate), opts...)
+}
+
+// NewTokenBucketRate creates a new TokenBucket that gains rate tokens per second
+func NewTokenBucketRate(capacity int, rate float64, opts ...Option) *TokenBucket {
+	o := newOptions(opts)
 	return &TokenBucket{
 		capacity:   capacity,
-		tokens:     capacity,
-		refillRate: refillRate,
-		lastRefill: time.Now(),
+		tokens:     float64(capacity),
+		rate:       rate,
+		lastRefill: o.clock.Now(),
+		clock:      o.clock,
 	}
 }
 
 // Allow checks if a request can proceed under token bucket algorithm
 func (tb *TokenBucket) Allow() bool {
+	return tb.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under token bucket algorithm
+func (tb *TokenBucket) AllowN(n int) bool {
+	return tb.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the tokens left
+func (tb *TokenBucket) Decide(n int) Decision {
+	n = max(0, n)
+
 	tb.refillMutex.Lock()
 	defer tb.refillMutex.Unlock()
 
-	now := time.Now()
+	now := tb.clock.Now()
+	tb.refill(now)
+
+	d := Decision{Limit: tb.capacity}
+	if tb.tokens >= float64(n) {
+		tb.tokens -= float64(n)
+		d.Allowed = true
+	} else if n > tb.capacity {
+		d.RetryAfter = InfDuration
+	} else {
+		d.RetryAfter = until(now, tb.refilledAt(float64(n)-tb.tokens))
+	}
+	d.Remaining = max(0, int(tb.tokens))
+	d.Reset = until(now, tb.refilledAt(float64(tb.capacity)-tb.tokens))
+	return d
+}
+
+// Reserve claims a token, borrowing against future refills if none are left
+func (tb *TokenBucket) Reserve() *Reservation {
+	return NewReservation(tb, tb.clock, 1)
+}
+
+// Wait blocks until a token is available or ctx is done
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	return WaitN(ctx, tb, tb.clock, 1)
+}
+
+// Rate returns the tokens added per second
+func (tb *TokenBucket) Rate() float64 {
+	tb.refillMutex.Lock()
+	defer tb.refillMutex.Unlock()
+	return tb.rate
+}
+
+// SetRate changes the tokens added per second from now on
+func (tb *TokenBucket) SetRate(rate float64) {
+	tb.refillMutex.Lock()
+	defer tb.refillMutex.Unlock()
+
+	tb.refill(tb.clock.Now())
+	tb.rate = rate
+}
+
+func (tb *TokenBucket) refill(now time.Time) {
 	elapsed := now.Sub(tb.lastRefill)
+	if elapsed <= 0 {
+		return
+	}
+
+	tb.tokens = math.Min(float64(tb.capacity), tb.tokens+elapsed.Seconds()*tb.rate)
+	tb.lastRefill = now
+}
+
+// refilledAt returns when the bucket will have gained the given number of tokens
+func (tb *TokenBucket) refilledAt(tokens float64) time.Time {
+	return tb.lastRefill.Add(durationFor(tokens, tb.rate))
+}
 
-	tokensToAdd := int(elapsed / tb.refillRate)
-	if tokensToAdd > 0 {
-		tb.tokens = min(tb.capacity, tb.tokens+tokensToAdd)
-		tb.lastRefill = now
+// ReserveN takes n tokens as of now, borrowing against future refills if
+// the bucket runs short, and returns when the debt is paid off
+func (tb *TokenBucket) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	tb.refillMutex.Lock()
+	defer tb.refillMutex.Unlock()
+
+	if n > tb.capacity {
+		return time.Time{}, false
 	}
+	tb.refill(now)
 
-	if tb.tokens > 0 {
-		tb.tokens--
-		return true
+	// Tokens may go negative; the debt is paid off by later refills
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return now, true
 	}
-	return false
+	return tb.refilledAt(-tb.tokens), true
+}
+
+// CancelN puts n tokens back, up to the bucket's capacity
+func (tb *TokenBucket) CancelN(now, at time.Time, n int) {
+	tb.refillMutex.Lock()
+	defer tb.refillMutex.Unlock()
+
+	tb.refill(now)
+	tb.tokens = math.Min(float64(tb.capacity), tb.tokens+float64(n))
+}
+
+// durationFor returns how long it takes to accumulate units at rate per
+// second, rounded up to the nanosecond and capped at InfDuration
+func durationFor(units, rate float64) time.Duration {
+	if units <= 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return InfDuration
+	}
+	nanos := math.Ceil(units / rate * float64(time.Second))
+	if nanos >= float64(InfDuration) {
+		return InfDuration
+	}
+	return time.Duration(nanos)
+}
+
+// windowLimit converts rate per second into a limit per window of at least one
+func windowLimit(rate float64, windowSize time.Duration) int {
+	return max(1, int(rate*windowSize.Seconds()))
+}
+
+// RateInterval returns the time between requests at rate per second, rounded
+// to the nanosecond but never zero
+func RateInterval(rate float64) time.Duration {
+	if interval := durationFor(1, rate); interval > 0 {
+		return interval
+	}
+	return 1
 }
 
 // LeakyBucket struct for leaky bucket algorithm
@@ -64,25 +230,83 @@ type LeakyBucket struct {
 	interval     time.Duration
 	lastLeakTime time.Time
 	currentCount int
+	clock        Clock
 	leakMutex    sync.Mutex
 }
 
 // NewLeakyBucket creates a new LeakyBucket
-func NewLeakyBucket(capacity int, interval time.Duration) *LeakyBucket {
+func NewLeakyBucket(capacity int, interval time.Duration, opts ...Option) *LeakyBucket {
+	o := newOptions(opts)
 	return &LeakyBucket{
 		capacity:     capacity,
 		interval:     interval,
-		lastLeakTime: time.Now(),
+		lastLeakTime: o.clock.Now(),
 		currentCount: 0,
+		clock:        o.clock,
 	}
 }
 
 // Allow checks if a request can proceed under leaky bucket algorithm
 func (lb *LeakyBucket) Allow() bool {
+	return lb.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under leaky bucket algorithm
+func (lb *LeakyBucket) AllowN(n int) bool {
+	return lb.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the room left in the bucket
+func (lb *LeakyBucket) Decide(n int) Decision {
+	n = max(0, n)
+
+	lb.leakMutex.Lock()
+	defer lb.leakMutex.Unlock()
+
+	now := lb.clock.Now()
+	lb.leak(now)
+
+	d := Decision{Limit: lb.capacity}
+	if lb.currentCount+n <= lb.capacity {
+		lb.currentCount += n
+		d.Allowed = true
+	} else if n > lb.capacity {
+		d.RetryAfter = InfDuration
+	} else {
+		d.RetryAfter = until(now, lb.leakedAt(lb.currentCount+n-lb.capacity))
+	}
+	d.Remaining = max(0, lb.capacity-lb.currentCount)
+	d.Reset = until(now, lb.leakedAt(lb.currentCount))
+	return d
+}
+
+// Reserve claims room in the bucket, reporting how long until it has leaked enough
+func (lb *LeakyBucket) Reserve() *Reservation {
+	return NewReservation(lb, lb.clock, 1)
+}
+
+// Wait blocks until the bucket has room or ctx is done
+func (lb *LeakyBucket) Wait(ctx context.Context) error {
+	return WaitN(ctx, lb, lb.clock, 1)
+}
+
+// Rate returns the requests leaked per second
+func (lb *LeakyBucket) Rate() float64 {
+	lb.leakMutex.Lock()
+	defer lb.leakMutex.Unlock()
+	return float64(time.Second) / float64(lb.interval)
+}
+
+// SetRate changes the requests leaked per second from now on
+func (lb *LeakyBucket) SetRate(rate float64) {
 	lb.leakMutex.Lock()
 	defer lb.leakMutex.Unlock()
 
-	now := time.Now()
+	lb.leak(lb.clock.Now())
+	lb.interval = RateInterval(rate)
+}
+
+func (lb *LeakyBucket) leak(now time.Time) {
 	elapsed := now.Sub(lb.lastLeakTime)
 
 	leaks := int(elapsed / lb.interval)
@@ -90,93 +314,346 @@ func (lb *LeakyBucket) Allow() bool {
 		lb.currentCount = max(0, lb.currentCount-leaks)
 		lb.lastLeakTime = now
 	}
+}
+
+// leakedAt returns when the given number of requests will have leaked out
+func (lb *LeakyBucket) leakedAt(count int) time.Time {
+	return lb.lastLeakTime.Add(time.Duration(count) * lb.interval)
+}
+
+// ReserveN adds n requests to the bucket as of now, overfilling it if need
+// be, and returns when enough has leaked for them
+func (lb *LeakyBucket) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	lb.leakMutex.Lock()
+	defer lb.leakMutex.Unlock()
+
+	if n > lb.capacity {
+		return time.Time{}, false
+	}
+	lb.leak(now)
 
-	if lb.currentCount < lb.capacity {
-		lb.currentCount++
-		return true
+	// The bucket may overfill; the excess is admitted once it has leaked away
+	lb.currentCount += n
+	if lb.currentCount <= lb.capacity {
+		return now, true
 	}
-	return false
+	return lb.leakedAt(lb.currentCount - lb.capacity), true
 }
 
-// SlidingWindow struct for the sliding window algorithm
+// CancelN takes n requests back out of the bucket
+func (lb *LeakyBucket) CancelN(now, at time.Time, n int) {
+	lb.leakMutex.Lock()
+	defer lb.leakMutex.Unlock()
+
+	lb.leak(now)
+	lb.currentCount = max(0, lb.currentCount-n)
+}
+
+// SlidingWindow struct for the sliding window algorithm. Timestamps are kept
+// sorted and may lie in the future for outstanding reservations.
 type SlidingWindow struct {
 	windowSize time.Duration
 	limit      int
 	timestamps []time.Time
+	clock      Clock
 	mutex      sync.Mutex
 }
 
 // NewSlidingWindow creates a new SlidingWindow instance
-func NewSlidingWindow(limit int, windowSize time.Duration) *SlidingWindow {
+func NewSlidingWindow(limit int, windowSize time.Duration, opts ...Option) *SlidingWindow {
+	o := newOptions(opts)
 	return &SlidingWindow{
 		windowSize: windowSize,
 		limit:      limit,
 		timestamps: make([]time.Time, 0, limit),
+		clock:      o.clock,
 	}
 }
 
 // Allow checks if a request can proceed under the sliding window algorithm
 func (sw *SlidingWindow) Allow() bool {
+	return sw.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the sliding window algorithm
+func (sw *SlidingWindow) AllowN(n int) bool {
+	return sw.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the slots left in the window
+func (sw *SlidingWindow) Decide(n int) Decision {
+	n = max(0, n)
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	now := sw.clock.Now()
+	sw.prune(now)
+
+	// Check if within limit
+	d := Decision{Limit: sw.limit}
+	if len(sw.timestamps)+n <= sw.limit {
+		sw.record(now, n)
+		d.Allowed = true
+	} else if n > sw.limit {
+		d.RetryAfter = InfDuration
+	} else {
+		d.RetryAfter = until(now, sw.openAt(n))
+	}
+	d.Remaining = max(0, sw.limit-len(sw.timestamps))
+	if len(sw.timestamps) > 0 {
+		d.Reset = until(now, sw.timestamps[len(sw.timestamps)-1].Add(sw.windowSize))
+	}
+	return d
+}
+
+// Reserve claims a slot in the window, reporting how long until it opens
+func (sw *SlidingWindow) Reserve() *Reservation {
+	return NewReservation(sw, sw.clock, 1)
+}
+
+// Wait blocks until a slot in the window opens or ctx is done
+func (sw *SlidingWindow) Wait(ctx context.Context) error {
+	return WaitN(ctx, sw, sw.clock, 1)
+}
+
+// Rate returns the limit spread over the window, in requests per second
+func (sw *SlidingWindow) Rate() float64 {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	return float64(sw.limit) / sw.windowSize.Seconds()
+}
+
+// SetRate changes the limit to rate requests per second over the window,
+// allowing at least one request per window
+func (sw *SlidingWindow) SetRate(rate float64) {
 	sw.mutex.Lock()
 	defer sw.mutex.Unlock()
+	sw.limit = windowLimit(rate, sw.windowSize)
+}
 
-	now := time.Now()
+// prune drops timestamps that have slid out of the window ending at now
+func (sw *SlidingWindow) prune(now time.Time) {
 	validWindowStart := now.Add(-sw.windowSize)
 
-	// Prune outdated timestamps
-	for len(sw.timestamps) > 0 && sw.timestamps[0].Before(validWindowStart) {
+	for len(sw.timestamps) > 0 && !sw.timestamps[0].After(validWindowStart) {
 		sw.timestamps = sw.timestamps[1:]
 	}
+}
 
-	// Check if within limit
-	if len(sw.timestamps) < sw.limit {
-		sw.timestamps = append(sw.timestamps, now)
-		return true
+// record inserts n copies of at, keeping timestamps sorted
+func (sw *SlidingWindow) record(at time.Time, n int) {
+	i := sort.Search(len(sw.timestamps), func(i int) bool {
+		return sw.timestamps[i].After(at)
+	})
+	sw.timestamps = slices.Insert(sw.timestamps, i, slices.Repeat([]time.Time{at}, n)...)
+}
+
+// ReserveN records n requests at the first time the window has room for
+// them, and returns that time
+func (sw *SlidingWindow) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if n > sw.limit {
+		return time.Time{}, false
 	}
+	sw.prune(now)
+
+	at := now
+	if len(sw.timestamps)+n > sw.limit {
+		at = sw.openAt(n)
+	}
+	sw.record(at, n)
+	return at, true
+}
+
+// openAt returns when enough of the oldest timestamps will have slid out of
+// the window to make room for n more
+func (sw *SlidingWindow) openAt(n int) time.Time {
+	excess := len(sw.timestamps) + n - sw.limit
+	return sw.timestamps[excess-1].Add(sw.windowSize)
+}
+
+// CancelN removes up to n requests recorded at at
+func (sw *SlidingWindow) CancelN(now, at time.Time, n int) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
 
-	return false
+	sw.prune(now)
+	i := sort.Search(len(sw.timestamps), func(i int) bool {
+		return !sw.timestamps[i].Before(at)
+	})
+	j := i
+	for j < len(sw.timestamps) && j-i < n && sw.timestamps[j].Equal(at) {
+		j++
+	}
+	sw.timestamps = slices.Delete(sw.timestamps, i, j)
 }
 
-// FixedWindow struct for the fixed window algorithm
+// FixedWindow struct for the fixed window algorithm. Windows follow each other
+// back to back from creation; reserved holds counts claimed in later windows.
 type FixedWindow struct {
 	windowSize  time.Duration
 	limit       int
 	count       int
+	reserved    []int
 	windowStart time.Time
+	clock       Clock
 	mutex       sync.Mutex
 }
 
 // NewFixedWindow creates a new FixedWindow instance
-func NewFixedWindow(limit int, windowSize time.Duration) *FixedWindow {
+func NewFixedWindow(limit int, windowSize time.Duration, opts ...Option) *FixedWindow {
+	o := newOptions(opts)
 	return &FixedWindow{
 		windowSize:  windowSize,
 		limit:       limit,
 		count:       0,
-		windowStart: time.Now(),
+		windowStart: o.clock.Now(),
+		clock:       o.clock,
 	}
 }
 
 // Allow checks if a request can proceed under the fixed window algorithm
 func (fw *FixedWindow) Allow() bool {
+	return fw.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the fixed window algorithm
+func (fw *FixedWindow) AllowN(n int) bool {
+	return fw.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports what is left of the window
+func (fw *FixedWindow) Decide(n int) Decision {
+	n = max(0, n)
+
 	fw.mutex.Lock()
 	defer fw.mutex.Unlock()
 
-	now := time.Now()
+	now := fw.clock.Now()
+	fw.advance(now)
 
-	// Check if we are still in the current window
-	if now.Sub(fw.windowStart) >= fw.windowSize {
-		// Reset the window
-		fw.windowStart = now
-		fw.count = 0
+	// Check if within limit
+	d := Decision{Limit: fw.limit}
+	if fw.count+n <= fw.limit {
+		fw.count += n
+		d.Allowed = true
+	} else if n > fw.limit {
+		d.RetryAfter = InfDuration
+	} else {
+		d.RetryAfter = until(now, fw.windowAt(fw.openWindow(n)))
 	}
+	d.Remaining = fw.limit - fw.count
+	d.Reset = until(now, fw.windowAt(1))
+	return d
+}
 
-	// Check if within limit
-	if fw.count < fw.limit {
-		fw.count++
-		return true
+// Reserve claims a request in the first window with room for it
+func (fw *FixedWindow) Reserve() *Reservation {
+	return NewReservation(fw, fw.clock, 1)
+}
+
+// Wait blocks until a window has room or ctx is done
+func (fw *FixedWindow) Wait(ctx context.Context) error {
+	return WaitN(ctx, fw, fw.clock, 1)
+}
+
+// Rate returns the limit spread over the window, in requests per second
+func (fw *FixedWindow) Rate() float64 {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return float64(fw.limit) / fw.windowSize.Seconds()
+}
+
+// SetRate changes the limit to rate requests per second over the window,
+// allowing at least one request per window
+func (fw *FixedWindow) SetRate(rate float64) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.limit = windowLimit(rate, fw.windowSize)
+}
+
+// advance moves the current window forward until it contains now
+func (fw *FixedWindow) advance(now time.Time) {
+	elapsed := now.Sub(fw.windowStart)
+	if elapsed < fw.windowSize {
+		return
+	}
+
+	// Reset the window, carrying over anything reserved for it
+	windows := int(elapsed / fw.windowSize)
+	fw.windowStart = fw.windowStart.Add(time.Duration(windows) * fw.windowSize)
+	fw.count = 0
+	if windows <= len(fw.reserved) {
+		fw.count = fw.reserved[windows-1]
+		fw.reserved = fw.reserved[windows:]
+	} else {
+		fw.reserved = nil
+	}
+}
+
+// ReserveN counts n requests in the first window from now with room for
+// them, and returns when it starts
+func (fw *FixedWindow) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	if n > fw.limit {
+		return time.Time{}, false
+	}
+	fw.advance(now)
+
+	if fw.count+n <= fw.limit {
+		fw.count += n
+		return now, true
+	}
+	i := fw.openWindow(n)
+	for len(fw.reserved) < i {
+		fw.reserved = append(fw.reserved, 0)
 	}
+	fw.reserved[i-1] += n
+	return fw.windowAt(i), true
+}
+
+// openWindow returns the index of the first window after the current one
+// with room for n more requests
+func (fw *FixedWindow) openWindow(n int) int {
+	for i, count := range fw.reserved {
+		if count+n <= fw.limit {
+			return i + 1
+		}
+	}
+	return len(fw.reserved) + 1
+}
+
+// windowAt returns the start of the i'th window after the current one
+func (fw *FixedWindow) windowAt(i int) time.Time {
+	return fw.windowStart.Add(time.Duration(i) * fw.windowSize)
+}
 
-	return false
+// CancelN takes n requests off the count of the window at falls in
+func (fw *FixedWindow) CancelN(now, at time.Time, n int) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+
+	fw.advance(now)
+	if at.Before(fw.windowStart) {
+		return
+	}
+	i := int(at.Sub(fw.windowStart) / fw.windowSize)
+	if i == 0 {
+		fw.count = max(0, fw.count-n)
+	} else if i <= len(fw.reserved) {
+		fw.reserved[i-1] = max(0, fw.reserved[i-1]-n)
+	}
 }
 
 // Helper functions
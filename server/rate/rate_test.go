@@ -1,7 +1,146 @@
 package server
 
-import "testing"
+import (
+	"context"
+	"testing"
+	"time"
+)
 
 func TestTokenBucket(t *testing.T) {
-	t.Log("Placeholder test for TokenBucket")
+	clock := NewFakeClock(epoch)
+	tb := NewTokenBucket(3, 100*ms, WithClock(clock))
+	for i := 0; i < 3; i++ {
+		if !tb.Allow() {
+			t.Fatalf("request %d denied by a full bucket", i+1)
+		}
+	}
+	if tb.Allow() {
+		t.Fatal("empty bucket admitted a request")
+	}
+
+	clock.Advance(100 * ms)
+	if !tb.Allow() {
+		t.Fatal("bucket did not refill a token after one interval")
+	}
+	if tb.Allow() {
+		t.Fatal("bucket refilled more than one token in one interval")
+	}
+
+	clock.Advance(time.Second)
+	if !tb.AllowN(3) || tb.Allow() {
+		t.Fatal("bucket should refill to its capacity and no further")
+	}
+}
+
+func TestReserveReportsDelay(t *testing.T) {
+	limiters := map[string]RateLimiter{
+		"token_bucket":   NewTokenBucket(1, time.Hour),
+		"leaky_bucket":   NewLeakyBucket(1, time.Hour),
+		"sliding_window": NewSlidingWindow(1, time.Hour),
+		"fixed_window":   NewFixedWindow(1, time.Hour),
+	}
+	for name, limiter := range limiters {
+		if r := limiter.Reserve(); !r.OK() || r.Delay() != 0 {
+			t.Errorf("%s: first reservation should act immediately, delay %v", name, r.Delay())
+		}
+		r := limiter.Reserve()
+		if !r.OK() || r.Delay() <= 0 {
+			t.Errorf("%s: second reservation should be delayed, delay %v", name, r.Delay())
+		}
+		if limiter.Allow() {
+			t.Errorf("%s: allowed a request while a reservation was outstanding", name)
+		}
+		r.Cancel()
+		if r.OK() && limiter.Reserve().Delay() > time.Hour {
+			t.Errorf("%s: cancel did not return the reserved request", name)
+		}
+	}
+}
+
+func TestZeroReservation(t *testing.T) {
+	var r Reservation
+	if r.OK() || r.Delay() != InfDuration {
+		t.Fatalf("zero reservation OK %v with delay %v, want one never honoured", r.OK(), r.Delay())
+	}
+	r.Cancel()
+}
+
+func TestAllowNRejectsOverCapacity(t *testing.T) {
+	tb := NewTokenBucket(5, time.Second)
+	if tb.AllowN(6) {
+		t.Fatal("AllowN(6) admitted more than the bucket holds")
+	}
+	if !tb.AllowN(5) {
+		t.Fatal("AllowN(5) should drain a full bucket")
+	}
+	if tb.Reserve().Delay() == 0 {
+		t.Fatal("empty bucket should delay reservations")
+	}
+	if r := NewFixedWindow(2, time.Second).Reserve(); !r.OK() {
+		t.Fatal("fixed window refused a reservation within its limit")
+	}
+	if NewFixedWindow(2, time.Second).AllowN(3) {
+		t.Fatal("fixed window admitted more than its limit")
+	}
+}
+
+func TestWaitHonoursContext(t *testing.T) {
+	sw := NewSlidingWindow(1, time.Hour)
+	if err := sw.Wait(context.Background()); err != nil {
+		t.Fatalf("first Wait failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sw.Wait(ctx); err == nil {
+		t.Fatal("Wait should fail when the deadline is before the next slot")
+	}
+	if len(sw.timestamps) != 1 {
+		t.Fatalf("failed Wait left %d timestamps, want 1", len(sw.timestamps))
+	}
+
+	tb := NewTokenBucket(1, 20*time.Millisecond)
+	tb.Allow()
+	start := time.Now()
+	if err := tb.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Fatalf("Wait returned after %v, expected to block for a refill", elapsed)
+	}
+}
+
+func TestTokenBucketSteadyRateMatchesConfigured(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	tb := NewTokenBucketRate(2, 3, WithClock(clock))
+	tb.AllowN(2)
+
+	// Polling every 250ms used to drop the partial interval on each refill
+	admitted := 0
+	for i := 0; i < 40; i++ {
+		clock.Advance(250 * ms)
+		if tb.Allow() {
+			admitted++
+		}
+	}
+	if admitted != 30 {
+		t.Fatalf("admitted %d requests over 10s at 3/s, want 30", admitted)
+	}
+}
+
+func TestRateInterval(t *testing.T) {
+	cases := []struct {
+		rate float64
+		want time.Duration
+	}{
+		{10, 100 * ms},
+		{0.5, 2 * time.Second},
+		{3e9, 1},
+		{0, InfDuration},
+	}
+	for _, tc := range cases {
+		if got := RateInterval(tc.rate); got != tc.want {
+			t.Errorf("RateInterval(%v) = %v, want %v", tc.rate, got, tc.want)
+		}
+	}
 }
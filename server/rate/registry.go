@@ -0,0 +1,235 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Param names a parameter of LimiterConfig an algorithm needs
+type Param string
+
+const (
+	// ParamRate is LimiterConfig.Rate, which must be positive
+	ParamRate Param = "rate"
+	// ParamBurst is LimiterConfig.Burst, which must be at least 1
+	ParamBurst Param = "burst"
+	// ParamWindow is LimiterConfig.Window, which must not be negative
+	ParamWindow Param = "window"
+)
+
+// Algorithm describes a limiter that can be selected by name. Only Name and
+// New are required; an algorithm that also limits requests in flight or
+// queues them provides NewInFlight or NewQueue, and one that can keep its
+// state in a Store provides NewStore. The factories are only called with
+// configs that passed validation.
+type Algorithm struct {
+	Name string
+	// Description says what the algorithm limits in terms of its Params,
+	// for the -algorithm help
+	Description string
+	// Params lists the parameters the algorithm needs
+	Params []Param
+	// Validate, if set, checks the config beyond Params
+	Validate func(config LimiterConfig) error
+
+	New         func(config LimiterConfig, opts ...Option) RateLimiter
+	NewStore    func(store Store, key string, config LimiterConfig, opts ...Option) RateLimiter
+	NewInFlight func(config LimiterConfig) InFlightLimiter
+	NewQueue    func(config LimiterConfig) *LeakyQueue
+}
+
+var (
+	algorithms      = make(map[string]Algorithm)
+	algorithmsMutex sync.RWMutex
+)
+
+// Register makes an algorithm selectable by its name. Like sql.Register it
+// is meant to be called from init, and panics if the name is taken or the
+// algorithm has no New.
+//
+// A limiter defined elsewhere should implement Reserver and build its
+// Reserve and Wait with NewReservation and WaitN. Without it, it can't be a
+// limit of the composite algorithm, which fails validation, nor a level of a
+// Hierarchy, whose requests are then refused with an error.
+func Register(algorithm Algorithm) {
+	algorithmsMutex.Lock()
+	defer algorithmsMutex.Unlock()
+
+	if algorithm.Name == "" || algorithm.New == nil {
+		panic("rate: Register needs an algorithm with a Name and New")
+	}
+	if _, taken := algorithms[algorithm.Name]; taken {
+		panic(fmt.Sprintf("rate: Register called twice for algorithm %q", algorithm.Name))
+	}
+	algorithms[algorithm.Name] = algorithm
+}
+
+// unregister forgets the algorithm registered as name, so that tests can
+// register theirs again
+func unregister(name string) {
+	algorithmsMutex.Lock()
+	defer algorithmsMutex.Unlock()
+	delete(algorithms, name)
+}
+
+// windowed reports whether the algorithm counts requests per window, and so
+// takes Rate as its limit per window rather than per second
+func (a Algorithm) windowed() bool {
+	for _, param := range a.Params {
+		if param == ParamWindow {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupAlgorithm returns the algorithm registered as name
+func LookupAlgorithm(name string) (Algorithm, bool) {
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+	algorithm, ok := algorithms[name]
+	return algorithm, ok
+}
+
+// Algorithms returns the names of the registered algorithms, sorted
+func Algorithms() []string {
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func noRateLimit(LimiterConfig, ...Option) RateLimiter {
+	return &NoRateLimiter{}
+}
+
+func init() {
+	Register(Algorithm{
+		Name:        "token_bucket",
+		Description: "bursts of up to burst requests, refilled at rate",
+		Params:      []Param{ParamRate, ParamBurst},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			return NewTokenBucketRate(c.Burst, c.Rate, opts...)
+		},
+		NewStore: func(store Store, key string, c LimiterConfig, opts ...Option) RateLimiter {
+			return NewStoreTokenBucket(store, key, c.Burst, c.Rate, opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "leaky_bucket",
+		Description: "up to burst requests, draining at rate",
+		Params:      []Param{ParamRate, ParamBurst},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			return NewLeakyBucket(c.Burst, RateInterval(c.Rate), opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "gcra",
+		Description: "the token bucket's limit, storing only the next arrival time",
+		Params:      []Param{ParamRate, ParamBurst},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			return NewGCRA(c.Burst, RateInterval(c.Rate), opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "sliding_window",
+		Description: "rate requests per window, the window moving with each request",
+		Params:      []Param{ParamRate, ParamWindow},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			return NewSlidingWindow(c.WindowLimit(), c.Window, opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "sliding_window_counter",
+		Description: "rate requests per moving window, estimated from two counters",
+		Params:      []Param{ParamRate, ParamWindow},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			return NewSlidingWindowCounter(c.WindowLimit(), c.Window, opts...)
+		},
+		NewStore: func(store Store, key string, c LimiterConfig, opts ...Option) RateLimiter {
+			return NewStoreSlidingWindowCounter(store, key, c.WindowLimit(), c.Window, opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "fixed_window",
+		Description: "rate requests per window, in consecutive fixed windows",
+		Params:      []Param{ParamRate, ParamWindow},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			return NewFixedWindow(c.WindowLimit(), c.Window, opts...)
+		},
+		NewStore: func(store Store, key string, c LimiterConfig, opts ...Option) RateLimiter {
+			return NewStoreFixedWindow(store, key, c.WindowLimit(), c.Window, opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "quota",
+		Description: "burst requests per calendar hour, day or month in a timezone",
+		Params:      []Param{ParamBurst},
+		Validate: func(c LimiterConfig) error {
+			_, _, err := c.QuotaPeriod()
+			return err
+		},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			period, location, _ := c.QuotaPeriod()
+			return NewQuota(c.Burst, period, location, opts...)
+		},
+		NewStore: func(store Store, key string, c LimiterConfig, opts ...Option) RateLimiter {
+			period, location, _ := c.QuotaPeriod()
+			return NewStoreQuota(store, key, c.Burst, period, location, opts...)
+		},
+	})
+	Register(Algorithm{
+		Name:        "leaky_queue",
+		Description: "queues up to burst requests and releases them at rate",
+		Params:      []Param{ParamRate, ParamBurst},
+		New:         noRateLimit,
+		NewQueue: func(c LimiterConfig) *LeakyQueue {
+			return NewLeakyQueue(c.Burst, RateInterval(c.Rate), c.QueueTimeout)
+		},
+	})
+	Register(Algorithm{
+		Name:        "concurrency",
+		Description: "up to burst requests in flight",
+		Params:      []Param{ParamBurst},
+		New:         noRateLimit,
+		NewInFlight: func(c LimiterConfig) InFlightLimiter {
+			return NewConcurrencyLimiter(c.Burst, c.QueueSize, c.QueueTimeout)
+		},
+	})
+	Register(Algorithm{
+		Name:        "gradient",
+		Description: "requests in flight, starting from burst and following backend latency",
+		Params:      []Param{ParamBurst},
+		New:         noRateLimit,
+		NewInFlight: func(c LimiterConfig) InFlightLimiter {
+			config := DefaultGradientConfig()
+			config.InitialLimit = c.Burst
+			config.QueueSize = c.QueueSize
+			config.QueueTimeout = c.QueueTimeout
+			return NewGradientLimiter(config)
+		},
+	})
+	Register(Algorithm{
+		Name:        "composite",
+		Description: "every one of limits at once",
+		Validate: func(c LimiterConfig) error {
+			_, err := newCompositeConfig(c)
+			return err
+		},
+		New: func(c LimiterConfig, opts ...Option) RateLimiter {
+			limiter, _ := newCompositeConfig(c, opts...)
+			return limiter
+		},
+	})
+	Register(Algorithm{
+		Name:        "no_rate_limit",
+		Description: "admits everything",
+		New:         noRateLimit,
+	})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// everyOther admits every other request, standing in for an algorithm
+// defined outside the package. Its reservations are built on Reserver, as
+// such an algorithm's would be.
+type everyOther struct {
+	calls int
+	mutex sync.Mutex
+}
+
+func (e *everyOther) Allow() bool {
+	return e.AllowN(1)
+}
+
+func (e *everyOther) AllowN(n int) bool {
+	return e.Decide(n).Allowed
+}
+
+func (e *everyOther) Decide(n int) Decision {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	// Deciding on no requests takes nothing, so it doesn't count as a call
+	if n <= 0 {
+		return Decision{Allowed: true, Limit: 1, Remaining: 1 - e.calls%2}
+	}
+	e.calls++
+	if e.calls%2 == 1 {
+		return Decision{Allowed: true, Limit: 1}
+	}
+	return Decision{Limit: 1, RetryAfter: time.Second}
+}
+
+// ReserveN admits the odd calls now and the even ones a second later
+func (e *everyOther) ReserveN(now time.Time, n int) (time.Time, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.calls++
+	if e.calls%2 == 1 {
+		return now, true
+	}
+	return now.Add(time.Second), true
+}
+
+func (e *everyOther) CancelN(now, at time.Time, n int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.calls--
+}
+
+func (e *everyOther) Reserve() *Reservation {
+	return NewReservation(e, nil, 1)
+}
+
+func (e *everyOther) Wait(ctx context.Context) error {
+	return WaitN(ctx, e, nil, 1)
+}
+
+func TestRegisterCustomAlgorithm(t *testing.T) {
+	errOdd := errors.New("burst must be odd")
+	Register(Algorithm{
+		Name:   "test_every_other",
+		Params: []Param{ParamBurst},
+		Validate: func(c LimiterConfig) error {
+			if c.Burst%2 == 0 {
+				return errOdd
+			}
+			return nil
+		},
+		New: func(LimiterConfig, ...Option) RateLimiter { return &everyOther{} },
+	})
+	t.Cleanup(func() { unregister("test_every_other") })
+
+	if !slices.Contains(Algorithms(), "test_every_other") {
+		t.Fatalf("Algorithms() = %v, missing the registered algorithm", Algorithms())
+	}
+	limiter, err := NewLimiter(LimiterConfig{Algorithm: "test_every_other", Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !limiter.Decide(1).Allowed || limiter.Decide(1).Allowed || !limiter.Allow() {
+		t.Fatal("NewLimiter did not build the registered algorithm")
+	}
+	if _, err := NewLimiter(LimiterConfig{Algorithm: "test_every_other", Burst: 0}); !errors.Is(err, ErrInvalidParameter) {
+		t.Fatalf("got %v, want the burst param checked", err)
+	}
+	if _, err := NewLimiter(LimiterConfig{Algorithm: "test_every_other", Burst: 2}); !errors.Is(err, errOdd) {
+		t.Fatalf("got %v, want the algorithm's own validation", err)
+	}
+	if _, err := NewStoreLimiter(NewMemoryStore(), "k", LimiterConfig{Algorithm: "test_every_other", Burst: 1}); !errors.Is(err, ErrStoreUnsupported) {
+		t.Fatalf("got %v, want ErrStoreUnsupported", err)
+	}
+	if r := limiter.Reserve(); !r.OK() || r.Delay() <= 0 {
+		t.Fatalf("got a reservation delayed %v for an even call", r.Delay())
+	}
+	if err := limiter.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() = %v for an odd call", err)
+	}
+
+	// Built on Reserver, it can be a limit of a composite and a level of a
+	// hierarchy, which hand back its reservations when it would delay
+	composite, err := NewLimiter(LimiterConfig{Algorithm: "composite", Limits: []LimiterConfig{{Algorithm: "test_every_other", Burst: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !composite.Allow() || composite.Allow() || composite.Allow() {
+		t.Fatal("a composite of every other request admits the first only, as the rest are handed back")
+	}
+	h := NewHierarchy(nil, nil, &everyOther{}, false)
+	if d, err := h.DecideKeys("", "", 1); err != nil || !d.Allowed {
+		t.Fatalf("got %+v, %v from a hierarchy with a global level defined elsewhere", d, err)
+	}
+	if d, _ := h.DecideKeys("", "", 1); d.Allowed {
+		t.Fatal("the hierarchy's second request was allowed")
+	}
+
+	// ProxyHandler decides with Decide, so it must see every other request denied
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	SetBackendURL(backend.URL)
+	if err := SetRateLimiter("test_every_other", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+	var codes []int
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		ProxyHandler(rec, httptest.NewRequest("GET", "/", nil))
+		codes = append(codes, rec.Code)
+	}
+	if !slices.Equal(codes, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusTooManyRequests}) {
+		t.Fatalf("ProxyHandler answered %v, want every other request denied", codes)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice should panic")
+		}
+	}()
+	Register(Algorithm{Name: "test_every_other", New: noRateLimit})
+}
+
+func TestSetLimiterConfigUsesAlgorithmHooks(t *testing.T) {
+	defer SetRateLimiter("no_rate_limit", 0, 0)
+
+	if err := SetLimiterConfig(LimiterConfig{Algorithm: "gradient", Burst: 4, QueueSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	config := loadConfig()
+	if _, ok := config.concurrencyLimiter.(*GradientLimiter); !ok || config.requestQueue != nil {
+		t.Fatalf("gradient set %T and queue %v", config.concurrencyLimiter, config.requestQueue)
+	}
+	if err := SetLimiterConfig(LimiterConfig{Algorithm: "leaky_queue", Rate: 10, Burst: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if config := loadConfig(); config.concurrencyLimiter != nil || config.requestQueue == nil {
+		t.Fatal("leaky_queue should set a queue and clear the in-flight limiter")
+	}
+}
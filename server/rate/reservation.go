@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// InfDuration is the delay reported for a reservation that can never be honoured
+const InfDuration = time.Duration(math.MaxInt64)
+
+// Reserver is the bookkeeping a limiter provides so that its Reserve and
+// Wait can be built with NewReservation and WaitN, as every algorithm in
+// this package does. Limiters that implement it can also be a limit of a
+// Composite, a level of a Hierarchy and share their clients through Gossip.
+type Reserver interface {
+	// ReserveN claims n requests and returns the time at which they may
+	// proceed. ok is false if the limiter can never admit n at once. A zero
+	// at with ok true admits them now without reserving anything, as a
+	// store-backed limiter does when it fails open.
+	ReserveN(now time.Time, n int) (at time.Time, ok bool)
+	// CancelN hands back n requests previously reserved for time at, and
+	// nothing for a zero at
+	CancelN(now, at time.Time, n int)
+}
+
+// recorder is a Reserver whose reservations can't be told apart by their
+// time alone, such as a Composite's. Each is handed back through the cancel
+// function returned with it rather than through CancelN.
+type recorder interface {
+	reserveRecord(now time.Time, n int) (at time.Time, ok bool, cancel func(now time.Time))
+}
+
+// reserve claims n requests from lim, returning the time at which they may
+// proceed and the function that hands them back
+func reserve(lim Reserver, now time.Time, n int) (time.Time, bool, func(now time.Time)) {
+	if rec, ok := lim.(recorder); ok {
+		return rec.reserveRecord(now, n)
+	}
+	at, ok := lim.ReserveN(now, n)
+	return at, ok, func(now time.Time) { lim.CancelN(now, at, n) }
+}
+
+// Reservation holds requests claimed from a limiter ahead of time. The zero
+// Reservation is one that can never be honoured.
+type Reservation struct {
+	clock    Clock
+	ok       bool
+	at       time.Time
+	cancel   func(now time.Time)
+	canceled bool
+	mutex    sync.Mutex
+}
+
+// NewReservation claims n requests from lim as of clock's time, the real time
+// if clock is nil
+func NewReservation(lim Reserver, clock Clock, n int) *Reservation {
+	if clock == nil {
+		clock = RealClock
+	}
+	at, ok, cancel := reserve(lim, clock.Now(), n)
+	return &Reservation{clock: clock, ok: ok, at: at, cancel: cancel}
+}
+
+// OK reports whether the limiter will ever admit the reserved requests
+func (r *Reservation) OK() bool {
+	return r.ok && r.clock != nil
+}
+
+// Delay returns how long the holder must wait before acting on the reservation
+func (r *Reservation) Delay() time.Duration {
+	if !r.OK() {
+		return InfDuration
+	}
+	return r.DelayFrom(r.clock.Now())
+}
+
+// DelayFrom returns how long the holder must wait from now
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if !r.OK() {
+		return InfDuration
+	}
+	if delay := r.at.Sub(now); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Cancel returns the reserved requests to the limiter. It has no effect once
+// the reservation's time to act has passed.
+func (r *Reservation) Cancel() {
+	if !r.OK() {
+		return
+	}
+	r.CancelAt(r.clock.Now())
+}
+
+// CancelAt is Cancel as of the given time
+func (r *Reservation) CancelAt(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.OK() || r.canceled || r.at.Before(now) {
+		return
+	}
+	r.canceled = true
+	r.cancel(now)
+}
+
+// WaitN blocks until lim admits n requests or ctx is done, timing the wait
+// with clock, or the real time if clock is nil
+func WaitN(ctx context.Context, lim Reserver, clock Clock, n int) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	r := NewReservation(lim, clock, n)
+	if !r.ok {
+		return fmt.Errorf("rate: Wait(n=%d) exceeds the limiter's capacity", n)
+	}
+
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(r.at) {
+		r.Cancel()
+		return fmt.Errorf("rate: Wait(n=%d) would exceed context deadline", n)
+	}
+
+	timer := r.clock.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ErrStoreClosed is returned by a RESPStore after Close
+var ErrStoreClosed = errors.New("rate: store is closed")
+
+// respError is an error reply from the server
+type respError string
+
+func (e respError) Error() string {
+	return "rate: store replied " + string(e)
+}
+
+// respConn is a connection speaking RESP, the Redis serialization protocol
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newRESPConn(conn net.Conn) *respConn {
+	return &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+// send queues a command without waiting for its reply
+func (c *respConn) send(args ...string) {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// do sends a command and returns its reply
+func (c *respConn) do(args ...string) (any, error) {
+	c.send(args...)
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// exec runs cmds in a MULTI/EXEC transaction and returns EXEC's reply
+func (c *respConn) exec(cmds ...[]string) (any, error) {
+	c.send("MULTI")
+	for _, cmd := range cmds {
+		c.send(cmd...)
+	}
+	c.send("EXEC")
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	// MULTI replies OK and each command QUEUED
+	for range len(cmds) + 1 {
+		reply, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if err, ok := reply.(respError); ok {
+			return nil, err
+		}
+	}
+	return c.read()
+}
+
+// read returns the next reply: a string, an int64, nil, a []any or a
+// respError. Protocol and network failures are returned as the error.
+func (c *respConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("rate: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return respError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(body)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]any, size)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("rate: unknown reply type %q", kind)
+}
+
+// RESPStore is a Store on a Redis server, or anything else that speaks RESP
+// and supports MULTI/EXEC and WATCH. Connections are pooled and opened on
+// demand.
+type RESPStore struct {
+	addr    string
+	timeout time.Duration
+	idle    chan *respConn
+	closed  chan struct{}
+}
+
+// NewRESPStore creates a new RESPStore for the server at addr, keeping up to
+// poolSize idle connections. Each command fails after timeout; zero waits
+// for as long as the context allows.
+func NewRESPStore(addr string, poolSize int, timeout time.Duration) *RESPStore {
+	return &RESPStore{
+		addr:    addr,
+		timeout: timeout,
+		idle:    make(chan *respConn, poolSize),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Incr adds delta to the integer at key and returns the result
+func (rs *RESPStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	var n int64
+	err := rs.with(ctx, func(c *respConn) error {
+		// SET NX only sets the TTL when it creates the key, and the transaction
+		// keeps the key from expiring between the two commands
+		reply, err := c.exec(
+			[]string{"SET", key, "0", "PX", respMillis(ttl), "NX"},
+			[]string{"INCRBY", key, strconv.FormatInt(delta, 10)},
+		)
+		if err != nil {
+			return err
+		}
+		results, ok := reply.([]any)
+		if !ok || len(results) != 2 {
+			return replyError(reply)
+		}
+		if n, ok = results[1].(int64); !ok {
+			return replyError(results[1])
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Get returns the value at key, or ok false if there is none
+func (rs *RESPStore) Get(ctx context.Context, key string) (string, bool, error) {
+	var value string
+	var ok bool
+	err := rs.with(ctx, func(c *respConn) error {
+		reply, err := c.do("GET", key)
+		if err != nil || reply == nil {
+			return err
+		}
+		if value, ok = reply.(string); !ok {
+			return replyError(reply)
+		}
+		return nil
+	})
+	return value, ok, err
+}
+
+// CompareAndSwap sets key to new if it currently holds old. The swap runs
+// in a transaction that WATCHes key, so it fails if anyone else changes key
+// in between.
+func (rs *RESPStore) CompareAndSwap(ctx context.Context, key, old, new string, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := rs.with(ctx, func(c *respConn) error {
+		if _, err := c.do("WATCH", key); err != nil {
+			return err
+		}
+		reply, err := c.do("GET", key)
+		if err != nil {
+			return err
+		}
+		current, isString := reply.(string)
+		if reply != nil && !isString {
+			return replyError(reply)
+		}
+		if (reply != nil) != (old != "") || current != old {
+			_, err := c.do("UNWATCH")
+			return err
+		}
+
+		if reply, err = c.exec([]string{"SET", key, new, "PX", respMillis(ttl)}); err != nil {
+			return err
+		}
+		// EXEC replies nil when a watched key changed
+		swapped = reply != nil
+		return nil
+	})
+	return swapped, err
+}
+
+// Close closes the idle connections and fails any later commands
+func (rs *RESPStore) Close() error {
+	select {
+	case <-rs.closed:
+		return nil
+	default:
+	}
+	close(rs.closed)
+	for {
+		select {
+		case c := <-rs.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// with runs fn on a pooled connection. A connection that fails is closed
+// rather than returned to the pool, since it may be left partway through a
+// reply.
+func (rs *RESPStore) with(ctx context.Context, fn func(c *respConn) error) error {
+	select {
+	case <-rs.closed:
+		return ErrStoreClosed
+	default:
+	}
+
+	c, err := rs.get(ctx)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if rs.timeout > 0 {
+		if limit := time.Now().Add(rs.timeout); !ok || limit.Before(deadline) {
+			deadline, ok = limit, true
+		}
+	}
+	if ok {
+		c.conn.SetDeadline(deadline)
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+
+	if err := fn(c); err != nil {
+		c.conn.Close()
+		return err
+	}
+	select {
+	case rs.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return nil
+}
+
+func (rs *RESPStore) get(ctx context.Context) (*respConn, error) {
+	select {
+	case c := <-rs.idle:
+		return c, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: rs.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", rs.addr)
+	if err != nil {
+		return nil, err
+	}
+	return newRESPConn(conn), nil
+}
+
+// replyError describes a reply that isn't what the command should return
+func replyError(reply any) error {
+	if err, ok := reply.(respError); ok {
+		return err
+	}
+	return fmt.Errorf("rate: unexpected reply %v", reply)
+}
+
+// respMillis formats d as the milliseconds of a PX argument, at least 1
+func respMillis(d time.Duration) string {
+	ms := int64((d + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
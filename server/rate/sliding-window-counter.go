@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindowCounter struct for the approximate sliding window algorithm.
+// Instead of a timestamp per request it keeps the counts of the current and
+// previous fixed windows, and weights the previous count by how much of it
+// still overlaps the sliding window. reserved holds counts claimed in later
+// windows.
+type SlidingWindowCounter struct {
+	windowSize  time.Duration
+	limit       int
+	prevCount   int
+	count       int
+	reserved    []int
+	windowStart time.Time
+	clock       Clock
+	mutex       sync.Mutex
+}
+
+// NewSlidingWindowCounter creates a new SlidingWindowCounter instance
+func NewSlidingWindowCounter(limit int, windowSize time.Duration, opts ...Option) *SlidingWindowCounter {
+	o := newOptions(opts)
+	return &SlidingWindowCounter{
+		windowSize:  windowSize,
+		limit:       limit,
+		windowStart: o.clock.Now(),
+		clock:       o.clock,
+	}
+}
+
+// Allow checks if a request can proceed under the sliding window counter algorithm
+func (swc *SlidingWindowCounter) Allow() bool {
+	return swc.AllowN(1)
+}
+
+// AllowN checks if n requests can proceed under the sliding window counter algorithm
+func (swc *SlidingWindowCounter) AllowN(n int) bool {
+	return swc.Decide(n).Allowed
+}
+
+// Decide checks if n requests can proceed and reports the estimated slots left
+func (swc *SlidingWindowCounter) Decide(n int) Decision {
+	n = max(0, n)
+
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+
+	now := swc.clock.Now()
+	swc.advance(now)
+
+	d := Decision{Limit: swc.limit}
+	if swc.estimate(now)+float64(n) <= float64(swc.limit) {
+		swc.count += n
+		d.Allowed = true
+	} else if n > swc.limit {
+		d.RetryAfter = InfDuration
+	} else {
+		d.RetryAfter = until(now, swc.openAt(now, n))
+	}
+	d.Remaining = max(0, swc.limit-int(math.Ceil(swc.estimate(now))))
+
+	// The current count stops weighing on the window once the next one ends
+	switch {
+	case swc.count > 0:
+		d.Reset = until(now, swc.windowAt(2))
+	case swc.prevCount > 0:
+		d.Reset = until(now, swc.windowAt(1))
+	}
+	return d
+}
+
+// Reserve claims a request, reporting how long until the estimate makes room for it
+func (swc *SlidingWindowCounter) Reserve() *Reservation {
+	return NewReservation(swc, swc.clock, 1)
+}
+
+// Wait blocks until the estimate makes room for a request or ctx is done
+func (swc *SlidingWindowCounter) Wait(ctx context.Context) error {
+	return WaitN(ctx, swc, swc.clock, 1)
+}
+
+// Rate returns the limit spread over the window, in requests per second
+func (swc *SlidingWindowCounter) Rate() float64 {
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+	return float64(swc.limit) / swc.windowSize.Seconds()
+}
+
+// SetRate changes the limit to rate requests per second over the window,
+// allowing at least one request per window
+func (swc *SlidingWindowCounter) SetRate(rate float64) {
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+	swc.limit = windowLimit(rate, swc.windowSize)
+}
+
+// estimate returns the weighted number of requests in the window ending at now
+func (swc *SlidingWindowCounter) estimate(now time.Time) float64 {
+	elapsed := float64(now.Sub(swc.windowStart)) / float64(swc.windowSize)
+	return float64(swc.prevCount)*(1-elapsed) + float64(swc.count)
+}
+
+// advance moves the current window forward until it contains now
+func (swc *SlidingWindowCounter) advance(now time.Time) {
+	elapsed := now.Sub(swc.windowStart)
+	if elapsed < swc.windowSize {
+		return
+	}
+
+	windows := int(elapsed / swc.windowSize)
+	swc.windowStart = swc.windowStart.Add(time.Duration(windows) * swc.windowSize)
+
+	// Shift the sequence prev, current, reserved... left by the windows passed
+	counts := append([]int{swc.prevCount, swc.count}, swc.reserved...)
+	swc.prevCount, swc.count, swc.reserved = 0, 0, nil
+	if windows < len(counts) {
+		swc.prevCount = counts[windows]
+	}
+	if windows+1 < len(counts) {
+		swc.count = counts[windows+1]
+	}
+	if windows+2 < len(counts) {
+		swc.reserved = counts[windows+2:]
+	}
+}
+
+// openAt returns the earliest time from now at which n more requests fit
+// under the estimate, taking later reservations into account
+func (swc *SlidingWindowCounter) openAt(now time.Time, n int) time.Time {
+	prev, count := swc.prevCount, swc.count
+	for i := 0; ; i++ {
+		if at, ok := slideAt(swc.windowAt(i), swc.windowSize, swc.limit, prev, count, n); ok {
+			if at.Before(now) {
+				at = now
+			}
+			return at
+		}
+		prev, count = count, 0
+		if i < len(swc.reserved) {
+			count = swc.reserved[i]
+		}
+	}
+}
+
+// slideAt returns when, in the window starting at start, enough of the
+// previous window's prev requests have slid out for n more to fit beside
+// count. ok is false if that doesn't happen before the window ends.
+func slideAt(start time.Time, windowSize time.Duration, limit, prev, count, n int) (at time.Time, ok bool) {
+	free := limit - count - n
+	if free < 0 {
+		return time.Time{}, false
+	}
+	fraction := 0.0
+	if prev > 0 {
+		fraction = math.Max(0, 1-float64(free)/float64(prev))
+	}
+	at = start.Add(time.Duration(math.Ceil(fraction * float64(windowSize))))
+	return at, at.Before(start.Add(windowSize))
+}
+
+// windowAt returns the start of the i'th window after the current one
+func (swc *SlidingWindowCounter) windowAt(i int) time.Time {
+	return swc.windowStart.Add(time.Duration(i) * swc.windowSize)
+}
+
+// ReserveN counts n requests in the first window from now whose estimate
+// has room for them, and returns when they fit
+func (swc *SlidingWindowCounter) ReserveN(now time.Time, n int) (time.Time, bool) {
+	n = max(0, n)
+
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+
+	if n > swc.limit {
+		return time.Time{}, false
+	}
+	swc.advance(now)
+
+	at := swc.openAt(now, n)
+	i := int(at.Sub(swc.windowStart) / swc.windowSize)
+	if i == 0 {
+		swc.count += n
+		return at, true
+	}
+	for len(swc.reserved) < i {
+		swc.reserved = append(swc.reserved, 0)
+	}
+	swc.reserved[i-1] += n
+	return at, true
+}
+
+// CancelN takes n requests off the count of the window at falls in
+func (swc *SlidingWindowCounter) CancelN(now, at time.Time, n int) {
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+
+	swc.advance(now)
+	if at.Before(swc.windowStart) {
+		return
+	}
+	i := int(at.Sub(swc.windowStart) / swc.windowSize)
+	if i == 0 {
+		swc.count = max(0, swc.count-n)
+	} else if i <= len(swc.reserved) {
+		swc.reserved[i-1] = max(0, swc.reserved[i-1]-n)
+	}
+}
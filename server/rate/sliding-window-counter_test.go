@@ -0,0 +1,106 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// workload is a list of request arrival offsets. The recordings in data/
+// hold the server's power draw, 60 voltage and current readings per run,
+// rather than when requests arrived, so there is no trace to replay. The
+// workloads instead regenerate the loads those runs were driven with: the
+// 1000-request bursts of req.py and the const, sin and exp rate profiles of
+// the client, with the 60 second duration of client/config.json.
+type workload struct {
+	name     string
+	arrivals []time.Duration
+}
+
+// burstWorkload sends count requests spread over spread, every period
+func burstWorkload(count int, spread, period time.Duration, bursts int) workload {
+	var arrivals []time.Duration
+	for b := 0; b < bursts; b++ {
+		start := time.Duration(b) * period
+		for i := 0; i < count; i++ {
+			arrivals = append(arrivals, start+spread*time.Duration(i)/time.Duration(count))
+		}
+	}
+	return workload{fmt.Sprintf("burst_%d", count), arrivals}
+}
+
+// rateWorkload sends requests at rateFunc(t) per second for duration
+func rateWorkload(name string, rateFunc func(float64) float64, duration time.Duration) workload {
+	var arrivals []time.Duration
+	for t := time.Duration(0); t < duration; {
+		rate := rateFunc(t.Seconds())
+		if rate <= 0 {
+			t += time.Second
+			continue
+		}
+		t += time.Duration(float64(time.Second) / rate)
+		arrivals = append(arrivals, t)
+	}
+	return workload{name, arrivals}
+}
+
+var accuracyWorkloads = []workload{
+	burstWorkload(1000, 100*ms, 2*time.Second, 10),
+	rateWorkload("const_100", func(float64) float64 { return 100 }, 60*time.Second),
+	rateWorkload("sin", func(t float64) float64 { return 150*math.Sin(t/2) + 120 }, 60*time.Second),
+	rateWorkload("exp", func(t float64) float64 { return 5 * math.Exp(0.1*t) }, 40*time.Second),
+}
+
+// BenchmarkSlidingWindowCounterAccuracy replays each workload through the
+// exact SlidingWindow and the approximate SlidingWindowCounter, reporting how
+// often they disagree and how many requests the counter admits relative to
+// the exact algorithm
+func BenchmarkSlidingWindowCounterAccuracy(b *testing.B) {
+	for _, w := range accuracyWorkloads {
+		b.Run(w.name, func(b *testing.B) {
+			var exactAdmits, approxAdmits, mismatches int
+			for i := 0; i < b.N; i++ {
+				exactClock, approxClock := NewFakeClock(epoch), NewFakeClock(epoch)
+				exact := NewSlidingWindow(100, time.Second, WithClock(exactClock))
+				approx := NewSlidingWindowCounter(100, time.Second, WithClock(approxClock))
+
+				exactAdmits, approxAdmits, mismatches = 0, 0, 0
+				for _, at := range w.arrivals {
+					exactClock.Advance(epoch.Add(at).Sub(exactClock.Now()))
+					approxClock.Advance(epoch.Add(at).Sub(approxClock.Now()))
+					e, a := exact.Allow(), approx.Allow()
+					if e {
+						exactAdmits++
+					}
+					if a {
+						approxAdmits++
+					}
+					if e != a {
+						mismatches++
+					}
+				}
+			}
+			b.ReportMetric(100*float64(mismatches)/float64(len(w.arrivals)), "%mismatch")
+			b.ReportMetric(float64(approxAdmits)/float64(exactAdmits), "admit-ratio")
+		})
+	}
+}
+
+func BenchmarkSlidingWindowAllow(b *testing.B) {
+	for _, limit := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("exact/limit_%d", limit), func(b *testing.B) {
+			benchmarkAllow(b, NewSlidingWindow(limit, time.Second))
+		})
+		b.Run(fmt.Sprintf("counter/limit_%d", limit), func(b *testing.B) {
+			benchmarkAllow(b, NewSlidingWindowCounter(limit, time.Second))
+		})
+	}
+}
+
+func benchmarkAllow(b *testing.B, limiter RateLimiter) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		limiter.Allow()
+	}
+}
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrStateMismatch is returned when restoring state saved by a different
+// algorithm
+var ErrStateMismatch = errors.New("rate: state was saved by a different algorithm")
+
+// Snapshotter is implemented by limiters whose state can be saved and
+// restored, so that a restart doesn't hand every client a fresh burst
+type Snapshotter interface {
+	// SnapshotState returns the limiter's state as JSON
+	SnapshotState() ([]byte, error)
+	// RestoreState replaces the limiter's state with one it saved earlier.
+	// Only the state is restored; the parameters are the limiter's own.
+	RestoreState(data []byte) error
+}
+
+// Each algorithm's saved state names the algorithm, so that state can't be
+// restored into a limiter of another kind
+
+type tokenBucketState struct {
+	Algorithm  string    `json:"algorithm"`
+	Tokens     float64   `json:"tokens"`
+	LastRefill time.Time `json:"last_refill"`
+}
+
+type leakyBucketState struct {
+	Algorithm    string    `json:"algorithm"`
+	Count        int       `json:"count"`
+	LastLeakTime time.Time `json:"last_leak_time"`
+}
+
+type gcraState struct {
+	Algorithm string    `json:"algorithm"`
+	TAT       time.Time `json:"tat"`
+}
+
+type slidingWindowState struct {
+	Algorithm  string      `json:"algorithm"`
+	Timestamps []time.Time `json:"timestamps"`
+}
+
+type quotaState struct {
+	Algorithm   string    `json:"algorithm"`
+	PeriodStart time.Time `json:"period_start"`
+	Used        int       `json:"used"`
+	Reserved    []int     `json:"reserved,omitempty"`
+}
+
+type compositeState struct {
+	Algorithm string            `json:"algorithm"`
+	Limits    []json.RawMessage `json:"limits"`
+}
+
+type windowCounterState struct {
+	Algorithm   string    `json:"algorithm"`
+	WindowStart time.Time `json:"window_start"`
+	PrevCount   int       `json:"prev_count,omitempty"`
+	Count       int       `json:"count"`
+	Reserved    []int     `json:"reserved,omitempty"`
+}
+
+// restoreState decodes data into state, checking it was saved by algorithm
+func restoreState(data []byte, algorithm string, state any) error {
+	var saved struct {
+		Algorithm string `json:"algorithm"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	if saved.Algorithm != algorithm {
+		return fmt.Errorf("%w: %q, not %q", ErrStateMismatch, saved.Algorithm, algorithm)
+	}
+	return json.Unmarshal(data, state)
+}
+
+// SnapshotState returns the tokens left and when they were last refilled
+func (tb *TokenBucket) SnapshotState() ([]byte, error) {
+	tb.refillMutex.Lock()
+	defer tb.refillMutex.Unlock()
+	return json.Marshal(tokenBucketState{"token_bucket", tb.tokens, tb.lastRefill})
+}
+
+// RestoreState restores the tokens, capped at the bucket's capacity
+func (tb *TokenBucket) RestoreState(data []byte) error {
+	var state tokenBucketState
+	if err := restoreState(data, "token_bucket", &state); err != nil {
+		return err
+	}
+	tb.refillMutex.Lock()
+	defer tb.refillMutex.Unlock()
+	tb.tokens = state.Tokens
+	if tb.tokens > float64(tb.capacity) {
+		tb.tokens = float64(tb.capacity)
+	}
+	tb.lastRefill = state.LastRefill
+	return nil
+}
+
+// SnapshotState returns the bucket's level and when it last leaked
+func (lb *LeakyBucket) SnapshotState() ([]byte, error) {
+	lb.leakMutex.Lock()
+	defer lb.leakMutex.Unlock()
+	return json.Marshal(leakyBucketState{"leaky_bucket", lb.currentCount, lb.lastLeakTime})
+}
+
+// RestoreState restores the bucket's level, capped at the bucket's capacity
+func (lb *LeakyBucket) RestoreState(data []byte) error {
+	var state leakyBucketState
+	if err := restoreState(data, "leaky_bucket", &state); err != nil {
+		return err
+	}
+	lb.leakMutex.Lock()
+	defer lb.leakMutex.Unlock()
+	lb.currentCount = min(max(0, state.Count), lb.capacity)
+	lb.lastLeakTime = state.LastLeakTime
+	return nil
+}
+
+// SnapshotState returns the theoretical arrival time
+func (g *GCRA) SnapshotState() ([]byte, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return json.Marshal(gcraState{"gcra", g.tat})
+}
+
+// RestoreState restores the theoretical arrival time
+func (g *GCRA) RestoreState(data []byte) error {
+	var state gcraState
+	if err := restoreState(data, "gcra", &state); err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.tat = state.TAT
+	return nil
+}
+
+// SnapshotState returns the timestamps of the requests in the window
+func (sw *SlidingWindow) SnapshotState() ([]byte, error) {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	return json.Marshal(slidingWindowState{"sliding_window", sw.timestamps})
+}
+
+// RestoreState restores the timestamps of the requests in the window
+func (sw *SlidingWindow) RestoreState(data []byte) error {
+	var state slidingWindowState
+	if err := restoreState(data, "sliding_window", &state); err != nil {
+		return err
+	}
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	sw.timestamps = state.Timestamps
+	return nil
+}
+
+// SnapshotState returns the current window and its counts
+func (swc *SlidingWindowCounter) SnapshotState() ([]byte, error) {
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+	return json.Marshal(windowCounterState{"sliding_window_counter", swc.windowStart, swc.prevCount, swc.count, swc.reserved})
+}
+
+// RestoreState restores the current window and its counts
+func (swc *SlidingWindowCounter) RestoreState(data []byte) error {
+	var state windowCounterState
+	if err := restoreState(data, "sliding_window_counter", &state); err != nil {
+		return err
+	}
+	swc.mutex.Lock()
+	defer swc.mutex.Unlock()
+	swc.windowStart, swc.prevCount, swc.count, swc.reserved = state.WindowStart, state.PrevCount, state.Count, state.Reserved
+	return nil
+}
+
+// SnapshotState returns the current window and its count
+func (fw *FixedWindow) SnapshotState() ([]byte, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	return json.Marshal(windowCounterState{Algorithm: "fixed_window", WindowStart: fw.windowStart, Count: fw.count, Reserved: fw.reserved})
+}
+
+// RestoreState restores the current window and its count
+func (fw *FixedWindow) RestoreState(data []byte) error {
+	var state windowCounterState
+	if err := restoreState(data, "fixed_window", &state); err != nil {
+		return err
+	}
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.windowStart, fw.count, fw.reserved = state.WindowStart, state.Count, state.Reserved
+	return nil
+}
+
+// SnapshotState returns the current period and what has been used of it
+func (q *Quota) SnapshotState() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return json.Marshal(quotaState{"quota", q.start, q.used, q.reserved})
+}
+
+// RestoreState restores the current period and what has been used of it
+func (q *Quota) RestoreState(data []byte) error {
+	var state quotaState
+	if err := restoreState(data, "quota", &state); err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.start, q.used, q.reserved = state.PeriodStart.In(q.location), state.Used, state.Reserved
+	return nil
+}
+
+// SnapshotState returns the state of each limit, if they are all
+// Snapshotters
+func (c *Composite) SnapshotState() ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	state := compositeState{Algorithm: "composite", Limits: make([]json.RawMessage, len(c.limiters))}
+	for i, limiter := range c.limiters {
+		snapshotter, ok := limiter.(Snapshotter)
+		if !ok {
+			return nil, fmt.Errorf("rate: %T can't be snapshotted", limiter)
+		}
+		limit, err := snapshotter.SnapshotState()
+		if err != nil {
+			return nil, err
+		}
+		state.Limits[i] = limit
+	}
+	return json.Marshal(state)
+}
+
+// RestoreState restores the state of each limit. The limits must be the
+// same number and algorithms, in the same order.
+func (c *Composite) RestoreState(data []byte) error {
+	var state compositeState
+	if err := restoreState(data, "composite", &state); err != nil {
+		return err
+	}
+	if len(state.Limits) != len(c.limiters) {
+		return fmt.Errorf("%w: %d limits, not %d", ErrStateMismatch, len(state.Limits), len(c.limiters))
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, limiter := range c.limiters {
+		snapshotter, ok := limiter.(Snapshotter)
+		if !ok {
+			return fmt.Errorf("rate: %T can't be restored", limiter)
+		}
+		if err := snapshotter.RestoreState(state.Limits[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyedSnapshot is the saved state of a KeyedLimiter
+type keyedSnapshot struct {
+	Saved time.Time         `json:"saved"`
+	Keys  []keyedEntryState `json:"keys"`
+}
+
+type keyedEntryState struct {
+	Key      string          `json:"key"`
+	LastSeen time.Time       `json:"last_seen"`
+	State    json.RawMessage `json:"state"`
+}
+
+// Snapshot writes the state of every key's limiter to w as JSON. Limiters
+// that aren't Snapshotters are left out. Shards are locked one at a time, so
+// the snapshot isn't a single point in time.
+func (kl *KeyedLimiter) Snapshot(w io.Writer) error {
+	snapshot := keyedSnapshot{Saved: kl.clock.Now(), Keys: []keyedEntryState{}}
+	for _, shard := range kl.shards {
+		shard.mutex.RLock()
+		for _, entry := range shard.ring {
+			s, ok := entry.limiter.(Snapshotter)
+			if !ok {
+				continue
+			}
+			state, err := s.SnapshotState()
+			if err != nil {
+				shard.mutex.RUnlock()
+				return err
+			}
+			snapshot.Keys = append(snapshot.Keys, keyedEntryState{
+				Key:      entry.key,
+				LastSeen: time.Unix(0, entry.lastSeen.Load()),
+				State:    state,
+			})
+		}
+		shard.mutex.RUnlock()
+	}
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// Restore reads a snapshot written by Snapshot and restores the keys in it
+// that haven't been idle for the TTL, returning how many it restored. Keys
+// already tracked are left alone, as are keys whose state doesn't fit the
+// factory's limiters, such as after a change of algorithm.
+func (kl *KeyedLimiter) Restore(r io.Reader) (int, error) {
+	var snapshot keyedSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return 0, err
+	}
+
+	now := kl.clock.Now()
+	restored := 0
+	for _, saved := range snapshot.Keys {
+		if kl.config.TTL > 0 && now.Sub(saved.LastSeen) >= kl.config.TTL {
+			continue
+		}
+		limiter := kl.factory(saved.Key)
+		s, ok := limiter.(Snapshotter)
+		if !ok || s.RestoreState(saved.State) != nil {
+			continue
+		}
+		if kl.insert(saved.Key, limiter, saved.LastSeen) {
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// insert tracks key with limiter unless it's already tracked or there's no
+// room for it
+func (kl *KeyedLimiter) insert(key string, limiter RateLimiter, lastSeen time.Time) bool {
+	shard := kl.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if _, exists := shard.entries[key]; exists || !kl.admit() {
+		return false
+	}
+	entry := &keyedEntry{key: key, limiter: limiter}
+	entry.lastSeen.Store(lastSeen.UnixNano())
+	shard.entries[key] = entry
+	shard.ring = append(shard.ring, entry)
+	return true
+}
+
+// SaveSnapshot writes a snapshot to the file at path. It is written to a
+// temporary file first and renamed into place, so a crash midway leaves the
+// previous snapshot intact.
+func (kl *KeyedLimiter) SaveSnapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := kl.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot restores the snapshot in the file at path. A missing file
+// restores nothing and is not an error.
+func (kl *KeyedLimiter) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return kl.Restore(f)
+}
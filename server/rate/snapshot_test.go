@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestoresEachAlgorithm(t *testing.T) {
+	cases := []struct {
+		name string
+		new  func(Clock) RateLimiter
+	}{
+		{"token_bucket", func(c Clock) RateLimiter { return NewTokenBucket(4, time.Second, WithClock(c)) }},
+		{"leaky_bucket", func(c Clock) RateLimiter { return NewLeakyBucket(4, time.Second, WithClock(c)) }},
+		{"gcra", func(c Clock) RateLimiter { return NewGCRA(4, time.Second, WithClock(c)) }},
+		{"sliding_window", func(c Clock) RateLimiter { return NewSlidingWindow(4, time.Second, WithClock(c)) }},
+		{"sliding_window_counter", func(c Clock) RateLimiter { return NewSlidingWindowCounter(4, time.Second, WithClock(c)) }},
+		{"fixed_window", func(c Clock) RateLimiter { return NewFixedWindow(4, time.Second, WithClock(c)) }},
+		{"quota", func(c Clock) RateLimiter { return NewQuota(4, PeriodHour, nil, WithClock(c)) }},
+		{"composite", func(c Clock) RateLimiter {
+			composite, _ := NewComposite([]RateLimiter{
+				NewTokenBucket(4, time.Second, WithClock(c)),
+				NewFixedWindow(10, time.Minute, WithClock(c)),
+			}, WithClock(c))
+			return composite
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			before := tc.new(clock)
+			before.AllowN(3)
+			clock.Advance(100 * ms)
+
+			state, err := before.(Snapshotter).SnapshotState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := tc.new(clock)
+			if err := after.(Snapshotter).RestoreState(state); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := after.Decide(1), before.Decide(1); got != want {
+				t.Fatalf("restored limiter decided %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRestoreStateRejectsOtherAlgorithms(t *testing.T) {
+	state, _ := NewGCRA(4, time.Second).SnapshotState()
+	if err := NewTokenBucket(4, time.Second).RestoreState(state); !errors.Is(err, ErrStateMismatch) {
+		t.Fatalf("got %v, want ErrStateMismatch", err)
+	}
+}
+
+func TestRestoreStateClampsToCapacity(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	larger := NewLeakyBucket(10, time.Second, WithClock(clock))
+	larger.AllowN(8)
+	state, _ := larger.SnapshotState()
+
+	// A snapshot taken under a larger burst fills the bucket and no more
+	lb := NewLeakyBucket(4, time.Second, WithClock(clock))
+	if err := lb.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if lb.currentCount != 4 {
+		t.Fatalf("restored a level of %d, want the capacity of 4", lb.currentCount)
+	}
+	clock.Advance(time.Second)
+	if !lb.Allow() || lb.Allow() {
+		t.Fatal("bucket should have room for one request after one leak")
+	}
+
+	if err := lb.RestoreState([]byte(`{"algorithm":"leaky_bucket","count":-3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if lb.currentCount != 0 {
+		t.Fatalf("restored a level of %d, want 0", lb.currentCount)
+	}
+}
+
+func TestKeyedLimiterSnapshotFile(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	config := KeyedConfig{TTL: time.Minute}
+	factory := func(string) RateLimiter { return NewFixedWindow(2, time.Hour, WithClock(clock)) }
+	path := filepath.Join(t.TempDir(), "limits.json")
+
+	kl := NewKeyedLimiter(ClientIP, factory, config, WithClock(clock))
+	if n, err := kl.LoadSnapshot(path); n != 0 || err != nil {
+		t.Fatalf("loading a missing snapshot: %d, %v", n, err)
+	}
+	stale, _ := kl.Limiter("stale")
+	stale.AllowN(2)
+	clock.Advance(45 * time.Second)
+	busy, _ := kl.Limiter("busy")
+	busy.AllowN(2)
+	if err := kl.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart 30s later, by which time stale has been idle for over the TTL
+	clock.Advance(30 * time.Second)
+	restarted := NewKeyedLimiter(ClientIP, factory, config, WithClock(clock))
+	if n, err := restarted.LoadSnapshot(path); n != 1 || err != nil {
+		t.Fatalf("restored %d keys, %v, want only the busy one", n, err)
+	}
+	if limiter, _ := restarted.Limiter("busy"); limiter.Allow() {
+		t.Fatal("restart handed a client a fresh quota")
+	}
+	if limiter, _ := restarted.Limiter("stale"); !limiter.Allow() {
+		t.Fatal("an expired key should start afresh")
+	}
+
+	// A change of algorithm restores nothing
+	other := NewKeyedLimiter(ClientIP, func(string) RateLimiter { return NewGCRA(2, time.Second) }, config, WithClock(clock))
+	if n, err := other.LoadSnapshot(path); n != 0 || err != nil {
+		t.Fatalf("restored %d keys, %v, into another algorithm", n, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("%d files left beside the snapshot, want none", len(entries)-1)
+	}
+}
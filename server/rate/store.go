@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store holds limiter state outside the process, so that several Limitly
+// instances behind a load balancer can share one limit
+type Store interface {
+	// Incr adds delta to the integer at key and returns the result. A missing
+	// or expired key counts as zero and is created to expire after ttl.
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// Get returns the value at key, or ok false if there is none
+	Get(ctx context.Context, key string) (value string, ok bool, err error)
+	// CompareAndSwap sets key to new, expiring after ttl, if it currently
+	// holds old. An empty old only matches a missing key.
+	CompareAndSwap(ctx context.Context, key, old, new string, ttl time.Duration) (bool, error)
+}
+
+type memoryValue struct {
+	value   string
+	expires time.Time
+}
+
+// MemoryStore is a Store kept in process memory. It shares nothing between
+// instances, but lets the store-backed limiters run without a server.
+type MemoryStore struct {
+	values    map[string]memoryValue
+	lastSweep time.Time
+	clock     Clock
+	mutex     sync.Mutex
+}
+
+// NewMemoryStore creates a new MemoryStore
+func NewMemoryStore(opts ...Option) *MemoryStore {
+	o := newOptions(opts)
+	return &MemoryStore{
+		values:    make(map[string]memoryValue),
+		lastSweep: o.clock.Now(),
+		clock:     o.clock,
+	}
+}
+
+// Incr adds delta to the integer at key and returns the result
+func (ms *MemoryStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := ms.clock.Now()
+	v, ok := ms.get(now, key)
+	var n int64
+	if ok {
+		var err error
+		if n, err = strconv.ParseInt(v.value, 10, 64); err != nil {
+			return 0, err
+		}
+	} else {
+		v.expires = now.Add(ttl)
+	}
+	n += delta
+	v.value = strconv.FormatInt(n, 10)
+	ms.values[key] = v
+	return n, nil
+}
+
+// Get returns the value at key, or ok false if there is none
+func (ms *MemoryStore) Get(ctx context.Context, key string) (string, bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	v, ok := ms.get(ms.clock.Now(), key)
+	return v.value, ok, nil
+}
+
+// CompareAndSwap sets key to new if it currently holds old
+func (ms *MemoryStore) CompareAndSwap(ctx context.Context, key, old, new string, ttl time.Duration) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := ms.clock.Now()
+	v, ok := ms.get(now, key)
+	if ok != (old != "") || v.value != old {
+		return false, nil
+	}
+	ms.values[key] = memoryValue{value: new, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Len returns the number of keys that haven't expired
+func (ms *MemoryStore) Len() int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.sweep(ms.clock.Now())
+	return len(ms.values)
+}
+
+// get returns the unexpired value at key, dropping expired keys now and then
+func (ms *MemoryStore) get(now time.Time, key string) (memoryValue, bool) {
+	if now.Sub(ms.lastSweep) >= time.Minute {
+		ms.sweep(now)
+	}
+	v, ok := ms.values[key]
+	if ok && !now.Before(v.expires) {
+		delete(ms.values, key)
+		return memoryValue{}, false
+	}
+	return v, ok
+}
+
+func (ms *MemoryStore) sweep(now time.Time) {
+	ms.lastSweep = now
+	for key, v := range ms.values {
+		if !now.Before(v.expires) {
+			delete(ms.values, key)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// respSimple is a simple string reply, as opposed to a bulk string
+type respSimple string
+
+type respValue struct {
+	value   string
+	expires time.Time
+}
+
+// respServer is a stand-in for Redis that understands the commands RESPStore
+// sends, so its tests don't need a real server
+type respServer struct {
+	listener net.Listener
+	values   map[string]respValue
+	versions map[string]int64
+	mutex    sync.Mutex
+}
+
+func newRESPServer(t *testing.T) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respServer{
+		listener: listener,
+		values:   make(map[string]respValue),
+		versions: make(map[string]int64),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *respServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	c := newRESPConn(conn)
+
+	var queued [][]string
+	var watched map[string]int64
+	inMulti := false
+	for {
+		request, err := c.read()
+		if err != nil {
+			return
+		}
+		items, _ := request.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		var reply any
+		switch strings.ToUpper(args[0]) {
+		case "MULTI":
+			inMulti, queued = true, nil
+			reply = respSimple("OK")
+		case "EXEC":
+			s.mutex.Lock()
+			aborted := false
+			for key, version := range watched {
+				aborted = aborted || s.versions[key] != version
+			}
+			if !aborted {
+				results := make([]any, len(queued))
+				for i, cmd := range queued {
+					results[i] = s.run(cmd)
+				}
+				reply = results
+			}
+			s.mutex.Unlock()
+			inMulti, queued, watched = false, nil, nil
+		case "WATCH":
+			s.mutex.Lock()
+			if watched == nil {
+				watched = make(map[string]int64)
+			}
+			for _, key := range args[1:] {
+				watched[key] = s.versions[key]
+			}
+			s.mutex.Unlock()
+			reply = respSimple("OK")
+		case "UNWATCH":
+			watched = nil
+			reply = respSimple("OK")
+		default:
+			if inMulti {
+				queued = append(queued, args)
+				reply = respSimple("QUEUED")
+			} else {
+				s.mutex.Lock()
+				reply = s.run(args)
+				s.mutex.Unlock()
+			}
+		}
+		writeRESP(c, reply)
+		if c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// run executes a data command; the caller holds the mutex
+func (s *respServer) run(args []string) any {
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+	v, exists := s.values[key]
+	if exists && !time.Now().Before(v.expires) {
+		delete(s.values, key)
+		exists = false
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if !exists {
+			return nil
+		}
+		return v.value
+	case "SET":
+		ttl := 24 * time.Hour
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return nil
+				}
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				ttl = time.Duration(ms) * time.Millisecond
+			}
+		}
+		s.set(key, respValue{value: args[2], expires: time.Now().Add(ttl)})
+		return respSimple("OK")
+	case "INCRBY":
+		n, _ := strconv.ParseInt(v.value, 10, 64)
+		delta, _ := strconv.ParseInt(args[2], 10, 64)
+		if !exists {
+			v.expires = time.Now().Add(24 * time.Hour)
+		}
+		v.value = strconv.FormatInt(n+delta, 10)
+		s.set(key, v)
+		return n + delta
+	}
+	return respError("ERR unknown command " + args[0])
+}
+
+func (s *respServer) set(key string, v respValue) {
+	s.values[key] = v
+	s.versions[key]++
+}
+
+func writeRESP(c *respConn, reply any) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprint(c.w, "$-1\r\n")
+	case respSimple:
+		fmt.Fprintf(c.w, "+%s\r\n", v)
+	case respError:
+		fmt.Fprintf(c.w, "-%s\r\n", string(v))
+	case string:
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(v), v)
+	case int64:
+		fmt.Fprintf(c.w, ":%d\r\n", v)
+	case []any:
+		if v == nil {
+			fmt.Fprint(c.w, "*-1\r\n")
+			return
+		}
+		fmt.Fprintf(c.w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRESP(c, item)
+		}
+	}
+}
+
+// testStore checks the Store contract. expire moves the store's time on by d.
+func testStore(t *testing.T, store Store, expire func(d time.Duration)) {
+	ctx := context.Background()
+
+	if _, ok, err := store.Get(ctx, "missing"); ok || err != nil {
+		t.Fatalf("Get of a missing key: ok %v, err %v", ok, err)
+	}
+	for i, want := range []int64{3, 5, 4} {
+		n, err := store.Incr(ctx, "counter", []int64{3, 2, -1}[i], 100*ms)
+		if err != nil || n != want {
+			t.Fatalf("Incr %d: %d, %v, want %d", i, n, err, want)
+		}
+	}
+	if value, ok, err := store.Get(ctx, "counter"); !ok || err != nil || value != "4" {
+		t.Fatalf("Get: %q, %v, %v, want 4", value, ok, err)
+	}
+
+	if swapped, err := store.CompareAndSwap(ctx, "cas", "x", "y", time.Minute); swapped || err != nil {
+		t.Fatalf("CAS of a missing key from a value: %v, %v", swapped, err)
+	}
+	if swapped, err := store.CompareAndSwap(ctx, "cas", "", "a", time.Minute); !swapped || err != nil {
+		t.Fatalf("CAS creating a key: %v, %v", swapped, err)
+	}
+	if swapped, err := store.CompareAndSwap(ctx, "cas", "", "b", time.Minute); swapped || err != nil {
+		t.Fatalf("CAS from missing on an existing key: %v, %v", swapped, err)
+	}
+	if swapped, err := store.CompareAndSwap(ctx, "cas", "a", "b", 100*ms); !swapped || err != nil {
+		t.Fatalf("CAS from the current value: %v, %v", swapped, err)
+	}
+
+	expire(150 * ms)
+	if _, ok, _ := store.Get(ctx, "counter"); ok {
+		t.Fatal("counter outlived its TTL")
+	}
+	if _, ok, _ := store.Get(ctx, "cas"); ok {
+		t.Fatal("swapped value outlived its TTL")
+	}
+	if n, err := store.Incr(ctx, "counter", 1, time.Minute); n != 1 || err != nil {
+		t.Fatalf("Incr after expiry: %d, %v, want 1", n, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	testStore(t, NewMemoryStore(WithClock(clock)), clock.Advance)
+}
+
+func TestRESPStore(t *testing.T) {
+	server := newRESPServer(t)
+	store := NewRESPStore(server.addr(), 4, time.Second)
+	defer store.Close()
+	testStore(t, store, time.Sleep)
+}
+
+// storeLimiters builds each store-backed limiter with a limit of 5 requests
+// a minute
+var storeLimiters = []struct {
+	name string
+	new  func(store Store, c Clock, opts ...Option) RateLimiter
+}{
+	{"token_bucket", func(store Store, c Clock, opts ...Option) RateLimiter {
+		return NewStoreTokenBucket(store, "tb", 5, 1.0/12, append(opts, WithClock(c))...)
+	}},
+	{"fixed_window", func(store Store, c Clock, opts ...Option) RateLimiter {
+		return NewStoreFixedWindow(store, "fw", 5, time.Minute, append(opts, WithClock(c))...)
+	}},
+	{"sliding_window_counter", func(store Store, c Clock, opts ...Option) RateLimiter {
+		return NewStoreSlidingWindowCounter(store, "swc", 5, time.Minute, append(opts, WithClock(c))...)
+	}},
+}
+
+func TestStoreLimitersShareOneLimit(t *testing.T) {
+	server := newRESPServer(t)
+	store := NewRESPStore(server.addr(), 16, time.Second)
+	defer store.Close()
+
+	for _, tc := range storeLimiters {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			// Two instances behind a load balancer, each admitting concurrently
+			instances := []RateLimiter{tc.new(store, clock), tc.new(store, clock)}
+			var admitted atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(limiter RateLimiter) {
+					defer wg.Done()
+					if limiter.Allow() {
+						admitted.Add(1)
+					}
+				}(instances[i%2])
+			}
+			wg.Wait()
+			if admitted.Load() != 5 {
+				t.Fatalf("admitted %d across both instances, want the shared limit of 5", admitted.Load())
+			}
+		})
+	}
+}
+
+// flakyStore is a MemoryStore that fails every call while fail is set
+type flakyStore struct {
+	*MemoryStore
+	fail atomic.Bool
+}
+
+var errFlaky = errors.New("store unavailable")
+
+func (fs *flakyStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	if fs.fail.Load() {
+		return 0, errFlaky
+	}
+	return fs.MemoryStore.Incr(ctx, key, delta, ttl)
+}
+
+func (fs *flakyStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if fs.fail.Load() {
+		return "", false, errFlaky
+	}
+	return fs.MemoryStore.Get(ctx, key)
+}
+
+func (fs *flakyStore) CompareAndSwap(ctx context.Context, key, old, new string, ttl time.Duration) (bool, error) {
+	if fs.fail.Load() {
+		return false, errFlaky
+	}
+	return fs.MemoryStore.CompareAndSwap(ctx, key, old, new, ttl)
+}
+
+func TestStoreLimitersCancelFailOpenReservation(t *testing.T) {
+	limiters := append(storeLimiters, struct {
+		name string
+		new  func(store Store, c Clock, opts ...Option) RateLimiter
+	}{"quota", func(store Store, c Clock, opts ...Option) RateLimiter {
+		return NewStoreQuota(store, "q", 5, PeriodDay, time.UTC, append(opts, WithClock(c))...)
+	}})
+	for _, tc := range limiters {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			store := &flakyStore{MemoryStore: NewMemoryStore(WithClock(clock))}
+			limiter := tc.new(store, clock)
+			part := limiter.(Reserver)
+
+			// A reservation made while the store is down takes nothing, so
+			// handing it back once the store recovers must give nothing back
+			store.fail.Store(true)
+			at, ok := part.ReserveN(clock.Now(), 1)
+			if !ok || until(clock.Now(), at) != 0 {
+				t.Fatal("should fail open by default")
+			}
+			store.fail.Store(false)
+			part.CancelN(clock.Now(), at, 1)
+
+			admitted := 0
+			for i := 0; i < 10; i++ {
+				if limiter.Allow() {
+					admitted++
+				}
+			}
+			if admitted != 5 {
+				t.Fatalf("admitted %d after cancelling a fail-open reservation, want the limit of 5", admitted)
+			}
+		})
+	}
+}
+
+func TestStoreLimitersOnStoreFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	store := NewRESPStore(addr, 1, 100*ms)
+
+	for _, tc := range storeLimiters {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := NewFakeClock(epoch)
+			if !tc.new(store, clock).Allow() {
+				t.Fatal("should fail open by default")
+			}
+			if tc.new(store, clock, WithFailClosed()).Allow() {
+				t.Fatal("should fail closed WithFailClosed")
+			}
+			limiter := tc.new(store, clock).(interface {
+				DecideContext(ctx context.Context, n int) (Decision, error)
+			})
+			if _, err := limiter.DecideContext(context.Background(), 1); err == nil {
+				t.Fatal("DecideContext should return the store's error")
+			}
+		})
+	}
+
+	store.Close()
+	if _, err := store.Incr(context.Background(), "k", 1, time.Second); !errors.Is(err, ErrStoreClosed) {
+		t.Fatalf("got %v after Close, want ErrStoreClosed", err)
+	}
+}